@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// capturedPacket is a single entry of a capture file: an uplink packet along
+// with the time elapsed since the start of the capture when it was received
+type capturedPacket struct {
+	Offset time.Duration  `json:"offset"`
+	Packet wrapper.Packet `json:"packet"`
+}
+
+// recorder serialises received packets to a capture file, one JSON object per line
+type recorder struct {
+	lock  sync.Mutex
+	start time.Time
+	file  *os.File
+	buf   *bufio.Writer
+	enc   *json.Encoder
+}
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(file)
+	return &recorder{
+		start: time.Now(),
+		file:  file,
+		buf:   buf,
+		enc:   json.NewEncoder(buf),
+	}, nil
+}
+
+// tee returns a receiver recording every packet returned by recv
+func (r *recorder) tee(recv receiver) receiver {
+	return func() ([]wrapper.Packet, error) {
+		packets, err := recv()
+		if err != nil || len(packets) == 0 {
+			return packets, err
+		}
+		if err := r.record(packets); err != nil {
+			return nil, err
+		}
+		return packets, nil
+	}
+}
+
+func (r *recorder) record(packets []wrapper.Packet) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	offset := time.Since(r.start)
+	for _, pkt := range packets {
+		if err := r.enc.Encode(capturedPacket{offset, pkt}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the pending entries and closes the capture file
+func (r *recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.buf.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// replayer reads back a capture file, handing out packets with their original timing
+type replayer struct {
+	start time.Time
+	file  *os.File
+	dec   *json.Decoder
+	next  *capturedPacket
+}
+
+func newReplayer(path string) (*replayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &replayer{
+		start: time.Now(),
+		file:  file,
+		dec:   json.NewDecoder(bufio.NewReader(file)),
+	}, nil
+}
+
+// receive behaves like Concentrator.Receive: it returns the packets due since the
+// last call, or none if the next one isn't due yet. io.EOF is returned once
+// the whole capture has been replayed.
+func (r *replayer) receive() ([]wrapper.Packet, error) {
+	var packets []wrapper.Packet
+	elapsed := time.Since(r.start)
+	for {
+		if r.next == nil {
+			var entry capturedPacket
+			if err := r.dec.Decode(&entry); err != nil {
+				if err == io.EOF && len(packets) > 0 {
+					return packets, nil
+				}
+				return packets, err
+			}
+			r.next = &entry
+		}
+		if r.next.Offset > elapsed {
+			return packets, nil
+		}
+		pkt := r.next.Packet
+		pkt.ReceivedAt = time.Now()
+		packets = append(packets, pkt)
+		r.next = nil
+	}
+}
+
+func (r *replayer) Close() error {
+	return r.file.Close()
+}
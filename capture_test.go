@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// capturePackets returns packets the way the concentrator would: the first batch at
+// once, the second after the gap
+func capturePackets() [][]wrapper.Packet {
+	first := testPacket(1, time.Time{})
+	first.Payload = []byte{1, 2, 3}
+	first.Size = 3
+	first.RSSI = -80
+	first.SNR = 7.5
+	second := testPacket(2, time.Time{})
+	if err := second.SetLoRa(9, 125000); err != nil {
+		panic(err)
+	}
+	third := testPacket(3, time.Time{})
+	third.Freq = 922300000
+	return [][]wrapper.Packet{{first, second}, {third}}
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	const gap = 100 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	batches := capturePackets()
+
+	rec, err := newRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	receive := rec.tee(func() ([]wrapper.Packet, error) {
+		calls++
+		return batches[calls-1], nil
+	})
+	for i := range batches {
+		if i > 0 {
+			time.Sleep(gap)
+		}
+		if _, err := receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The packets come back in their batches, as far apart as they were received
+	rep, err := newReplayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rep.Close()
+	var replayed [][]wrapper.Packet
+	var offsets []time.Duration
+	for {
+		packets, err := rep.receive()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packets) == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		offsets = append(offsets, time.Since(rep.start))
+		for i := range packets {
+			if packets[i].ReceivedAt.IsZero() {
+				t.Error("Replayed packet without reception time")
+			}
+			packets[i].ReceivedAt = time.Time{}
+		}
+		replayed = append(replayed, packets)
+	}
+	if !reflect.DeepEqual(replayed, batches) {
+		t.Fatalf("Replayed %+v, expected %+v", replayed, batches)
+	}
+	if between := offsets[1] - offsets[0]; between < gap-10*time.Millisecond || between > gap+50*time.Millisecond {
+		t.Errorf("Batches replayed %v apart, expected %v", between, gap)
+	}
+}
+
+func TestReplayRepeatsQueuedPackets(t *testing.T) {
+	rep, err := newRepeater(testConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The whole capture is read before the first repeat is over
+	batches := capturePackets()
+	receive := func() ([]wrapper.Packet, error) {
+		if len(batches) == 0 {
+			return nil, io.EOF
+		}
+		packets := batches[0]
+		batches = batches[1:]
+		for i := range packets {
+			packets[i].ReceivedAt = time.Now()
+		}
+		return packets, nil
+	}
+	var emitted int32
+	transmit := func(wrapper.Packet, wrapper.TxParams) error {
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&emitted, 1)
+		return nil
+	}
+
+	conf := defaultConf()
+	sigc := make(chan os.Signal, 1)
+	code, running := superviseRoutines(rep, &conf, repeaterOptions{replayPath: "capture.jsonl"}, nil, receive, transmit, sigc)
+	if code != exitOK {
+		t.Errorf("Exit code %d", code)
+	}
+	rep.stopRoutines(running)
+	if n := atomic.LoadInt32(&emitted); n != 3 {
+		t.Errorf("%d packets repeated, expected 3", n)
+	}
+	if dropped := atomic.LoadUint64(&rep.stats.dropped); dropped != 0 {
+		t.Errorf("%d packets dropped", dropped)
+	}
+}
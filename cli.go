@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Process exit codes
+const (
+	exitOK            = 0 // success
+	exitFailure       = 1 // runtime failure, e.g. concentrator error
+	exitUsage         = 2 // invalid command line
+	exitInvalidConfig = 3 // the configuration couldn't be loaded or is invalid
+)
+
+type command struct {
+	name  string
+	args  string
+	desc  string
+	setup func(fs *flag.FlagSet) func(args []string) int // registers the flags and returns the command body
+}
+
+func commands() []command {
+	return []command{
+		{"run", "[-record file]", "run the repeater", runCmd},
+		{"validate-config", "", "check the configuration without touching the concentrator", validateConfigCmd},
+		{"dump-config", "", "print the effective configuration", dumpConfigCmd},
+		{"capture", "-o file", "record received uplinks without repeating them", captureCmd},
+		{"replay", "file", "repeat uplinks from a capture file, logging instead of transmitting", replayCmd},
+		{"board", "", "drive the board of this build for a repeater running several, over stdin and stdout", boardCmd},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.desc)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// runCommand dispatches the command line to the matching command and returns the exit code
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return exitUsage
+	}
+	if args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage()
+		return exitOK
+	}
+
+	for _, cmd := range commands() {
+		if cmd.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n\n%s\n\nFlags:\n", os.Args[0], cmd.name, cmd.args, cmd.desc)
+			fs.PrintDefaults()
+		}
+		run := cmd.setup(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			if err == flag.ErrHelp {
+				return exitOK
+			}
+			return exitUsage
+		}
+		return run(fs.Args())
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	usage()
+	return exitUsage
+}
+
+type confFlags struct {
+	globalPath string
+	localPath  string
+}
+
+func addConfFlags(fs *flag.FlagSet) *confFlags {
+	var f confFlags
+	fs.StringVar(&f.globalPath, "config", "global_conf.json", "global configuration `file`")
+	fs.StringVar(&f.localPath, "local", "local_conf.json", "local configuration `file` overriding the global one, ignored if missing")
+	return &f
+}
+
+// load returns the effective configuration, printing the error if there is one
+func (f *confFlags) load(strict bool) (globalConf, bool) {
+	conf, err := loadConf(f.globalPath, f.localPath, strict)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return conf, false
+	}
+	return conf, true
+}
+
+// loadValid is like load, but also validates the configuration, printing every violation
+func (f *confFlags) loadValid(strict bool) (globalConf, bool) {
+	return f.loadChecked(strict, (*globalConf).validate)
+}
+
+// loadReplayable is like loadValid, but skips the checks of the hardware configuration
+func (f *confFlags) loadReplayable() (globalConf, bool) {
+	return f.loadChecked(false, (*globalConf).validateRepeater)
+}
+
+func (f *confFlags) loadChecked(strict bool, validate func(*globalConf) error) (globalConf, bool) {
+	conf, ok := f.load(strict)
+	if !ok {
+		return conf, false
+	}
+	if err := validate(&conf); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%s\n", err)
+		return conf, false
+	}
+	return conf, true
+}
+
+func noArgs(fs *flag.FlagSet, args []string) bool {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %v\n", args)
+		fs.Usage()
+		return false
+	}
+	return true
+}
+
+func runCmd(fs *flag.FlagSet) func(args []string) int {
+	conf := addConfFlags(fs)
+	recordPath := fs.String("record", "", "also record received uplink packets to `file`")
+	return func(args []string) int {
+		if !noArgs(fs, args) {
+			return exitUsage
+		}
+		c, ok := conf.loadValid(false)
+		if !ok {
+			return exitInvalidConfig
+		}
+		return runRepeater(c, repeaterOptions{
+			recordPath: *recordPath,
+			reload:     func() (globalConf, bool) { return conf.loadValid(false) },
+		})
+	}
+}
+
+func validateConfigCmd(fs *flag.FlagSet) func(args []string) int {
+	conf := addConfFlags(fs)
+	return func(args []string) int {
+		if !noArgs(fs, args) {
+			return exitUsage
+		}
+		if _, ok := conf.loadValid(true); !ok {
+			return exitInvalidConfig
+		}
+		fmt.Println("Configuration is valid")
+		return exitOK
+	}
+}
+
+func dumpConfigCmd(fs *flag.FlagSet) func(args []string) int {
+	conf := addConfFlags(fs)
+	return func(args []string) int {
+		if !noArgs(fs, args) {
+			return exitUsage
+		}
+		c, ok := conf.load(false)
+		if !ok {
+			return exitInvalidConfig
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(c); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		return exitOK
+	}
+}
+
+func captureCmd(fs *flag.FlagSet) func(args []string) int {
+	conf := addConfFlags(fs)
+	output := fs.String("o", "", "capture `file` to write")
+	return func(args []string) int {
+		if !noArgs(fs, args) {
+			return exitUsage
+		}
+		if *output == "" {
+			fmt.Fprintln(os.Stderr, "Missing capture file")
+			fs.Usage()
+			return exitUsage
+		}
+		c, ok := conf.loadValid(false)
+		if !ok {
+			return exitInvalidConfig
+		}
+		return runRepeater(c, repeaterOptions{recordPath: *output, listenOnly: true})
+	}
+}
+
+func replayCmd(fs *flag.FlagSet) func(args []string) int {
+	conf := addConfFlags(fs)
+	return func(args []string) int {
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "Expected a single capture file")
+			fs.Usage()
+			return exitUsage
+		}
+		c, ok := conf.loadReplayable()
+		if !ok {
+			return exitInvalidConfig
+		}
+		return runRepeater(c, repeaterOptions{
+			replayPath: args[0],
+			reload:     conf.loadReplayable,
+		})
+	}
+}
+
+func boardCmd(fs *flag.FlagSet) func(args []string) int {
+	return func(args []string) int {
+		if !noArgs(fs, args) {
+			return exitUsage
+		}
+		// The repeater stops the board on a signal, then closes the standard input
+		signal.Ignore(os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		// The repeater reads the responses on the standard output, the logs go to the
+		// standard error
+		responses := os.Stdout
+		os.Stdout = os.Stderr
+		if err := wrapper.ServeWorker(os.Stdin, responses); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		return exitOK
+	}
+}
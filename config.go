@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/gpio"
+	"github.com/NaNkeen/packet_repeater/gwmp"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/policy"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type serverConf struct {
+	ServerAddress string `json:"server_address"`
+	ServPortUp    int    `json:"serv_port_up"`
+	ServPortDown  int    `json:"serv_port_down"`
+	ServEnabled   bool   `json:"serv_enabled"`
+}
+
+type gatewayConf struct {
+	GatewayID     *string      `json:"gateway_ID,omitempty"`
+	ServerAddress string       `json:"server_address,omitempty"`
+	ServPortUp    int          `json:"serv_port_up,omitempty"`
+	ServPortDown  int          `json:"serv_port_down,omitempty"`
+	Servers       []serverConf `json:"servers,omitempty"`
+	StatInterval  int          `json:"stat_interval"` // in seconds
+	GPSTTYPath    string       `json:"gps_tty_path,omitempty"`
+	FakeGPS       bool         `json:"fake_gps,omitempty"` // report the reference location instead of the GPS one
+	RefLatitude   float64      `json:"ref_latitude,omitempty"`
+	RefLongitude  float64      `json:"ref_longitude,omitempty"`
+	RefAltitude   int16        `json:"ref_altitude,omitempty"`
+	StatePath     string       `json:"state_path,omitempty"`     // file keeping the repeater state across restarts, in memory only if empty
+	ReceiveBoards []int        `json:"receive_boards,omitempty"` // boards whose uplinks are repeated, 0 being the one of SX1301_conf and i the i-th of boards, all if empty
+	TransmitBoard int          `json:"transmit_board,omitempty"` // board emitting the repeats
+}
+
+// upstreamServers returns the host:port of the enabled servers, or of the single
+// server configured the legacy way if the list is empty
+func (c *gatewayConf) upstreamServers() []string {
+	var servers []string
+	for _, server := range c.Servers {
+		if server.ServEnabled {
+			servers = append(servers, net.JoinHostPort(server.ServerAddress, strconv.Itoa(server.ServPortUp)))
+		}
+	}
+	if len(c.Servers) == 0 && c.ServerAddress != "" {
+		servers = append(servers, net.JoinHostPort(c.ServerAddress, strconv.Itoa(c.ServPortUp)))
+	}
+	return servers
+}
+
+// changes returns the keys of the settings which differ in other. They are only
+// applied when the repeater starts.
+func (c *gatewayConf) changes(other *gatewayConf) []string {
+	var keys []string
+	v, o := reflect.ValueOf(c).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !reflect.DeepEqual(v.Field(i).Interface(), o.Field(i).Interface()) {
+			key := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+			keys = append(keys, "gateway_conf."+key)
+		}
+	}
+	return keys
+}
+
+// repeaterConf holds the repeater policy, which can be changed without restarting the concentrator
+type repeaterConf struct {
+	RfPower       int8               `json:"rf_power"`                 // TX power of the repeats, in dBm
+	Frequencies   []uint32           `json:"frequencies,omitempty"`    // only repeat packets received on these frequencies (in Hz), any if empty
+	MinRSSI       *float32           `json:"min_rssi,omitempty"`       // only repeat packets received with at least this RSSI (in dB)
+	QueueSize     int                `json:"queue_size"`               // packets waiting to be repeated, beyond which the lowest priority ones are shed. Applied on restart.
+	MaxQueueAge   int                `json:"max_queue_age_ms"`         // repeats still queued this long after their reception are shed, in milliseconds
+	GPSSlots      *gpsSlotsConf      `json:"gps_slots,omitempty"`      // repeat in GPS time slots instead of immediately
+	LBTRetries    int                `json:"lbt_retries"`              // attempts after LBT found the channel busy, before dropping the packet
+	LBTBackoff    int                `json:"lbt_backoff_ms"`           // wait before the first retry, in milliseconds, doubled at each retry
+	Rules         []policy.Rule      `json:"rules,omitempty"`          // repeat policy, the first rule matching a packet applies
+	RulesFile     string             `json:"rules_file,omitempty"`     // JSON or YAML file of rules, appended to the ones above
+	DefaultAction string             `json:"default_action,omitempty"` // repeat or drop the packets which match no rule, repeat if empty
+	Script        *scriptConf        `json:"script,omitempty"`         // Lua script deciding before the rules
+	RateLimit     *rateLimitConf     `json:"rate_limit,omitempty"`     // limits on the repeats the policy decided
+	DutyCycle     *dutyCycleConf     `json:"duty_cycle,omitempty"`     // airtime budget of the repeats, by priority
+	ReplayProtect bool               `json:"replay_protection"`        // refuse data uplinks of devices in keys_file whose frame counter isn't newer than their last one
+	MaxFCntGap    uint32             `json:"max_fcnt_gap"`             // frame counters further ahead of the last one of their device are taken as replays
+	KeysFile      string             `json:"keys_file,omitempty"`      // JSON or YAML file of session keys, the data uplinks of these devices are only repeated with a valid MIC
+	KnownOnly     bool               `json:"known_devices_only"`       // only repeat the data uplinks of the devices of the keys file
+	DownlinkRelay *downlinkRelayConf `json:"downlink_relay,omitempty"` // relay the downlinks answering the repeated uplinks
+	TS011Relay    *ts011RelayConf    `json:"ts011_relay,omitempty"`    // forward the uplinks to the network as a TS011 relay instead of repeating them
+	TxRules       []txRule           `json:"tx_rules,omitempty"`       // deprecated, converted into rules on loading
+
+	keys      map[uint32]lorawan.SessionKeys // loaded from KeysFile
+	rulePaths []string                       // where the rules not written in Rules come from, see rulePath
+}
+
+// rulePath tells where the i-th rule was written, for the configuration errors
+func (c *repeaterConf) rulePath(i int) string {
+	if i < len(c.rulePaths) && c.rulePaths[i] != "" {
+		return c.rulePaths[i]
+	}
+	return fmt.Sprintf("repeater_conf.rules[%d]", i)
+}
+
+// addRule appends a rule which isn't written in Rules, from path
+func (c *repeaterConf) addRule(rule policy.Rule, path string) {
+	for len(c.rulePaths) < len(c.Rules) {
+		c.rulePaths = append(c.rulePaths, "")
+	}
+	c.Rules = append(c.Rules, rule)
+	c.rulePaths = append(c.rulePaths, path)
+}
+
+// txRule overrides how the packets it matches are emitted. It predates rules, which
+// replace it.
+type txRule struct {
+	Frequencies []uint32 `json:"frequencies,omitempty"` // match packets received on these frequencies (in Hz), any if empty
+	Modulation  string   `json:"modulation,omitempty"`  // match LORA or FSK packets, any if empty
+	InvertPol   *bool    `json:"invert_pol,omitempty"`  // emit with inverted IQ or not, instead of the polarity of the packet
+	Preamble    uint16   `json:"preamble,omitempty"`    // preamble length, in symbols for LoRa and bytes for FSK, the packet one if 0
+}
+
+// convertTxRules appends to the rules a repeat rule for every tx_rules entry, which
+// only applies to the packets no other rule matches, like before rules existed
+func convertTxRules(conf *repeaterConf) {
+	if len(conf.TxRules) == 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "repeater_conf.tx_rules is deprecated, converted into rules: move them to repeater_conf.rules")
+	for i, txRule := range conf.TxRules {
+		conf.addRule(policy.Rule{
+			Name: fmt.Sprintf("tx_rules[%d]", i),
+			Match: policy.Match{
+				Frequencies: txRule.Frequencies,
+				Modulation:  txRule.Modulation,
+			},
+			Action:    policy.ActionRepeat,
+			InvertPol: txRule.InvertPol,
+			Preamble:  txRule.Preamble,
+		}, fmt.Sprintf("repeater_conf.tx_rules[%d]", i))
+	}
+	conf.TxRules = nil
+}
+
+// scriptConf configures the Lua repeat policy, see policy.Script
+type scriptConf struct {
+	Path   string `json:"path"`
+	Budget int    `json:"budget_ms"` // time allowed per packet, in milliseconds
+}
+
+// gpsSlotsConf divides GPS time into periods, in each of which the repeater only
+// emits within its slot. Repeaters sharing the period with disjoint slots never
+// transmit simultaneously.
+type gpsSlotsConf struct {
+	Period int `json:"period_ms"` // in milliseconds, slots repeat every period since the GPS epoch
+	Offset int `json:"offset_ms"` // start of the slot within the period, in milliseconds
+	Length int `json:"length_ms"` // in milliseconds, a repeat must fit entirely in the slot
+}
+
+func (c *gpsSlotsConf) validate(prefix string) wrapper.ConfigErrors {
+	var errs wrapper.ConfigErrors
+	if c.Period <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".period_ms", Message: fmt.Sprintf("%d ms is not a valid period", c.Period)})
+	}
+	if c.Length <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".length_ms", Message: fmt.Sprintf("%d ms is not a valid slot length", c.Length)})
+	}
+	if c.Offset < 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".offset_ms", Message: fmt.Sprintf("%d ms is not a valid offset", c.Offset)})
+	} else if c.Period > 0 && c.Offset+c.Length > c.Period {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".length_ms", Message: fmt.Sprintf("the slot ends at %d ms, past the %d ms period", c.Offset+c.Length, c.Period)})
+	}
+	return errs
+}
+
+// next returns the GPS time of the first slot starting at or after earliest
+func (c *gpsSlotsConf) next(earliest time.Duration) time.Duration {
+	period := time.Duration(c.Period) * time.Millisecond
+	start := earliest - earliest%period + time.Duration(c.Offset)*time.Millisecond
+	if start < earliest {
+		start += period
+	}
+	return start
+}
+
+// accepts checks a received packet against the filters of the configuration
+func (c *repeaterConf) accepts(pkt wrapper.Packet) bool {
+	if c.MinRSSI != nil && pkt.RSSI < *c.MinRSSI {
+		return false
+	}
+	if len(c.Frequencies) == 0 {
+		return true
+	}
+	for _, freq := range c.Frequencies {
+		if pkt.Freq == freq {
+			return true
+		}
+	}
+	return false
+}
+
+// policy builds the repeat policy of the configuration
+func (c *repeaterConf) policy() (policy.Policy, error) {
+	rules, err := policy.NewRuleSet(c.Rules, c.DefaultAction)
+	if err != nil || c.Script == nil {
+		return rules, err
+	}
+	return policy.NewScript(c.Script.Path, time.Duration(c.Script.Budget)*time.Millisecond, rules)
+}
+
+// resetConf describes the GPIO line wired to the reset pin of the concentrator
+type resetConf struct {
+	Backend   string `json:"backend"`              // "sysfs" or "chardev"
+	Pin       int    `json:"pin"`                  // BCM pin number, which is also the line offset on the chip
+	ActiveLow bool   `json:"active_low"`           // the reset is asserted by driving the pin low
+	Chip      string `json:"chip,omitempty"`       // GPIO character device, for the chardev backend
+	SysfsRoot string `json:"sysfs_root,omitempty"` // sysfs GPIO directory, for the sysfs backend
+}
+
+func (c *resetConf) validate(prefix string) wrapper.ConfigErrors {
+	var errs wrapper.ConfigErrors
+	if c.Backend != "sysfs" && c.Backend != "chardev" {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".backend", Message: fmt.Sprintf("invalid backend %q, should be sysfs or chardev", c.Backend)})
+	}
+	if c.Pin < 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".pin", Message: fmt.Sprintf("invalid pin %d", c.Pin)})
+	}
+	return errs
+}
+
+func (c *resetConf) opener() gpio.Opener {
+	if c.Backend == "chardev" {
+		return gpio.Chardev{Chip: c.Chip}
+	}
+	return gpio.Sysfs{Root: c.SysfsRoot}
+}
+
+// boardConf is a board driven besides the one of SX1301_conf, by a worker process
+type boardConf struct {
+	Worker string             `json:"worker"` // repeater linked with a libloragw built for the SPI device of the board, run with the board command
+	SX1301 wrapper.SX1301Conf `json:"SX1301_conf"`
+	Reset  *resetConf         `json:"reset_conf,omitempty"` // no reset is performed if missing
+}
+
+// globalConf is the layout of global_conf.json and local_conf.json
+type globalConf struct {
+	SX1301   wrapper.SX1301Conf `json:"SX1301_conf"`
+	Gateway  gatewayConf        `json:"gateway_conf"`
+	Repeater repeaterConf       `json:"repeater_conf"`
+	Reset    *resetConf         `json:"reset_conf,omitempty"` // no reset is performed if missing
+	Boards   []boardConf        `json:"boards,omitempty"`     // other boards, see gateway_conf.receive_boards and transmit_board
+}
+
+// boards returns the configuration of every board, the one of SX1301_conf first
+func (c *globalConf) boards() []boardConf {
+	return append([]boardConf{{SX1301: c.SX1301, Reset: c.Reset}}, c.Boards...)
+}
+
+// receiveBoards returns the boards whose uplinks are repeated
+func (c *globalConf) receiveBoards() []int {
+	if len(c.Gateway.ReceiveBoards) > 0 {
+		return c.Gateway.ReceiveBoards
+	}
+	boards := make([]int, len(c.Boards)+1)
+	for i := range boards {
+		boards[i] = i
+	}
+	return boards
+}
+
+// transmitSX1301 returns the configuration of the board emitting the repeats. Replays
+// don't validate the boards, the one of SX1301_conf stands for an invalid one.
+func (c *globalConf) transmitSX1301() *wrapper.SX1301Conf {
+	if i := c.Gateway.TransmitBoard; i > 0 && i <= len(c.Boards) {
+		return &c.Boards[i-1].SX1301
+	}
+	return &c.SX1301
+}
+
+// validate checks the configuration and returns every violation found
+func (c *globalConf) validate() error {
+	var errs wrapper.ConfigErrors
+	if err := c.SX1301.Validate("SX1301_conf"); err != nil {
+		errs = append(errs, err.(wrapper.ConfigErrors)...)
+	}
+	if err := c.validateRepeater(); err != nil {
+		errs = append(errs, err.(wrapper.ConfigErrors)...)
+	}
+	if c.Reset != nil {
+		errs = append(errs, c.Reset.validate("reset_conf")...)
+	}
+	for i, board := range c.Boards {
+		prefix := fmt.Sprintf("boards[%d]", i)
+		if board.Worker == "" {
+			errs = append(errs, wrapper.ConfigError{Path: prefix + ".worker", Message: "missing"})
+		}
+		if err := board.SX1301.Validate(prefix + ".SX1301_conf"); err != nil {
+			errs = append(errs, err.(wrapper.ConfigErrors)...)
+		}
+		if board.Reset != nil {
+			errs = append(errs, board.Reset.validate(prefix+".reset_conf")...)
+		}
+	}
+	errs = append(errs, c.validateRouting()...)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validateRouting checks the boards receiving and transmitting the repeats. Packets
+// are timestamped by the counter of the board which received them: the repeats
+// scheduled from it have to be emitted by the same board.
+func (c *globalConf) validateRouting() wrapper.ConfigErrors {
+	var errs wrapper.ConfigErrors
+	if n := c.Gateway.TransmitBoard; n < 0 || n > len(c.Boards) {
+		errs = append(errs, wrapper.ConfigError{Path: "gateway_conf.transmit_board", Message: fmt.Sprintf("%d is not a valid board, should be between 0 and %d", n, len(c.Boards))})
+	}
+	onTransmitBoard := true
+	seen := make(map[int]bool)
+	for i, n := range c.Gateway.ReceiveBoards {
+		path := fmt.Sprintf("gateway_conf.receive_boards[%d]", i)
+		switch {
+		case n < 0 || n > len(c.Boards):
+			errs = append(errs, wrapper.ConfigError{Path: path, Message: fmt.Sprintf("%d is not a valid board, should be between 0 and %d", n, len(c.Boards))})
+		case seen[n]:
+			errs = append(errs, wrapper.ConfigError{Path: path, Message: fmt.Sprintf("board %d listed twice", n)})
+		}
+		seen[n] = true
+	}
+	for _, n := range c.receiveBoards() {
+		onTransmitBoard = onTransmitBoard && n == c.Gateway.TransmitBoard
+	}
+	if onTransmitBoard {
+		return errs
+	}
+
+	const message = "requires gateway_conf.receive_boards to only hold the transmit_board, %s are scheduled on the counter of the board which received the uplinks"
+	if c.Repeater.DownlinkRelay != nil {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.downlink_relay", Message: fmt.Sprintf(message, "relayed downlinks")})
+	}
+	if c.Repeater.TS011Relay != nil {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.ts011_relay", Message: fmt.Sprintf(message, "the downlinks forwarded to the devices")})
+	}
+	if lbt := c.transmitSX1301().LbtConfig; lbt != nil && lbt.Enabled {
+		path := "SX1301_conf.lbt_cfg"
+		if n := c.Gateway.TransmitBoard; n > 0 {
+			path = fmt.Sprintf("boards[%d].SX1301_conf.lbt_cfg", n-1)
+		}
+		errs = append(errs, wrapper.ConfigError{Path: path, Message: fmt.Sprintf(message, "the repeats checked by LBT")})
+	}
+	return errs
+}
+
+// validateRepeater checks the configuration but for the hardware, the concentrator and
+// its reset pin, which replays don't use, and returns every violation found
+func (c *globalConf) validateRepeater() error {
+	var errs wrapper.ConfigErrors
+	if c.Gateway.GatewayID != nil {
+		if _, err := gwmp.ParseGatewayID(*c.Gateway.GatewayID); err != nil {
+			errs = append(errs, wrapper.ConfigError{Path: "gateway_conf.gateway_ID", Message: fmt.Sprintf("%q is not valid, should be 16 hexadecimal digits", *c.Gateway.GatewayID)})
+		}
+	}
+	if c.Gateway.StatInterval <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: "gateway_conf.stat_interval", Message: fmt.Sprintf("%d s is not a valid interval", c.Gateway.StatInterval)})
+	}
+	if c.Repeater.QueueSize <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.queue_size", Message: fmt.Sprintf("%d is not a valid queue size", c.Repeater.QueueSize)})
+	}
+	if c.Repeater.MaxQueueAge <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.max_queue_age_ms", Message: fmt.Sprintf("%d ms is not a valid age", c.Repeater.MaxQueueAge)})
+	}
+	if c.Repeater.KnownOnly && c.Repeater.KeysFile == "" {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.known_devices_only", Message: "requires keys_file"})
+	}
+	if c.Repeater.ReplayProtect && c.Repeater.KeysFile == "" {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.replay_protection", Message: "requires keys_file"})
+	}
+	if c.Repeater.MaxFCntGap == 0 {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.max_fcnt_gap", Message: "0 is not a valid gap"})
+	}
+	if c.Repeater.LBTRetries < 0 {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.lbt_retries", Message: fmt.Sprintf("%d is not a valid number of retries", c.Repeater.LBTRetries)})
+	}
+	if c.Repeater.LBTBackoff <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.lbt_backoff_ms", Message: fmt.Sprintf("%d ms is not a valid backoff", c.Repeater.LBTBackoff)})
+	}
+	for i, rule := range c.Repeater.Rules {
+		for _, err := range rule.Validate() {
+			errs = append(errs, wrapper.ConfigError{Path: c.Repeater.rulePath(i) + "." + err.Field, Message: err.Message})
+		}
+	}
+	switch c.Repeater.DefaultAction {
+	case "", policy.ActionRepeat, policy.ActionDrop:
+	default:
+		errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.default_action", Message: fmt.Sprintf("invalid action %q, should be %s or %s", c.Repeater.DefaultAction, policy.ActionRepeat, policy.ActionDrop)})
+	}
+	if script := c.Repeater.Script; script != nil {
+		if script.Path == "" {
+			errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.script.path", Message: "missing"})
+		}
+		if script.Budget <= 0 {
+			errs = append(errs, wrapper.ConfigError{Path: "repeater_conf.script.budget_ms", Message: fmt.Sprintf("%d ms is not a valid time budget", script.Budget)})
+		}
+	}
+	if c.Repeater.RateLimit != nil {
+		errs = append(errs, c.Repeater.RateLimit.validate("repeater_conf.rate_limit")...)
+	}
+	if c.Repeater.DutyCycle != nil {
+		errs = append(errs, c.Repeater.DutyCycle.validate("repeater_conf.duty_cycle")...)
+	}
+	if c.Repeater.DownlinkRelay != nil {
+		errs = append(errs, c.Repeater.DownlinkRelay.validate("repeater_conf.downlink_relay")...)
+	}
+	if c.Repeater.TS011Relay != nil {
+		errs = append(errs, c.Repeater.TS011Relay.validate("repeater_conf.ts011_relay", c.Repeater.DownlinkRelay)...)
+	}
+	if c.Repeater.GPSSlots != nil {
+		errs = append(errs, c.Repeater.GPSSlots.validate("repeater_conf.gps_slots")...)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func defaultConf() globalConf {
+	return globalConf{
+		SX1301: wrapper.DefaultSX1301Conf(),
+		Gateway: gatewayConf{
+			StatInterval: 30,
+		},
+		Repeater: repeaterConf{
+			RfPower:     14,
+			QueueSize:   16,
+			MaxQueueAge: 2000,
+			LBTRetries:  3,
+			LBTBackoff:  50,
+			MaxFCntGap:  16384,
+		},
+	}
+}
+
+// loadConf builds the effective configuration: the built-in defaults, overridden by
+// the global configuration file, itself overridden by the local configuration file if
+// it exists, then completed by the rules file, the deprecated tx_rules and the keys
+// file. In strict mode, unknown keys are reported as errors.
+func loadConf(globalPath, localPath string, strict bool) (globalConf, error) {
+	conf := defaultConf()
+	builtinChannels := true
+	if err := mergeConfFile(&conf, globalPath, strict, &builtinChannels); err != nil {
+		return conf, err
+	}
+	if localPath != "" {
+		if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+			if err := mergeConfFile(&conf, localPath, strict, &builtinChannels); err != nil {
+				return conf, err
+			}
+		}
+	}
+	if err := loadRulesFile(&conf.Repeater); err != nil {
+		return conf, err
+	}
+	convertTxRules(&conf.Repeater)
+	if conf.Repeater.KeysFile != "" {
+		keys, err := loadKeys(conf.Repeater.KeysFile)
+		if err != nil {
+			return conf, err
+		}
+		conf.Repeater.keys = keys
+	}
+	return conf, nil
+}
+
+// loadRulesFile appends the rules of the rules file, if any, to the configuration
+func loadRulesFile(conf *repeaterConf) error {
+	if conf.RulesFile == "" {
+		return nil
+	}
+	rules, err := policy.LoadRules(conf.RulesFile)
+	if err != nil {
+		return err
+	}
+	for i, rule := range rules {
+		conf.addRule(rule, fmt.Sprintf("%s[%d]", conf.RulesFile, i))
+	}
+	return nil
+}
+
+// mergeConfFile decodes a configuration file on top of conf. Objects present in the
+// file are merged key by key, any other value replaces the existing one. The TX gain
+// table and the IF channels are sets instead: a file defining any tx_lut_* entry, or
+// any chan_* channel, replaces the whole table, or all the channels. The built-in
+// channels, still in use while builtinChannels is true, are also dropped by a file
+// defining the radios, as they are placed relative to the built-in radios.
+func mergeConfFile(conf *globalConf, path string, strict bool, builtinChannels *bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keys struct {
+		SX1301 map[string]json.RawMessage `json:"SX1301_conf"`
+	}
+	_ = json.Unmarshal(data, &keys) // errors are reported by the decoding below
+	var luts, channels, radios bool
+	for key := range keys.SX1301 {
+		switch {
+		case strings.HasPrefix(key, "tx_lut_"):
+			luts = true
+		case strings.HasPrefix(key, "chan_"):
+			channels = true
+		case strings.HasPrefix(key, "radio_"):
+			radios = true
+		}
+	}
+	if luts {
+		conf.SX1301.ClearTxLuts()
+	}
+	if channels || radios && *builtinChannels {
+		conf.SX1301.ClearChannels()
+	}
+	if channels || radios {
+		*builtinChannels = false
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(conf); err != nil {
+		return &confFileError{path, err}
+	}
+	return nil
+}
+
+type confFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *confFileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
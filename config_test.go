@@ -0,0 +1,305 @@
+package main
+
+import (
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeConfFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfSets(t *testing.T) {
+	tests := []struct {
+		name     string
+		global   string
+		local    string
+		channels int // enabled multi-SF channels
+		luts     int
+	}{
+		{
+			name:     "defaults",
+			global:   `{}`,
+			channels: 8,
+			luts:     16,
+		},
+		{
+			name:     "channels replace the defaults",
+			global:   `{"SX1301_conf": {"chan_multiSF_0": {"enable": true}, "chan_multiSF_1": {"enable": true}, "chan_multiSF_2": {"enable": true}, "chan_multiSF_3": {"enable": true}}}`,
+			channels: 4,
+			luts:     16,
+		},
+		{
+			name:     "radios drop the default channels",
+			global:   `{"SX1301_conf": {"radio_0": {"enable": true, "freq": 867500000}}}`,
+			channels: 0,
+			luts:     16,
+		},
+		{
+			name:     "local radios keep the global channels",
+			global:   `{"SX1301_conf": {"chan_multiSF_0": {"enable": true}}}`,
+			local:    `{"SX1301_conf": {"radio_0": {"enable": true, "freq": 867500000}}}`,
+			channels: 1,
+			luts:     16,
+		},
+		{
+			name:     "local channels replace the global ones",
+			global:   `{"SX1301_conf": {"chan_multiSF_0": {"enable": true}, "chan_multiSF_1": {"enable": true}}}`,
+			local:    `{"SX1301_conf": {"chan_multiSF_5": {"enable": true}}}`,
+			channels: 1,
+			luts:     16,
+		},
+		{
+			name:     "a table replaces the default one",
+			global:   `{"SX1301_conf": {"tx_lut_0": {"pa_gain": 0, "mix_gain": 15, "rf_power": 2}, "tx_lut_1": {"pa_gain": 1, "mix_gain": 8, "rf_power": 5}}}`,
+			channels: 8,
+			luts:     2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			global := writeConfFile(t, "global_conf.json", test.global)
+			local := ""
+			if test.local != "" {
+				local = writeConfFile(t, "local_conf.json", test.local)
+			}
+			conf, err := loadConf(global, local, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			channels := 0
+			for _, channel := range conf.SX1301.MultiSFChannels() {
+				if channel != nil && channel.Enabled {
+					channels++
+				}
+			}
+			if channels != test.channels {
+				t.Errorf("%d enabled channels, expected %d", channels, test.channels)
+			}
+			luts := 0
+			for _, lut := range conf.SX1301.TxLuts() {
+				if lut != nil {
+					luts++
+				}
+			}
+			if luts != test.luts {
+				t.Errorf("%d TX gain table entries, expected %d", luts, test.luts)
+			}
+		})
+	}
+}
+
+func TestLoadConfTxRules(t *testing.T) {
+	global := writeConfFile(t, "global_conf.json", `{"repeater_conf": {
+		"rules": [{"match": {"sf": [12]}, "action": "drop"}],
+		"tx_rules": [{"frequencies": [922100000], "modulation": "LORA", "invert_pol": true, "preamble": 12}]
+	}}`)
+	conf, err := loadConf(global, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Repeater.TxRules != nil {
+		t.Error("tx_rules kept")
+	}
+	if len(conf.Repeater.Rules) != 2 {
+		t.Fatalf("%d rules, expected 2", len(conf.Repeater.Rules))
+	}
+	rule := conf.Repeater.Rules[1]
+	if rule.Action != "repeat" || rule.Match.Modulation != "LORA" || len(rule.Match.Frequencies) != 1 || rule.Match.Frequencies[0] != 922100000 ||
+		rule.InvertPol == nil || !*rule.InvertPol || rule.Preamble != 12 {
+		t.Errorf("Converted into %+v", rule)
+	}
+	if err := conf.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateRulePaths(t *testing.T) {
+	rules := writeConfFile(t, "rules.yaml", "- match: {sf: [13]}\n  action: drop\n")
+	global := writeConfFile(t, "global_conf.json", `{"repeater_conf": {
+		"rules": [{"action": "forward"}],
+		"rules_file": "`+rules+`",
+		"tx_rules": [{"modulation": "CSS"}]
+	}}`)
+	conf, err := loadConf(global, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, ok := conf.validate().(wrapper.ConfigErrors)
+	if !ok {
+		t.Fatalf("Validated as %v", conf.validate())
+	}
+	paths := []string{"repeater_conf.rules[0].action", rules + "[0].match.sf[0]", "repeater_conf.tx_rules[0].match.modulation"}
+	if len(errs) != len(paths) {
+		t.Fatalf("Errors %v, expected on %v", errs, paths)
+	}
+	for i, err := range errs {
+		if err.Path != paths[i] {
+			t.Errorf("Error on %s, expected %s", err.Path, paths[i])
+		}
+	}
+}
+
+func TestValidateDownlinkRelayPolarity(t *testing.T) {
+	for _, uninverted := range []bool{false, true} {
+		conf := defaultConf()
+		conf.Repeater.DownlinkRelay = &downlinkRelayConf{Region: "AS923", Uninverted: uninverted}
+		if err := conf.validate(); (err == nil) != uninverted {
+			t.Errorf("Uninverted downlinks %v: %v", uninverted, err)
+		}
+	}
+}
+
+func TestGPSSlotsNext(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		slots    gpsSlotsConf
+		earliest time.Duration
+		next     time.Duration
+	}{
+		{gpsSlotsConf{Period: 1000, Offset: 200, Length: 100}, 0, 200 * ms},
+		{gpsSlotsConf{Period: 1000, Offset: 200, Length: 100}, 200 * ms, 200 * ms},
+		{gpsSlotsConf{Period: 1000, Offset: 200, Length: 100}, 200*ms + 1, 1200 * ms},
+		{gpsSlotsConf{Period: 1000, Offset: 200, Length: 100}, 999 * ms, 1200 * ms},
+		{gpsSlotsConf{Period: 1000, Offset: 200, Length: 100}, 1000 * ms, 1200 * ms},
+		{gpsSlotsConf{Period: 1000, Offset: 0, Length: 100}, 1000 * ms, 1000 * ms},
+		{gpsSlotsConf{Period: 1000, Offset: 0, Length: 100}, 1000*ms + 1, 2000 * ms},
+		// Slots at the end of the period, past the boundary
+		{gpsSlotsConf{Period: 1000, Offset: 900, Length: 100}, 950 * ms, 1900 * ms},
+		{gpsSlotsConf{Period: 1000, Offset: 900, Length: 100}, 1950 * ms, 2900 * ms},
+		{gpsSlotsConf{Period: 1000, Offset: 900, Length: 100}, 2000 * ms, 2900 * ms},
+		// Current GPS times
+		{gpsSlotsConf{Period: 3000, Offset: 1000, Length: 500}, 1445000000123 * ms, 1445000002000 * ms},
+	}
+	for _, test := range tests {
+		if next := test.slots.next(test.earliest); next != test.next {
+			t.Errorf("Slot of %+v after %v at %v, expected %v", test.slots, test.earliest, next, test.next)
+		}
+	}
+}
+
+func TestReloadKeepsGatewayConf(t *testing.T) {
+	rep, err := newRepeater(testConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := defaultConf()
+	minRSSI := float32(-100)
+	reloaded := defaultConf()
+	reloaded.Repeater.MinRSSI = &minRSSI
+	reloaded.Gateway.StatePath = "state.db"
+	reloaded.Gateway.Servers = []serverConf{{ServerAddress: "localhost", ServPortUp: 1700, ServEnabled: true}}
+	if changed := conf.Gateway.changes(&reloaded.Gateway); len(changed) != 2 || changed[0] != "gateway_conf.servers" || changed[1] != "gateway_conf.state_path" {
+		t.Errorf("Changes %v", changed)
+	}
+
+	opts := repeaterOptions{reload: func() (globalConf, bool) { return reloaded, true }}
+	if reload(rep, &conf, opts) {
+		t.Error("Concentrator restarted")
+	}
+	// The repeater settings are applied, the gateway ones kept until restarting
+	if current, _ := rep.getConf(); current.MinRSSI == nil || conf.Repeater.MinRSSI == nil {
+		t.Error("Repeater configuration not reloaded")
+	}
+	if conf.Gateway.StatePath != "" || len(conf.Gateway.Servers) != 0 {
+		t.Errorf("Gateway configuration reloaded as %+v", conf.Gateway)
+	}
+}
+
+func TestValidateBoards(t *testing.T) {
+	lbt := &wrapper.LbtConf{Enabled: true, ChannelsConfig: []wrapper.ChannelFreqConf{{Freq: 922200000, ScanTime: 128}}}
+	tests := []struct {
+		name   string
+		change func(c *globalConf)
+		paths  []string
+	}{
+		{"every board receiving", func(c *globalConf) {}, nil},
+		{"other board transmitting", func(c *globalConf) { c.Gateway.TransmitBoard = 1 }, nil},
+		{"worker", func(c *globalConf) { c.Boards[0].Worker = "" }, []string{"boards[0].worker"}},
+		{"board configuration", func(c *globalConf) { c.Boards[0].SX1301.Clksrc = 2 }, []string{"boards[0].SX1301_conf.clksrc"}},
+		{"transmit board", func(c *globalConf) { c.Gateway.TransmitBoard = 2 }, []string{"gateway_conf.transmit_board"}},
+		{
+			"receive boards",
+			func(c *globalConf) { c.Gateway.ReceiveBoards = []int{1, 1, -1} },
+			[]string{"gateway_conf.receive_boards[1]", "gateway_conf.receive_boards[2]"},
+		},
+
+		// Repeats scheduled on the counter of the board which received the uplink
+		{
+			"relays on the transmit board",
+			func(c *globalConf) {
+				c.Repeater = *testRelayConf(t)
+				c.Gateway.ReceiveBoards = []int{1}
+				c.Gateway.TransmitBoard = 1
+				c.Boards[0].SX1301.LbtConfig = lbt
+			},
+			nil,
+		},
+		{
+			"relays across boards",
+			func(c *globalConf) { c.Repeater = *testRelayConf(t) },
+			[]string{"repeater_conf.downlink_relay", "repeater_conf.ts011_relay"},
+		},
+		{
+			"LBT across boards",
+			func(c *globalConf) {
+				c.Gateway.TransmitBoard = 1
+				c.Boards[0].SX1301.LbtConfig = lbt
+			},
+			[]string{"boards[0].SX1301_conf.lbt_cfg"},
+		},
+		{"LBT on the receiving boards", func(c *globalConf) { c.SX1301.LbtConfig = lbt; c.Gateway.TransmitBoard = 1 }, nil},
+	}
+	for _, test := range tests {
+		conf := defaultConf()
+		conf.Boards = []boardConf{{Worker: "/usr/local/bin/packet_repeater", SX1301: wrapper.DefaultSX1301Conf()}}
+		test.change(&conf)
+		var paths []string
+		if err := conf.validate(); err != nil {
+			for _, err := range err.(wrapper.ConfigErrors) {
+				paths = append(paths, err.Path)
+			}
+		}
+		if !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: errors on %v, expected %v", test.name, paths, test.paths)
+		}
+	}
+}
+
+func TestReloadBoards(t *testing.T) {
+	rep, err := newRepeater(testConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := defaultConf()
+	conf.Boards = []boardConf{{Worker: "packet_repeater", SX1301: wrapper.DefaultSX1301Conf()}}
+	reloaded := conf
+	reloaded.Boards = []boardConf{{Worker: "other", SX1301: wrapper.DefaultSX1301Conf()}}
+	opts := repeaterOptions{reload: func() (globalConf, bool) { return reloaded, true }}
+	if reload(rep, &conf, opts) {
+		t.Error("Concentrator restarted")
+	}
+	// The worker is kept until the repeater restarts
+	if conf.Boards[0].Worker != "packet_repeater" {
+		t.Errorf("Worker reloaded as %s", conf.Boards[0].Worker)
+	}
+
+	// A board configuration changed restarts the boards
+	reloaded.Boards = []boardConf{{Worker: "packet_repeater", SX1301: wrapper.DefaultSX1301Conf()}}
+	reloaded.Boards[0].SX1301.Radio0.Freq = 922600000
+	if !reload(rep, &conf, opts) {
+		t.Error("Concentrator not restarted")
+	}
+	if conf.Boards[0].SX1301.Radio0.Freq != 922600000 {
+		t.Error("Board configuration not reloaded")
+	}
+}
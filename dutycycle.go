@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/policy"
+	"github.com/NaNkeen/packet_repeater/store"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"os"
+	"sync"
+	"time"
+)
+
+// dutyCycleConf limits the share of time spent emitting repeats over a sliding window.
+// As the budget runs out, low priority repeats are shed first, then normal ones: part
+// of the budget can be reserved for the higher priorities.
+type dutyCycleConf struct {
+	Limit         float64 `json:"limit_percent"`                    // share of the window the repeater may emit, e.g. 1 for 1%
+	Window        int     `json:"window_s"`                         // in seconds
+	ReserveHigh   float64 `json:"reserve_high_percent,omitempty"`   // share of the budget only high priority repeats may use
+	ReserveNormal float64 `json:"reserve_normal_percent,omitempty"` // share of the budget low priority repeats may not use, beyond reserve_high_percent
+}
+
+func (c *dutyCycleConf) validate(prefix string) wrapper.ConfigErrors {
+	var errs wrapper.ConfigErrors
+	if c.Limit <= 0 || c.Limit > 100 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".limit_percent", Message: fmt.Sprintf("%g%% is not a valid duty cycle", c.Limit)})
+	}
+	if c.Window <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".window_s", Message: fmt.Sprintf("%d s is not a valid window", c.Window)})
+	}
+	if c.ReserveHigh < 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".reserve_high_percent", Message: fmt.Sprintf("%g%% is not a valid reserve", c.ReserveHigh)})
+	}
+	if c.ReserveNormal < 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".reserve_normal_percent", Message: fmt.Sprintf("%g%% is not a valid reserve", c.ReserveNormal)})
+	} else if c.ReserveHigh >= 0 && c.ReserveHigh+c.ReserveNormal > 100 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".reserve_normal_percent", Message: fmt.Sprintf("the reserves add up to %g%%, more than the budget", c.ReserveHigh+c.ReserveNormal)})
+	}
+	return errs
+}
+
+// budget returns the airtime the repeats of the priority may use over the window
+func (c *dutyCycleConf) budget(priority policy.Priority) time.Duration {
+	budget := float64(time.Duration(c.Window)*time.Second) * c.Limit / 100
+	switch priority {
+	case policy.PriorityLow:
+		budget *= 1 - (c.ReserveHigh+c.ReserveNormal)/100
+	case policy.PriorityNormal:
+		budget *= 1 - c.ReserveHigh/100
+	}
+	return time.Duration(budget)
+}
+
+// emission is a past repeat, accounted in the duty cycle
+type emission struct {
+	end     time.Time
+	airtime time.Duration
+}
+
+// dutyCycle tracks the airtime of the repeats over the window
+type dutyCycle struct {
+	mutex     sync.Mutex
+	conf      *dutyCycleConf
+	emissions []emission // in chronological order
+	used      time.Duration
+	store     *store.Store // where the emissions are saved, if not nil
+}
+
+// setConf changes the limits, keeping the emissions accounted
+func (d *dutyCycle) setConf(conf *dutyCycleConf) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.conf = conf
+}
+
+// load resumes from the emissions saved in st, and saves the next ones there
+func (d *dutyCycle) load(st *store.Store) error {
+	emissions, err := st.Emissions(time.Time{})
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.store = st
+	for _, e := range emissions {
+		d.emissions = append(d.emissions, emission{e.End, e.Airtime})
+		d.used += e.Airtime
+	}
+	d.expire(time.Now())
+	return nil
+}
+
+// expire forgets the emissions which ended before the window
+func (d *dutyCycle) expire(now time.Time) {
+	var window time.Duration
+	if d.conf != nil {
+		window = time.Duration(d.conf.Window) * time.Second
+	}
+	i := 0
+	for ; i < len(d.emissions) && now.Sub(d.emissions[i].end) > window; i++ {
+		d.used -= d.emissions[i].airtime
+	}
+	d.emissions = d.emissions[i:]
+	if i > 0 && d.store != nil {
+		if err := d.store.ExpireEmissions(now.Add(-window)); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to save state:", err)
+		}
+	}
+}
+
+// allow tells whether a repeat of the priority lasting airtime fits in the budget
+func (d *dutyCycle) allow(priority policy.Priority, airtime time.Duration) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.conf == nil {
+		return true
+	}
+	d.expire(time.Now())
+	return d.used+airtime <= d.conf.budget(priority)
+}
+
+// add accounts a repeat which just ended
+func (d *dutyCycle) add(airtime time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	d.expire(now)
+	if d.conf != nil {
+		d.emissions = append(d.emissions, emission{now, airtime})
+		d.used += airtime
+		if d.store != nil {
+			d.store.AddEmission(store.Emission{End: now, Airtime: airtime})
+		}
+	}
+}
+
+// usage returns the share of the budget used, in percent, or false without duty cycle
+func (d *dutyCycle) usage() (float64, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.conf == nil {
+		return 0, false
+	}
+	d.expire(time.Now())
+	return 100 * float64(d.used) / float64(d.conf.budget(policy.PriorityHigh)), true
+}
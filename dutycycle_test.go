@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/NaNkeen/packet_repeater/policy"
+	"testing"
+	"time"
+)
+
+func TestDutyCycleBudget(t *testing.T) {
+	// 1% of 100 s, 20% of it reserved for high priority repeats, 30% more for normal ones
+	conf := dutyCycleConf{Limit: 1, Window: 100, ReserveHigh: 20, ReserveNormal: 30}
+	tests := []struct {
+		priority policy.Priority
+		budget   time.Duration
+	}{
+		{policy.PriorityHigh, time.Second},
+		{policy.PriorityNormal, 800 * time.Millisecond},
+		{policy.PriorityLow, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if budget := conf.budget(test.priority); budget != test.budget {
+			t.Errorf("%s priority budget %v, expected %v", test.priority, budget, test.budget)
+		}
+	}
+}
+
+func TestDutyCycleReserve(t *testing.T) {
+	var d dutyCycle
+	if !d.allow(policy.PriorityLow, time.Hour) {
+		t.Error("Repeat denied without duty cycle")
+	}
+	d.add(time.Hour)
+	if _, ok := d.usage(); ok {
+		t.Error("Usage without duty cycle")
+	}
+
+	d.setConf(&dutyCycleConf{Limit: 1, Window: 100, ReserveHigh: 20, ReserveNormal: 30})
+	d.add(400 * time.Millisecond)
+	tests := []struct {
+		priority policy.Priority
+		airtime  time.Duration
+		allowed  bool
+	}{
+		{policy.PriorityLow, 100 * time.Millisecond, true},
+		{policy.PriorityLow, 101 * time.Millisecond, false},
+		{policy.PriorityNormal, 400 * time.Millisecond, true},
+		{policy.PriorityNormal, 401 * time.Millisecond, false},
+		{policy.PriorityHigh, 600 * time.Millisecond, true},
+		{policy.PriorityHigh, 601 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		if allowed := d.allow(test.priority, test.airtime); allowed != test.allowed {
+			t.Errorf("%s priority repeat of %v allowed %v, expected %v", test.priority, test.airtime, allowed, test.allowed)
+		}
+	}
+	if usage, ok := d.usage(); !ok || usage != 40 {
+		t.Errorf("Usage %g%%, expected 40%%", usage)
+	}
+}
+
+func TestDutyCycleExpiry(t *testing.T) {
+	var d dutyCycle
+	d.setConf(&dutyCycleConf{Limit: 1, Window: 100})
+	now := time.Now()
+	d.emissions = []emission{
+		{now.Add(-101 * time.Second), 500 * time.Millisecond},
+		{now.Add(-99 * time.Second), 300 * time.Millisecond},
+		{now.Add(-time.Second), 200 * time.Millisecond},
+	}
+	d.used = time.Second
+
+	// Only the emissions which ended within the window count
+	if !d.allow(policy.PriorityHigh, 500*time.Millisecond) || d.allow(policy.PriorityHigh, 501*time.Millisecond) {
+		t.Errorf("%v used, expected 500ms", d.used)
+	}
+	if len(d.emissions) != 2 {
+		t.Errorf("%d emissions kept, expected 2", len(d.emissions))
+	}
+	d.expire(now.Add(100 * time.Second))
+	if d.used != 0 || len(d.emissions) != 0 {
+		t.Errorf("%v used by %d emissions past the window", d.used, len(d.emissions))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/store"
+	"os"
+	"time"
+)
+
+// fcntRetention is how long the frame counter of a silent device is kept in memory.
+// With a state file, older ones are read back from it.
+const fcntRetention = 24 * time.Hour
+
+// fcntVerdict is how a frame counter compares with the last one of the device
+type fcntVerdict int
+
+const (
+	fcntNew            fcntVerdict = iota // newer, or the device is unknown
+	fcntRetransmission                    // the same as the last one, within the dedup window
+	fcntReplay                            // older, too far ahead, or the same past the window
+)
+
+// unverifiedRetention is how long the frame counter of a device without keys is kept
+// in memory, only to tell its retransmissions
+const unverifiedRetention = time.Minute
+
+// fcntTracker remembers the frame counter of the last frame emitted from each device.
+// Those of the devices with keys are verified by their MIC and kept over 32 bits, to
+// tell replays. Those of the other devices could be forged, they only tell
+// retransmissions. It is only used by broadcastRoutine.
+type fcntTracker struct {
+	devices             map[uint32]store.Device
+	unverified          map[uint32]store.Device // 16 least significant bits
+	store               *store.Store            // where the verified counters are saved, if not nil
+	lastSweep           time.Time
+	lastUnverifiedSweep time.Time
+}
+
+func newFCntTracker() *fcntTracker {
+	return &fcntTracker{devices: make(map[uint32]store.Device), unverified: make(map[uint32]store.Device)}
+}
+
+// fullFCnt returns the 32 bits frame counter following last whose 16 least significant
+// bits are fcnt. Devices with 16 bits counters roll over the same way.
+func fullFCnt(last uint32, fcnt uint16) uint32 {
+	full := last&^0xffff | uint32(fcnt)
+	if full < last {
+		full += 0x10000
+	}
+	return full
+}
+
+// fcntRollovers is how many times the 16 least significant bits of the frame counter
+// of a device may have rolled over unseen, the upper bits being tried up to that
+const fcntRollovers = 16
+
+// fcntCandidates returns the full frame counters a frame whose 16 least significant
+// bits are fcnt may have been sent with, the one following the last first. If the
+// device is unknown, the upper bits are tried up to fcntRollovers. If older frames are
+// accepted, the counter may also be behind the last one, reset, or have rolled over
+// unseen.
+func fcntCandidates(full uint32, last *uint32, fcnt uint16, older bool) []uint32 {
+	candidates := []uint32{full}
+	switch {
+	case last == nil:
+		for i := uint32(1); i <= fcntRollovers; i++ {
+			candidates = append(candidates, i<<16|uint32(fcnt))
+		}
+	case older:
+		for _, candidate := range []uint32{*last&^0xffff | uint32(fcnt), uint32(fcnt)} {
+			if candidate != full && candidate != candidates[len(candidates)-1] {
+				candidates = append(candidates, candidate)
+			}
+		}
+		for i := uint32(1); i <= fcntRollovers && full+i<<16 > full; i++ {
+			candidates = append(candidates, full+i<<16)
+		}
+	}
+	return candidates
+}
+
+// device returns the state of the device, false if unknown
+func (t *fcntTracker) device(devAddr uint32) (store.Device, bool) {
+	if device, ok := t.devices[devAddr]; ok {
+		return device, true
+	}
+	if t.store == nil {
+		return store.Device{}, false
+	}
+	device, ok, err := t.store.Device(devAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load state:", err)
+	}
+	if ok {
+		t.devices[devAddr] = device
+	}
+	return device, ok
+}
+
+// check compares the frame counter of a frame from the device with the last one, at
+// most maxGap behind. It returns the full frame counter, and the last one if known.
+func (t *fcntTracker) check(devAddr uint32, fcnt uint16, maxGap uint32, window time.Duration, now time.Time) (uint32, *uint32, fcntVerdict) {
+	device, ok := t.device(devAddr)
+	if !ok {
+		return uint32(fcnt), nil, fcntNew
+	}
+	last := device.FCnt
+	full := fullFCnt(last, fcnt)
+	switch gap := full - last; {
+	case gap == 0 && now.Sub(device.LastSeen) < window:
+		return full, &last, fcntRetransmission
+	case gap > 0 && gap <= maxGap:
+		return full, &last, fcntNew
+	}
+	return full, &last, fcntReplay
+}
+
+// retransmission tells whether a frame from a device without keys has the frame counter
+// of the last one emitted, within the window. A forged frame can at worst get the
+// genuine one with its frame counter refused, within the window.
+func (t *fcntTracker) retransmission(devAddr uint32, fcnt uint16, window time.Duration, now time.Time) bool {
+	device, ok := t.unverified[devAddr]
+	return ok && device.FCnt == uint32(fcnt) && now.Sub(device.LastSeen) < window
+}
+
+// updateUnverified records the frame counter of the last frame emitted from a device
+// without keys
+func (t *fcntTracker) updateUnverified(devAddr uint32, fcnt uint16, now time.Time) {
+	if now.Sub(t.lastUnverifiedSweep) >= unverifiedRetention {
+		t.lastUnverifiedSweep = now
+		for addr, device := range t.unverified {
+			if now.Sub(device.LastSeen) >= unverifiedRetention {
+				delete(t.unverified, addr)
+			}
+		}
+	}
+	t.unverified[devAddr] = store.Device{FCnt: uint32(fcnt), LastSeen: now}
+}
+
+// update records the frame counter of the last frame emitted from a device with keys,
+// once its MIC verified
+func (t *fcntTracker) update(devAddr uint32, fcnt uint32, now time.Time) {
+	if now.Sub(t.lastSweep) >= fcntRetention {
+		t.lastSweep = now
+		for addr, device := range t.devices {
+			if now.Sub(device.LastSeen) >= fcntRetention {
+				delete(t.devices, addr)
+			}
+		}
+	}
+	device := store.Device{FCnt: fcnt, LastSeen: now}
+	t.devices[devAddr] = device
+	if t.store != nil {
+		t.store.PutDevice(devAddr, device)
+	}
+}
@@ -1 +1,11 @@
 module github.com/NaNkeen/packet_repeater
+
+go 1.27.1
+
+require (
+	github.com/yuin/gopher-lua v1.1.2
+	go.etcd.io/bbolt v1.4.3
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.29.0 // indirect
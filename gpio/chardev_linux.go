@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+package gpio
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// DefaultChip is the GPIO controller of the Raspberry Pi header
+const DefaultChip = "/dev/gpiochip0"
+
+// From linux/gpio.h, v1 ABI
+const (
+	gpioHandlesMax             = 64
+	gpioHandleRequestOutput    = 1 << 1
+	gpioGetLineHandleIoctl     = 0xc16cb403 // _IOWR(0xB4, 0x03, struct gpiohandle_request)
+	gpioHandleSetLineValsIoctl = 0xc040b409 // _IOWR(0xB4, 0x09, struct gpiohandle_data)
+)
+
+type gpioHandleRequest struct {
+	lineOffsets   [gpioHandlesMax]uint32
+	flags         uint32
+	defaultValues [gpioHandlesMax]uint8
+	consumerLabel [32]byte
+	lines         uint32
+	fd            int32
+}
+
+type gpioHandleData struct {
+	values [gpioHandlesMax]uint8
+}
+
+// Chardev opens lines through the GPIO character device of a chip, e.g. /dev/gpiochip0.
+// An empty Chip uses DefaultChip.
+type Chardev struct {
+	Chip string
+}
+
+type chardevPin struct {
+	handle *os.File
+}
+
+// Open requests the line as an output, initially low
+func (c Chardev) Open(line int) (Pin, error) {
+	chip := c.Chip
+	if chip == "" {
+		chip = DefaultChip
+	}
+	f, err := os.OpenFile(chip, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var req = gpioHandleRequest{
+		flags: gpioHandleRequestOutput,
+		lines: 1,
+	}
+	req.lineOffsets[0] = uint32(line)
+	copy(req.consumerLabel[:], "packet_repeater")
+	if err := ioctl(f.Fd(), gpioGetLineHandleIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, &os.PathError{Op: "request line", Path: chip, Err: err}
+	}
+	return &chardevPin{os.NewFile(uintptr(req.fd), chip)}, nil
+}
+
+func (p *chardevPin) Set(high bool) error {
+	var data gpioHandleData
+	if high {
+		data.values[0] = 1
+	}
+	if err := ioctl(p.handle.Fd(), gpioHandleSetLineValsIoctl, unsafe.Pointer(&data)); err != nil {
+		return &os.PathError{Op: "set line", Path: p.handle.Name(), Err: err}
+	}
+	return nil
+}
+
+// Close releases the line
+func (p *chardevPin) Close() error {
+	return p.handle.Close()
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package gpio
+
+import (
+	"errors"
+)
+
+// DefaultChip is the GPIO controller of the Raspberry Pi header
+const DefaultChip = "/dev/gpiochip0"
+
+// Chardev opens lines through the GPIO character device, only available on Linux
+type Chardev struct {
+	Chip string
+}
+
+func (c Chardev) Open(line int) (Pin, error) {
+	return nil, errors.New("GPIO character devices are only supported on Linux")
+}
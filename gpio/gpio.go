@@ -0,0 +1,41 @@
+// Package gpio drives the reset line of the concentrator board, either through
+// the sysfs interface or the GPIO character device.
+package gpio
+
+import (
+	"time"
+)
+
+// Pin is a GPIO line configured as an output
+type Pin interface {
+	// Set drives the line to the given electrical level
+	Set(high bool) error
+	// Close releases the line
+	Close() error
+}
+
+// Opener requests a line as an output
+type Opener interface {
+	Open(line int) (Pin, error)
+}
+
+// ResetPulse is how long each step of the reset sequence lasts
+const ResetPulse = 100 * time.Millisecond
+
+// Reset releases, asserts, then releases the reset line again, ResetPulse apart, and
+// finally closes the line. With activeLow, the reset is asserted by driving the line low.
+func Reset(opener Opener, line int, activeLow bool) error {
+	pin, err := opener.Open(line)
+	if err != nil {
+		return err
+	}
+
+	for _, asserted := range []bool{false, true, false} {
+		if err := pin.Set(asserted != activeLow); err != nil {
+			pin.Close()
+			return err
+		}
+		time.Sleep(ResetPulse)
+	}
+	return pin.Close()
+}
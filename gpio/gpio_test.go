@@ -0,0 +1,164 @@
+package gpio
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSysfs creates an empty sysfs GPIO tree, with its export and unexport files
+func fakeSysfs(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range []string{"export", "unexport"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// exportLine creates the directory of the line as the kernel does once exported
+func exportLine(t *testing.T, root, name string) {
+	dir := filepath.Join(root, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Error(err)
+		return
+	}
+	files := map[string]string{"direction": "in", "value": "0"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSysfs(t *testing.T) {
+	root := fakeSysfs(t)
+
+	// The kernel creates the line directory after the export, udev later
+	exported := make(chan struct{})
+	go func() {
+		defer close(exported)
+		deadline := time.Now().Add(exportTimeout)
+		for time.Now().Before(deadline) {
+			if data, _ := os.ReadFile(filepath.Join(root, "export")); string(data) == "17" {
+				time.Sleep(20 * time.Millisecond)
+				exportLine(t, root, "gpio17")
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Error("Line not exported")
+	}()
+
+	pin, err := Sysfs{Root: root}.Open(17)
+	<-exported
+	if err != nil {
+		t.Fatal(err)
+	}
+	if direction := readFile(t, filepath.Join(root, "gpio17", "direction")); direction != "out" {
+		t.Errorf("Direction %q, expected out", direction)
+	}
+	for _, high := range []bool{true, false, true} {
+		if err := pin.Set(high); err != nil {
+			t.Fatal(err)
+		}
+		expected := "0"
+		if high {
+			expected = "1"
+		}
+		if value := readFile(t, filepath.Join(root, "gpio17", "value")); value != expected {
+			t.Errorf("Value %q, expected %q", value, expected)
+		}
+	}
+	if err := pin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if unexport := readFile(t, filepath.Join(root, "unexport")); unexport != "17" {
+		t.Errorf("Unexported %q, expected 17", unexport)
+	}
+}
+
+func TestSysfsAlreadyExported(t *testing.T) {
+	root := fakeSysfs(t)
+	exportLine(t, root, "gpio4")
+
+	pin, err := Sysfs{Root: root}.Open(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin.Close()
+	if export := readFile(t, filepath.Join(root, "export")); export != "" {
+		t.Errorf("Exported %q again", export)
+	}
+}
+
+func TestSysfsExportTimeout(t *testing.T) {
+	root := fakeSysfs(t)
+	if _, err := (Sysfs{Root: root}).Open(5); err == nil {
+		t.Error("Opened a line never exported")
+	}
+}
+
+type recordingPin struct {
+	levels []bool
+	closed bool
+}
+
+func (p *recordingPin) Set(high bool) error {
+	p.levels = append(p.levels, high)
+	return nil
+}
+
+func (p *recordingPin) Close() error {
+	p.closed = true
+	return nil
+}
+
+type recordingOpener struct {
+	pin  *recordingPin
+	line int
+}
+
+func (o *recordingOpener) Open(line int) (Pin, error) {
+	o.line = line
+	o.pin = &recordingPin{}
+	return o.pin, nil
+}
+
+func TestReset(t *testing.T) {
+	tests := []struct {
+		activeLow bool
+		levels    []bool
+	}{
+		{false, []bool{false, true, false}},
+		{true, []bool{true, false, true}},
+	}
+	for _, test := range tests {
+		var opener recordingOpener
+		if err := Reset(&opener, 22, test.activeLow); err != nil {
+			t.Fatal(err)
+		}
+		if opener.line != 22 {
+			t.Errorf("Opened line %d, expected 22", opener.line)
+		}
+		if !reflect.DeepEqual(opener.pin.levels, test.levels) {
+			t.Errorf("Active low %v: levels %v, expected %v", test.activeLow, opener.pin.levels, test.levels)
+		}
+		if !opener.pin.closed {
+			t.Errorf("Active low %v: line not closed", test.activeLow)
+		}
+	}
+}
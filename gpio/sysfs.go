@@ -0,0 +1,97 @@
+package gpio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// DefaultSysfsRoot is where the kernel exposes the sysfs GPIO interface
+const DefaultSysfsRoot = "/sys/class/gpio"
+
+// exportTimeout bounds the wait for the line directory to appear, and become writable,
+// once the line is exported
+const exportTimeout = time.Second
+
+// Sysfs opens lines through the legacy sysfs interface. Root can point to a fake tree
+// for testing, an empty Root uses DefaultSysfsRoot.
+type Sysfs struct {
+	Root string
+}
+
+type sysfsPin struct {
+	root  string
+	line  int
+	value *os.File
+}
+
+func (s Sysfs) root() string {
+	if s.Root == "" {
+		return DefaultSysfsRoot
+	}
+	return s.Root
+}
+
+// Open exports the line and configures it as an output
+func (s Sysfs) Open(line int) (Pin, error) {
+	root := s.root()
+	dir := filepath.Join(root, fmt.Sprintf("gpio%d", line))
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := writeFile(filepath.Join(root, "export"), strconv.Itoa(line)); err != nil {
+			return nil, err
+		}
+	}
+
+	// udev may take a moment to create the files and set their permissions
+	var err error
+	deadline := time.Now().Add(exportTimeout)
+	for {
+		err = writeFile(filepath.Join(dir, "direction"), "out")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := os.OpenFile(filepath.Join(dir, "value"), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &sysfsPin{root, line, value}, nil
+}
+
+func (p *sysfsPin) Set(high bool) error {
+	level := "0"
+	if high {
+		level = "1"
+	}
+	_, err := p.value.WriteAt([]byte(level), 0)
+	return err
+}
+
+// Close unexports the line
+func (p *sysfsPin) Close() error {
+	err := p.value.Close()
+	if unexportErr := writeFile(filepath.Join(p.root, "unexport"), strconv.Itoa(p.line)); err == nil {
+		err = unexportErr
+	}
+	return err
+}
+
+func writeFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
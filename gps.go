@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"io"
+	"os"
+)
+
+// gpsFamily is the GPS module family, configured by the HAL to send UBX time messages
+const gpsFamily = "ubx7"
+
+// maxGPSBufferSize bounds the data kept while looking for a complete GPS message
+const maxGPSBufferSize = 1024
+
+// openGPS opens the GPS. Serial devices, including pseudo-terminals, are configured
+// through the HAL; anything else, e.g. a file of recorded messages, is read as is.
+func openGPS(path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeCharDevice != 0 {
+		return wrapper.EnableGPS(path, gpsFamily)
+	}
+	return os.Open(path)
+}
+
+// gpsRoutine parses the messages read from the GPS until src fails or is exhausted.
+// UBX time messages synchronise the GPS time reference with the counter of the boards,
+// and NMEA RMC sentences update their location.
+func gpsRoutine(src io.Reader, boards []*wrapper.Concentrator) {
+	fmt.Println("Reading GPS messages")
+	var synced, located bool
+	err := readGPSMessages(src, func(msg wrapper.GPSMessage) {
+		switch msg {
+		case wrapper.GPSUBXTimeGPS:
+			var err error
+			for _, board := range boards {
+				if err = board.SyncGPSTime(); err != nil {
+					break
+				}
+			}
+			if err != nil && synced {
+				fmt.Fprintln(os.Stderr, err)
+			} else if err == nil && !synced {
+				fmt.Println("GPS time reference synchronised")
+			}
+			synced = err == nil
+		case wrapper.GPSNMEARMC:
+			var err error
+			for _, board := range boards {
+				if err = board.UpdateLocation(); err != nil {
+					break
+				}
+			}
+			if err == nil && !located {
+				coordinates, _ := boards[0].Location()
+				fmt.Printf("GPS location: %s\n", formatCoordinates(coordinates))
+			}
+			located = err == nil
+		}
+	})
+	// The GPS is closed on shutdown, while this is still reading
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		fmt.Fprintln(os.Stderr, "GPS:", err)
+	}
+	fmt.Println("GPS stopped")
+}
+
+// readGPSMessages splits the data read from src into GPS messages, and calls handle
+// with the type of every complete one, skipping the data which isn't part of a message.
+// It returns once src fails, nil if it is exhausted.
+func readGPSMessages(src io.Reader, handle func(wrapper.GPSMessage)) error {
+	buf := make([]byte, 0, maxGPSBufferSize)
+	chunk := make([]byte, wrapper.GPSMinMessageSize)
+	for {
+		n, err := src.Read(chunk)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		buf = append(buf, chunk[:n]...)
+
+		// Parse every complete message, skipping anything else, then drop what was parsed
+		var i int
+	PARSE:
+		for i < len(buf) {
+			msg, size := wrapper.ParseGPSMessage(buf[i:])
+			switch {
+			case msg == wrapper.GPSIncomplete:
+				break PARSE // until the rest is read
+			case msg == wrapper.GPSInvalid || msg == wrapper.GPSUnknown || size == 0:
+				i++ // not the start of a message
+			default:
+				handle(msg)
+				i += size
+			}
+		}
+		buf = append(buf[:0], buf[i:]...)
+		if len(buf) >= maxGPSBufferSize-len(chunk) {
+			buf = buf[:0]
+		}
+	}
+}
+
+func formatCoordinates(c wrapper.GPSCoordinates) string {
+	return fmt.Sprintf("%.5f, %.5f, %dm", c.Latitude, c.Longitude, c.Altitude)
+}
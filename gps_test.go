@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// ubxFrame returns a UBX frame with its checksum
+func ubxFrame(class, id byte, payload []byte) []byte {
+	frame := append([]byte{0xB5, 0x62, class, id, byte(len(payload)), byte(len(payload) >> 8)}, payload...)
+	var a, b byte
+	for _, c := range frame[2:] {
+		a += c
+		b += a
+	}
+	return append(frame, a, b)
+}
+
+// nmeaSentence returns an NMEA sentence with its checksum
+func nmeaSentence(fields string) []byte {
+	var checksum byte
+	for i := 0; i < len(fields); i++ {
+		checksum ^= fields[i]
+	}
+	return []byte(fmt.Sprintf("$%s*%02X\r\n", fields, checksum))
+}
+
+// chunkReader returns the data in reads of the given sizes, in turn
+type chunkReader struct {
+	data  []byte
+	sizes []int
+	next  int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := r.sizes[r.next%len(r.sizes)]
+	r.next++
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReadGPSMessages(t *testing.T) {
+	timeGPS := ubxFrame(0x01, 0x20, make([]byte, 16))
+	status := ubxFrame(0x01, 0x03, make([]byte, 16))
+	rmc := nmeaSentence("GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W")
+	gga := nmeaSentence("GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,")
+	corrupt := append([]byte(nil), timeGPS...)
+	corrupt[8] ^= 0xff
+
+	// A bogus UBX header announcing more than the buffer holds, then enough data for
+	// the buffer to be dropped
+	bogus := append([]byte{0xB5, 0x62, 0x01, 0x20, 0xff, 0xff}, bytes.Repeat([]byte{0}, maxGPSBufferSize)...)
+
+	tests := []struct {
+		name     string
+		stream   [][]byte
+		messages []wrapper.GPSMessage
+	}{
+		{
+			name:     "messages",
+			stream:   [][]byte{timeGPS, rmc, gga, timeGPS},
+			messages: []wrapper.GPSMessage{wrapper.GPSUBXTimeGPS, wrapper.GPSNMEARMC, wrapper.GPSNMEAGGA, wrapper.GPSUBXTimeGPS},
+		},
+		{
+			name:     "garbage between messages",
+			stream:   [][]byte{[]byte("\x00\xffnoise"), timeGPS, []byte("\r\n$GP"), rmc, {0xB5, 0x00}, timeGPS, []byte("$x\r\n$"), gga},
+			messages: []wrapper.GPSMessage{wrapper.GPSUBXTimeGPS, wrapper.GPSNMEARMC, wrapper.GPSUBXTimeGPS, wrapper.GPSNMEAGGA},
+		},
+		{
+			name:     "corrupt messages",
+			stream:   [][]byte{corrupt, rmc[:20], timeGPS, []byte("$GPGGA,*00\r\n"), gga},
+			messages: []wrapper.GPSMessage{wrapper.GPSUBXTimeGPS, wrapper.GPSNMEAGGA},
+		},
+		{
+			name:     "other messages",
+			stream:   [][]byte{status, nmeaSentence("GPGSV,1,1,00"), timeGPS},
+			messages: []wrapper.GPSMessage{wrapper.GPSIgnored, wrapper.GPSIgnored, wrapper.GPSUBXTimeGPS},
+		},
+		{
+			name:     "bogus header",
+			stream:   [][]byte{bogus, timeGPS, rmc},
+			messages: []wrapper.GPSMessage{wrapper.GPSUBXTimeGPS, wrapper.GPSNMEARMC},
+		},
+	}
+	splits := map[string][]int{
+		"whole":       {wrapper.GPSMinMessageSize},
+		"byte a time": {1},
+		"uneven":      {3, 1, 7, 2, 8, 5},
+	}
+	for _, test := range tests {
+		for split, sizes := range splits {
+			t.Run(test.name+"/"+split, func(t *testing.T) {
+				src := &chunkReader{data: bytes.Join(test.stream, nil), sizes: sizes}
+				var messages []wrapper.GPSMessage
+				err := readGPSMessages(src, func(msg wrapper.GPSMessage) {
+					messages = append(messages, msg)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(messages, test.messages) {
+					t.Errorf("Messages %v, expected %v", messages, test.messages)
+				}
+			})
+		}
+	}
+}
+
+func TestReadGPSMessagesErrors(t *testing.T) {
+	rmc := nmeaSentence("GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W")
+	var messages int
+	err := readGPSMessages(iotest.TimeoutReader(bytes.NewReader(rmc)), func(wrapper.GPSMessage) { messages++ })
+	if err != iotest.ErrTimeout {
+		t.Errorf("Error %v, expected %v", err, iotest.ErrTimeout)
+	}
+
+	// The GPS is closed on shutdown
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r.Close()
+	if err := readGPSMessages(r, func(wrapper.GPSMessage) {}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Error %v, expected %v", err, os.ErrClosed)
+	}
+}
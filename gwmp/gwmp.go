@@ -0,0 +1,231 @@
+// Package gwmp implements the upstream status reports of the Semtech gateway messaging
+// protocol (GWMP), spoken by the network servers the packet forwarder connects to.
+package gwmp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const protocolVersion = 2
+
+// pushTimeout is how long the acknowledgements of a report are awaited, like the
+// push_timeout_ms of the packet forwarder
+const pushTimeout = 100 * time.Millisecond
+
+// Backoff of ackRoutine on read errors, e.g. while the server port is unreachable
+const (
+	minReadBackoff = 10 * time.Millisecond
+	maxReadBackoff = time.Second
+)
+
+// Message identifiers
+const (
+	pushData = 0x00
+	pushAck  = 0x01
+)
+
+// TimeFormat is the layout of Stat.Time
+const TimeFormat = "2006-01-02 15:04:05 GMT"
+
+// Stat is the "stat" object of a PUSH_DATA message. The counters cover the interval
+// since the previous report.
+type Stat struct {
+	Time     string      `json:"time"`           // UTC time of the report, in TimeFormat
+	Lati     *float64    `json:"lati,omitempty"` // latitude of the gateway, in degrees
+	Long     *float64    `json:"long,omitempty"` // longitude of the gateway, in degrees
+	Alti     *int16      `json:"alti,omitempty"` // altitude of the gateway, in meters
+	RxNb     uint64      `json:"rxnb"`           // radio packets received
+	RxOK     uint64      `json:"rxok"`           // radio packets received with a valid CRC
+	RxFw     uint64      `json:"rxfw"`           // radio packets forwarded
+	AckR     float64     `json:"ackr"`           // percentage of upstream datagrams acknowledged
+	DwNb     uint64      `json:"dwnb"`           // downlink datagrams received
+	TxNb     uint64      `json:"txnb"`           // packets emitted
+	Repeater interface{} `json:"repeater,omitempty"`
+}
+
+// ParseGatewayID decodes a gateway EUI written as 16 hexadecimal digits
+func ParseGatewayID(s string) ([8]byte, error) {
+	var id [8]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, errors.New("Invalid gateway ID " + s + ", should be 16 hexadecimal digits")
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// Client pushes status reports to a set of servers, and keeps track of their
+// acknowledgements
+type Client struct {
+	gatewayID [8]byte
+	conns     []*net.UDPConn
+
+	mutex    sync.Mutex
+	token    uint16        // of the last report
+	expected int           // acknowledgements of the last report still awaited, 0 past pushTimeout
+	acked    chan struct{} // closed once the last report is acknowledged by every server
+	counts   AckCounts
+}
+
+// AckCounts counts the datagrams sent to the servers and acknowledged in time, since
+// the client was created
+type AckCounts struct {
+	Sent  uint64
+	Acked uint64
+}
+
+// Ratio returns the percentage of the datagrams sent since prev which were
+// acknowledged, 0 if none was sent
+func (a AckCounts) Ratio(prev AckCounts) float64 {
+	sent := a.Sent - prev.Sent
+	if sent == 0 {
+		return 0
+	}
+	return 100 * float64(a.Acked-prev.Acked) / float64(sent)
+}
+
+// Dial connects to the servers, given as host:port. Servers which can't be resolved are
+// skipped and reported in the returned error, along with a client for the others.
+func Dial(gatewayID [8]byte, servers []string) (*Client, error) {
+	c := &Client{gatewayID: gatewayID}
+	var failed error
+	for _, server := range servers {
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err == nil {
+			var conn *net.UDPConn
+			if conn, err = net.DialUDP("udp", nil, addr); err == nil {
+				c.conns = append(c.conns, conn)
+				go c.ackRoutine(conn)
+				continue
+			}
+		}
+		if failed == nil {
+			failed = err
+		}
+	}
+	return c, failed
+}
+
+// ackRoutine counts the PUSH_ACK received on the connection until it is closed. Read
+// errors are retried with a backoff.
+func (c *Client) ackRoutine(conn *net.UDPConn) {
+	buf := make([]byte, 64)
+	backoff := minReadBackoff
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// e.g. the server port is unreachable, which only means no acknowledgement
+			time.Sleep(backoff)
+			backoff = min(2*backoff, maxReadBackoff)
+			continue
+		}
+		backoff = minReadBackoff
+		if n < 4 || buf[0] != protocolVersion || buf[3] != pushAck {
+			continue
+		}
+		token := binary.BigEndian.Uint16(buf[1:3])
+		c.mutex.Lock()
+		if c.expected > 0 && token == c.token {
+			c.counts.Acked++
+			c.awaited()
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// awaited accounts an acknowledgement of the last report as received or never coming,
+// with the mutex held
+func (c *Client) awaited() {
+	if c.expected--; c.expected == 0 {
+		close(c.acked)
+	}
+}
+
+// PushStat sends the status report to every server, and waits up to pushTimeout for
+// their acknowledgements
+func (c *Client) PushStat(stat Stat) error {
+	payload, err := json.Marshal(struct {
+		Stat Stat `json:"stat"`
+	}{stat})
+	if err != nil {
+		return err
+	}
+
+	token := uint16(rand.Intn(1 << 16))
+	datagram := make([]byte, 12, 12+len(payload))
+	datagram[0] = protocolVersion
+	binary.BigEndian.PutUint16(datagram[1:3], token)
+	datagram[3] = pushData
+	copy(datagram[4:12], c.gatewayID[:])
+	datagram = append(datagram, payload...)
+
+	// The acknowledgements of older reports are ignored
+	acked := make(chan struct{})
+	c.mutex.Lock()
+	c.token, c.expected, c.acked = token, len(c.conns), acked
+	if c.expected == 0 {
+		close(acked)
+	}
+	c.mutex.Unlock()
+
+	var failed error
+	for _, conn := range c.conns {
+		_, err := conn.Write(datagram)
+		c.mutex.Lock()
+		if err != nil {
+			failed = err
+			c.awaited()
+		} else {
+			c.counts.Sent++
+		}
+		c.mutex.Unlock()
+	}
+
+	// The acknowledgements are accounted with the report, not in a later interval
+	timer := time.NewTimer(pushTimeout)
+	defer timer.Stop()
+	select {
+	case <-acked:
+	case <-timer.C:
+	}
+	c.mutex.Lock()
+	if c.expected > 0 {
+		c.expected = 0
+		close(acked)
+	}
+	c.mutex.Unlock()
+	return failed
+}
+
+// AckCounts returns the datagrams sent and acknowledged so far
+func (c *Client) AckCounts() AckCounts {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts
+}
+
+// Close closes the connections to the servers
+func (c *Client) Close() error {
+	var failed error
+	for _, conn := range c.conns {
+		if err := conn.Close(); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// FormatTime formats t as expected in Stat.Time
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
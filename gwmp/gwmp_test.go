@@ -0,0 +1,110 @@
+package gwmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseGatewayID(t *testing.T) {
+	id, err := ParseGatewayID("AA555A0000000101")
+	if err != nil || id != [8]byte{0xaa, 0x55, 0x5a, 0, 0, 0, 1, 1} {
+		t.Errorf("Parsed as % X, error %v", id, err)
+	}
+	for _, s := range []string{"AA555A00000001", "AA555A000000010G", "AA555A000000010101"} {
+		if _, err := ParseGatewayID(s); err == nil {
+			t.Errorf("%s parsed", s)
+		}
+	}
+}
+
+// testServer listens for the datagrams of the client
+func testServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestPushStat(t *testing.T) {
+	server := testServer(t)
+	id := [8]byte{0xaa, 0x55, 0x5a, 0, 0, 0, 1, 1}
+	client, err := Dial(id, []string{server.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	lati, long, alti := 46.5, 6.625, int16(372)
+	stat := Stat{
+		Time:     "2026-10-19 12:00:00 GMT",
+		Lati:     &lati,
+		Long:     &long,
+		Alti:     &alti,
+		RxNb:     3,
+		RxOK:     2,
+		RxFw:     2,
+		AckR:     50,
+		TxNb:     1,
+		Repeater: map[string]int{"dropped": 1},
+	}
+	json := `{"stat":{"time":"2026-10-19 12:00:00 GMT","lati":46.5,"long":6.625,"alti":372,"rxnb":3,"rxok":2,"rxfw":2,"ackr":50,"dwnb":0,"txnb":1,"repeater":{"dropped":1}}}`
+
+	// The server acknowledges the report once received
+	datagrams := make(chan []byte, 2)
+	go func() {
+		buf := make([]byte, 1024)
+		ack := true
+		for {
+			n, addr, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			datagram := append([]byte(nil), buf[:n]...)
+			if ack && n >= 4 {
+				// A late acknowledgement of an older report, then the expected one
+				server.WriteToUDP([]byte{protocolVersion, datagram[1] + 1, datagram[2], pushAck}, addr)
+				server.WriteToUDP([]byte{protocolVersion, datagram[1], datagram[2], pushAck}, addr)
+			}
+			ack = false
+			datagrams <- datagram
+		}
+	}()
+
+	if err := client.PushStat(stat); err != nil {
+		t.Fatal(err)
+	}
+	datagram := <-datagrams
+	expected := append([]byte{protocolVersion, datagram[1], datagram[2], pushData, 0xaa, 0x55, 0x5a, 0, 0, 0, 1, 1}, json...)
+	if !bytes.Equal(datagram, expected) {
+		t.Errorf("Sent\n% X\nexpected\n% X", datagram, expected)
+	}
+	acks := client.AckCounts()
+	if acks != (AckCounts{Sent: 1, Acked: 1}) || acks.Ratio(AckCounts{}) != 100 {
+		t.Errorf("Counted %+v", acks)
+	}
+
+	// A report without acknowledgement is given up after pushTimeout
+	start := time.Now()
+	if err := client.PushStat(stat); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < pushTimeout {
+		t.Errorf("Acknowledgement awaited %v, expected %v", elapsed, pushTimeout)
+	}
+	<-datagrams
+	if next := client.AckCounts(); next != (AckCounts{Sent: 2, Acked: 1}) || next.Ratio(acks) != 0 || next.Ratio(AckCounts{}) != 50 {
+		t.Errorf("Counted %+v", next)
+	}
+}
+
+func TestRatioWithoutDatagrams(t *testing.T) {
+	acks := AckCounts{Sent: 4, Acked: 3}
+	if ratio := acks.Ratio(acks); ratio != 0 {
+		t.Errorf("Ratio %g without datagrams", ratio)
+	}
+}
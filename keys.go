@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// keyEntry is an entry of the keys file
+type keyEntry struct {
+	DevAddr             string `json:"dev_addr" yaml:"dev_addr"` // 8 hexadecimal digits
+	lorawan.SessionKeys `yaml:",inline"`
+}
+
+// loadKeys reads the session keys of the known devices from a JSON or YAML file,
+// depending on its extension, indexed by DevAddr
+func loadKeys(path string) (map[uint32]lorawan.SessionKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []keyEntry
+	switch filepath.Ext(path) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&entries)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&entries)
+	default:
+		return nil, errors.New("Key files should be .json, .yaml or .yml")
+	}
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+
+	keys := make(map[uint32]lorawan.SessionKeys, len(entries))
+	for i, entry := range entries {
+		addr, err := strconv.ParseUint(entry.DevAddr, 16, 32)
+		if err != nil || len(entry.DevAddr) != 8 {
+			return nil, fmt.Errorf("%s: entry %d: invalid DevAddr %q, should be 8 hexadecimal digits", path, i, entry.DevAddr)
+		}
+		if (entry.NwkSKey == nil) == (entry.FNwkSIntKey == nil) {
+			return nil, fmt.Errorf("%s: entry %d: should have either nwk_s_key (LoRaWAN 1.0.x) or f_nwk_s_int_key (LoRaWAN 1.1)", path, i)
+		}
+		if _, ok := keys[uint32(addr)]; ok {
+			return nil, fmt.Errorf("%s: entry %d: DevAddr %s already has keys", path, i, entry.DevAddr)
+		}
+		keys[uint32(addr)] = entry.SessionKeys
+	}
+	return keys, nil
+}
@@ -0,0 +1,178 @@
+// Package lorawan decodes the clear parts of LoRaWAN frames, which is all the repeater
+// needs to apply its policies. Encrypted payloads are left as they are, but for the
+// frames of the repeater itself acting as a TS011 relay.
+package lorawan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MType is the type of a frame, from its MAC header
+type MType uint8
+
+// Frame types
+const (
+	JoinRequest MType = iota
+	JoinAccept
+	UnconfirmedDataUp
+	UnconfirmedDataDown
+	ConfirmedDataUp
+	ConfirmedDataDown
+	RejoinRequest
+	Proprietary
+)
+
+var mTypeNames = [...]string{
+	"JoinRequest",
+	"JoinAccept",
+	"UnconfirmedDataUp",
+	"UnconfirmedDataDown",
+	"ConfirmedDataUp",
+	"ConfirmedDataDown",
+	"RejoinRequest",
+	"Proprietary",
+}
+
+func (m MType) String() string {
+	if int(m) < len(mTypeNames) {
+		return mTypeNames[m]
+	}
+	return fmt.Sprintf("MType(%d)", uint8(m))
+}
+
+// ParseMType returns the frame type with the given name, e.g. ConfirmedDataUp
+func ParseMType(name string) (MType, bool) {
+	for i, n := range mTypeNames {
+		if n == name {
+			return MType(i), true
+		}
+	}
+	return 0, false
+}
+
+// Uplink tells whether frames of this type are sent by end devices
+func (m MType) Uplink() bool {
+	switch m {
+	case JoinRequest, UnconfirmedDataUp, ConfirmedDataUp, RejoinRequest:
+		return true
+	}
+	return false
+}
+
+// Downlink tells whether frames of this type are sent by the network
+func (m MType) Downlink() bool {
+	switch m {
+	case JoinAccept, UnconfirmedDataDown, ConfirmedDataDown:
+		return true
+	}
+	return false
+}
+
+// Data tells whether frames of this type carry a frame header
+func (m MType) Data() bool {
+	return m >= UnconfirmedDataUp && m <= ConfirmedDataDown
+}
+
+// Default delays of the receive windows of a device, after the end of its uplink
+const (
+	ReceiveDelay1    = time.Second
+	ReceiveDelay2    = 2 * time.Second
+	JoinAcceptDelay1 = 5 * time.Second
+	JoinAcceptDelay2 = 6 * time.Second
+)
+
+const (
+	mhdrSize       = 1
+	micSize        = 4
+	fhdrMinSize    = 7 // DevAddr, FCtrl and FCnt
+	maxFOptsSize   = 15
+	fCtrlACK       = 0x20
+	joinRequestLen = mhdrSize + 8 + 8 + 2 + micSize
+)
+
+// Frame is a decoded LoRaWAN frame. Only the fields relevant to its type are set.
+type Frame struct {
+	MType MType
+	Major uint8
+
+	// Data frames
+	DevAddr    uint32 // as usually written, e.g. 0x26011234
+	FCtrl      uint8
+	FCnt       uint16 // 16 least significant bits of the frame counter
+	FOpts      []byte // MAC commands, encrypted in LoRaWAN 1.1
+	FPort      *uint8 // nil without payload
+	FRMPayload []byte // encrypted
+
+	// Join requests
+	JoinEUI  uint64
+	DevEUI   uint64
+	DevNonce uint16
+
+	// Join accepts and proprietary frames, between the MAC header and the MIC
+	Payload []byte
+
+	MIC [micSize]byte
+}
+
+// ErrTooShort is returned for frames too short for their type
+var ErrTooShort = errors.New("Frame too short")
+
+// Decode decodes a PHY payload
+func Decode(phy []byte) (*Frame, error) {
+	if len(phy) < mhdrSize+micSize {
+		return nil, ErrTooShort
+	}
+	f := &Frame{
+		MType: MType(phy[0] >> 5),
+		Major: phy[0] & 0x03,
+	}
+	copy(f.MIC[:], phy[len(phy)-micSize:])
+	body := phy[mhdrSize : len(phy)-micSize]
+
+	switch {
+	case f.MType.Data():
+		if len(body) < fhdrMinSize {
+			return nil, ErrTooShort
+		}
+		f.DevAddr = binary.LittleEndian.Uint32(body[0:4])
+		f.FCtrl = body[4]
+		f.FCnt = binary.LittleEndian.Uint16(body[5:7])
+		fOptsLen := int(f.FCtrl & 0x0f)
+		if len(body) < fhdrMinSize+fOptsLen {
+			return nil, ErrTooShort
+		}
+		f.FOpts = body[fhdrMinSize : fhdrMinSize+fOptsLen]
+		if rest := body[fhdrMinSize+fOptsLen:]; len(rest) > 0 {
+			fPort := rest[0]
+			f.FPort = &fPort
+			f.FRMPayload = rest[1:]
+		}
+	case f.MType == JoinRequest:
+		if len(phy) != joinRequestLen {
+			return nil, fmt.Errorf("Join request of %d bytes, should be %d", len(phy), joinRequestLen)
+		}
+		f.JoinEUI = binary.LittleEndian.Uint64(body[0:8])
+		f.DevEUI = binary.LittleEndian.Uint64(body[8:16])
+		f.DevNonce = binary.LittleEndian.Uint16(body[16:18])
+	default:
+		f.Payload = body
+	}
+	return f, nil
+}
+
+func (f *Frame) String() string {
+	switch {
+	case f.MType.Data():
+		s := fmt.Sprintf("%s DevAddr %08X FCnt %d", f.MType, f.DevAddr, f.FCnt)
+		if f.FPort != nil {
+			s += fmt.Sprintf(" FPort %d", *f.FPort)
+		}
+		return s
+	case f.MType == JoinRequest:
+		return fmt.Sprintf("%s JoinEUI %016X DevEUI %016X DevNonce %d", f.MType, f.JoinEUI, f.DevEUI, f.DevNonce)
+	}
+	return f.MType.String()
+}
@@ -0,0 +1,107 @@
+package lorawan
+
+import (
+	"fmt"
+)
+
+// MAC commands the network sends a LoRaWAN 1.0.x device, or a TS011 relay
+const (
+	LinkCheckAns         byte = 0x02
+	LinkADRReq           byte = 0x03
+	DutyCycleReq         byte = 0x04
+	RXParamSetupReq      byte = 0x05
+	DevStatusReq         byte = 0x06
+	NewChannelReq        byte = 0x07
+	RXTimingSetupReq     byte = 0x08
+	TxParamSetupReq      byte = 0x09
+	DlChannelReq         byte = 0x0a
+	DeviceTimeAns        byte = 0x0d
+	RelayConfReq         byte = 0x40
+	EndDeviceConfReq     byte = 0x41
+	FilterListReq        byte = 0x42
+	UpdateUplinkListReq  byte = 0x43
+	CtrlUplinkListReq    byte = 0x44
+	ConfigureFwdLimitReq byte = 0x45
+)
+
+// variableSize is the size of the MAC commands whose payload takes the rest of the
+// commands
+const variableSize = -1
+
+// downlinkCommands are the names and payload sizes of the MAC commands the network
+// sends. The answers of a device or a relay have the same CID.
+var downlinkCommands = map[byte]struct {
+	name string
+	size int
+}{
+	LinkCheckAns:         {"LinkCheckAns", 2},
+	LinkADRReq:           {"LinkADRReq", 4},
+	DutyCycleReq:         {"DutyCycleReq", 1},
+	RXParamSetupReq:      {"RXParamSetupReq", 4},
+	DevStatusReq:         {"DevStatusReq", 0},
+	NewChannelReq:        {"NewChannelReq", 5},
+	RXTimingSetupReq:     {"RXTimingSetupReq", 1},
+	TxParamSetupReq:      {"TxParamSetupReq", 1},
+	DlChannelReq:         {"DlChannelReq", 4},
+	DeviceTimeAns:        {"DeviceTimeAns", 5},
+	RelayConfReq:         {"RelayConfReq", 5},
+	EndDeviceConfReq:     {"EndDeviceConfReq", 6},
+	FilterListReq:        {"FilterListReq", variableSize},
+	UpdateUplinkListReq:  {"UpdateUplinkListReq", 26},
+	CtrlUplinkListReq:    {"CtrlUplinkListReq", 1},
+	ConfigureFwdLimitReq: {"ConfigureFwdLimitReq", 5},
+}
+
+// CommandName returns the name of a MAC command sent by the network, else its CID
+func CommandName(cid byte) string {
+	if command, ok := downlinkCommands[cid]; ok {
+		return command.name
+	}
+	return fmt.Sprintf("CID 0x%02X", cid)
+}
+
+// Command is a MAC command, or its answer
+type Command struct {
+	CID     byte
+	Payload []byte
+}
+
+func (c Command) String() string {
+	return CommandName(c.CID)
+}
+
+// ParseDownlinkCommands splits the MAC commands the network sent, in FOpts or in the
+// payload of a frame on port 0. The commands following an unknown one can't be told
+// apart, the ones before it are returned with an error.
+func ParseDownlinkCommands(b []byte) ([]Command, error) {
+	var commands []Command
+	for len(b) > 0 {
+		command, ok := downlinkCommands[b[0]]
+		if !ok {
+			return commands, fmt.Errorf("Unknown MAC command %s", CommandName(b[0]))
+		}
+		size := command.size
+		if size == variableSize {
+			size = len(b) - 1
+		}
+		if len(b) < 1+size {
+			return commands, fmt.Errorf("%s of %d bytes, should be %d", command.name, len(b)-1, size)
+		}
+		commands = append(commands, Command{b[0], b[1 : 1+size]})
+		b = b[1+size:]
+	}
+	return commands, nil
+}
+
+// EncodeCommands returns the commands to put in FOpts, as many as fit in its 15 bytes,
+// and how many
+func EncodeCommands(commands []Command) ([]byte, int) {
+	var fOpts []byte
+	for i, command := range commands {
+		if len(fOpts)+1+len(command.Payload) > maxFOptsSize {
+			return fOpts, i
+		}
+		fOpts = append(append(fOpts, command.CID), command.Payload...)
+	}
+	return fOpts, len(commands)
+}
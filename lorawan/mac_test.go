@@ -0,0 +1,93 @@
+package lorawan
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseDownlinkCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		commands []Command
+		err      bool
+	}{
+		{"none", nil, nil, false},
+		{
+			"LoRaWAN",
+			[]byte{0x06, 0x03, 0x51, 0xff, 0x00, 0x01, 0x08, 0x01},
+			[]Command{{DevStatusReq, []byte{}}, {LinkADRReq, []byte{0x51, 0xff, 0x00, 0x01}}, {RXTimingSetupReq, []byte{0x01}}},
+			false,
+		},
+		{
+			"relay",
+			[]byte{0x44, 0x12, 0x42, 0x21, 1, 2, 3},
+			[]Command{{CtrlUplinkListReq, []byte{0x12}}, {FilterListReq, []byte{0x21, 1, 2, 3}}},
+			false,
+		},
+		{"unknown", []byte{0x06, 0x7f, 0x06}, []Command{{DevStatusReq, []byte{}}}, true},
+		{"truncated", []byte{0x06, 0x03, 0x51}, []Command{{DevStatusReq, []byte{}}}, true},
+	}
+	for _, test := range tests {
+		commands, err := ParseDownlinkCommands(test.data)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+		if !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%s: commands %v, expected %v", test.name, commands, test.commands)
+		}
+	}
+}
+
+func TestEncodeCommands(t *testing.T) {
+	commands := []Command{
+		{LinkADRReq, []byte{1}},
+		{DevStatusReq, []byte{0, 5}},
+		{CtrlUplinkListReq, []byte{0, 0, 0, 0, 0}},
+		{RXParamSetupReq, []byte{0}},
+		{NewChannelReq, []byte{0}},
+		{DlChannelReq, []byte{0}},
+	}
+	fOpts, n := EncodeCommands(commands)
+	expected := []byte{0x03, 1, 0x06, 0, 5, 0x44, 0, 0, 0, 0, 0, 0x05, 0, 0x07, 0}
+	if n != 5 || !bytes.Equal(fOpts, expected) {
+		t.Errorf("%d commands encoded as % X, expected 5 as % X", n, fOpts, expected)
+	}
+}
+
+func TestEncodeUplink(t *testing.T) {
+	key := &AES128Key{1}
+	fOpts := []byte{0x06, 0, 5}
+	phy := EncodeUplink(key, 0x01020304, 0x10007, true, fOpts, RelayFPort, []byte{1, 2, 3})
+	frame, err := Decode(phy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.MType != UnconfirmedDataUp || frame.DevAddr != 0x01020304 || frame.FCnt != 7 || frame.FCtrl&fCtrlACK == 0 ||
+		!bytes.Equal(frame.FOpts, fOpts) || frame.FPort == nil || *frame.FPort != RelayFPort {
+		t.Errorf("Decoded as %+v", frame)
+	}
+	if !(&SessionKeys{NwkSKey: key}).VerifyUplink(phy, 0x01020304, 0x10007) {
+		t.Error("Invalid MIC")
+	}
+	if payload := cryptFRMPayload(key, false, 0x01020304, 0x10007, frame.FRMPayload); !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("Payload % X", payload)
+	}
+}
+
+func TestDecodeDownlink(t *testing.T) {
+	key := &AES128Key{1}
+	phy := EncodeDownlink(ConfirmedDataDown, key, 0x01020304, 0x20001, false, nil, 1, []byte{4, 5})
+	frame, err := Decode(phy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := DecodeDownlink(key, phy, frame, 0x20001)
+	if err != nil || !bytes.Equal(payload, []byte{4, 5}) {
+		t.Errorf("Payload % X, error %v", payload, err)
+	}
+	if _, err := DecodeDownlink(key, phy, frame, 1); err != ErrInvalidMIC {
+		t.Errorf("Error %v with the wrong frame counter", err)
+	}
+}
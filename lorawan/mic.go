@@ -0,0 +1,124 @@
+package lorawan
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// AES128Key is a LoRaWAN key, written as 32 hexadecimal digits
+type AES128Key [16]byte
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (k *AES128Key) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != len(k) {
+		return fmt.Errorf("Key of %d hexadecimal digits, should be %d", len(text), hex.EncodedLen(len(k)))
+	}
+	_, err := hex.Decode(k[:], text)
+	return err
+}
+
+// MarshalText implements encoding.TextMarshaler, hiding the key
+func (k AES128Key) MarshalText() ([]byte, error) {
+	return []byte("********"), nil
+}
+
+// aesCMAC computes the AES-CMAC of msg, as specified by RFC 4493
+func aesCMAC(key *AES128Key, msg []byte) [aes.BlockSize]byte {
+	block, _ := aes.NewCipher(key[:]) // only fails for invalid key sizes
+
+	// Subkeys
+	var k1, k2 [aes.BlockSize]byte
+	block.Encrypt(k1[:], k1[:])
+	k1 = doubleBlock(k1)
+	k2 = doubleBlock(k1)
+
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(msg)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+	var last [aes.BlockSize]byte
+	rest := msg[(n-1)*aes.BlockSize:]
+	copy(last[:], rest)
+	if complete {
+		subtle.XORBytes(last[:], last[:], k1[:])
+	} else {
+		last[len(rest)] = 0x80
+		subtle.XORBytes(last[:], last[:], k2[:])
+	}
+
+	var x [aes.BlockSize]byte
+	for i := 0; i < n-1; i++ {
+		subtle.XORBytes(x[:], x[:], msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(x[:], x[:])
+	}
+	subtle.XORBytes(x[:], x[:], last[:])
+	block.Encrypt(x[:], x[:])
+	return x
+}
+
+// doubleBlock multiplies the block by x in GF(2^128), to derive the CMAC subkeys
+func doubleBlock(b [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var d [aes.BlockSize]byte
+	for i := 0; i < aes.BlockSize-1; i++ {
+		d[i] = b[i]<<1 | b[i+1]>>7
+	}
+	d[aes.BlockSize-1] = b[aes.BlockSize-1] << 1
+	if b[0]&0x80 != 0 {
+		d[aes.BlockSize-1] ^= 0x87
+	}
+	return d
+}
+
+// dataB0 is the B0 block prefixed to a data frame to compute its MIC
+func dataB0(downlink bool, devAddr uint32, fcnt uint32, msgLen int) []byte {
+	b0 := make([]byte, aes.BlockSize)
+	b0[0] = 0x49
+	if downlink {
+		b0[5] = 1
+	}
+	binary.LittleEndian.PutUint32(b0[6:10], devAddr)
+	binary.LittleEndian.PutUint32(b0[10:14], fcnt)
+	b0[15] = byte(msgLen)
+	return b0
+}
+
+// dataCMAC computes the CMAC of a data frame prefixed with its B0 block. phy is the
+// whole frame, MIC included, and fcnt the full frame counter.
+func dataCMAC(key *AES128Key, phy []byte, downlink bool, devAddr uint32, fcnt uint32) [aes.BlockSize]byte {
+	msg := phy[:len(phy)-micSize]
+	return aesCMAC(key, append(dataB0(downlink, devAddr, fcnt, len(msg)), msg...))
+}
+
+// SessionKeys are the network session keys of a device, which sign its uplinks: the
+// NwkSKey of a LoRaWAN 1.0.x device, or the FNwkSIntKey of a LoRaWAN 1.1 one.
+//
+// A LoRaWAN 1.1 MIC is made of 2 bytes computed with SNwkSIntKey, then 2 computed with
+// FNwkSIntKey. Only the latter can be checked: the former covers the frame counter of
+// the confirmed downlink acknowledged, and the data rate and channel index of the
+// uplink, which the repeater can't know. A forgery passes with a 1 in 65536 chance.
+type SessionKeys struct {
+	NwkSKey     *AES128Key `json:"nwk_s_key,omitempty" yaml:"nwk_s_key,omitempty"`             // LoRaWAN 1.0.x
+	FNwkSIntKey *AES128Key `json:"f_nwk_s_int_key,omitempty" yaml:"f_nwk_s_int_key,omitempty"` // LoRaWAN 1.1
+}
+
+// VerifyUplink checks the MIC of an uplink data frame from the device with the
+// address. phy is the whole frame and fcnt the full frame counter.
+func (k *SessionKeys) VerifyUplink(phy []byte, devAddr uint32, fcnt uint32) bool {
+	if len(phy) < mhdrSize+micSize {
+		return false
+	}
+	mic := phy[len(phy)-micSize:]
+	switch {
+	case k.NwkSKey != nil:
+		cmac := dataCMAC(k.NwkSKey, phy, false, devAddr, fcnt)
+		return subtle.ConstantTimeCompare(cmac[:micSize], mic) == 1
+	case k.FNwkSIntKey != nil:
+		cmac := dataCMAC(k.FNwkSIntKey, phy, false, devAddr, fcnt)
+		return subtle.ConstantTimeCompare(cmac[:2], mic[2:]) == 1
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package lorawan
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func mustKey(t *testing.T, s string) *AES128Key {
+	t.Helper()
+	var key AES128Key
+	if err := key.UnmarshalText([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return &key
+}
+
+// The examples of RFC 4493, section 4
+func TestAESCMAC(t *testing.T) {
+	key := mustKey(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	tests := []struct {
+		msg  string
+		cmac string
+	}{
+		{"", "bb1d6929e95937287fa37d129b756746"},
+		{"6bc1bee22e409f96e93d7e117393172a", "070a16b46b4d4144f79bdd9dd04a287c"},
+		{"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411", "dfa66747de9ae63030ca32611497c827"},
+		{"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710", "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+	for _, test := range tests {
+		cmac := aesCMAC(key, mustHex(t, test.msg))
+		if got := hex.EncodeToString(cmac[:]); got != test.cmac {
+			t.Errorf("CMAC of %d bytes %s, expected %s", len(test.msg)/2, got, test.cmac)
+		}
+	}
+}
+
+func TestVerifyUplink(t *testing.T) {
+	const devAddr = 0x49BE7DF1
+	key := mustKey(t, "44024241ed4ce9a68c6a8bc055233fd3")
+	phy := mustHex(t, "40F17DBE4900020001954378762B11FF0D")
+
+	// A LoRaWAN 1.1 MIC ends with the first 2 bytes of the CMAC of FNwkSIntKey
+	phy11 := append([]byte(nil), phy...)
+	copy(phy11[len(phy11)-micSize:], []byte{0x12, 0x34, 0x2B, 0x11})
+
+	tampered := append([]byte(nil), phy...)
+	tampered[9] ^= 1
+
+	tests := []struct {
+		name  string
+		keys  SessionKeys
+		phy   []byte
+		fcnt  uint32
+		valid bool
+	}{
+		{"1.0", SessionKeys{NwkSKey: key}, phy, 2, true},
+		{"1.0 upper bits", SessionKeys{NwkSKey: key}, phy, 0x10002, false},
+		{"1.0 tampered", SessionKeys{NwkSKey: key}, tampered, 2, false},
+		{"1.0 other key", SessionKeys{NwkSKey: &AES128Key{}}, phy, 2, false},
+		{"1.1", SessionKeys{FNwkSIntKey: key}, phy11, 2, true},
+		{"1.1 with the 1.0 MIC", SessionKeys{FNwkSIntKey: key}, phy, 2, false},
+		{"no key", SessionKeys{}, phy, 2, false},
+		{"too short", SessionKeys{NwkSKey: key}, phy[:4], 2, false},
+	}
+	for _, test := range tests {
+		if valid := test.keys.VerifyUplink(test.phy, devAddr, test.fcnt); valid != test.valid {
+			t.Errorf("%s: valid %v, expected %v", test.name, valid, test.valid)
+		}
+	}
+}
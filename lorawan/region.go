@@ -0,0 +1,173 @@
+package lorawan
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DataRate is a LoRa modulation
+type DataRate struct {
+	SF        uint8
+	Bandwidth uint32 // in Hz
+}
+
+// Channel is a frequency and a data rate, e.g. of a receive window
+type Channel struct {
+	Freq uint32 // in Hz
+	DataRate
+}
+
+func (c Channel) String() string {
+	return fmt.Sprintf("%.3f MHz SF%d BW%d", float64(c.Freq)/1e6, c.SF, c.Bandwidth/1000)
+}
+
+// Region holds the regional parameters giving the receive windows of an uplink, for
+// the default channel plans and without dwell time limitation
+type Region struct {
+	Name           string
+	RX2            Channel // default RX2 window
+	MaxRX1DROffset int
+
+	dataRates []DataRate // indexed by data rate, unused ones are zero
+	uplinkDRs int        // data rates 0 to uplinkDRs-1 are used by uplinks
+	rx1       func(up Channel, dr int, offset int) (uint32, int, error)
+}
+
+func loraDR(sf uint8, bandwidth uint32) DataRate {
+	return DataRate{sf, bandwidth}
+}
+
+// euLikeDataRates are the data rates of EU868 and AS923
+var euLikeDataRates = []DataRate{
+	loraDR(12, 125000), loraDR(11, 125000), loraDR(10, 125000), loraDR(9, 125000),
+	loraDR(8, 125000), loraDR(7, 125000), loraDR(7, 250000),
+}
+
+// usLikeDownlinkDataRates are the data rates 8 to 13 of US915 and AU915
+var usLikeDownlinkDataRates = []DataRate{
+	loraDR(12, 500000), loraDR(11, 500000), loraDR(10, 500000), loraDR(9, 500000),
+	loraDR(8, 500000), loraDR(7, 500000),
+}
+
+func clampDR(dr, min, max int) int {
+	if dr < min {
+		return min
+	}
+	if dr > max {
+		return max
+	}
+	return dr
+}
+
+// usLikeRX1 returns the RX1 window of US915 and AU915: one of the 8 downlink channels,
+// picked by the index of the uplink channel, at a data rate from 8 to 13
+func usLikeRX1(firstFreq125, firstFreq500 uint32, drBase int) func(Channel, int, int) (uint32, int, error) {
+	return func(up Channel, dr int, offset int) (uint32, int, error) {
+		index := -1
+		switch {
+		case up.Bandwidth == 125000 && up.Freq >= firstFreq125 && (up.Freq-firstFreq125)%200000 == 0:
+			index = int((up.Freq - firstFreq125) / 200000)
+			if index >= 64 {
+				index = -1
+			}
+		case up.Bandwidth == 500000 && up.Freq >= firstFreq500 && (up.Freq-firstFreq500)%1600000 == 0:
+			index = 64 + int((up.Freq-firstFreq500)/1600000)
+			if index >= 72 {
+				index = -1
+			}
+		}
+		if index < 0 {
+			return 0, 0, fmt.Errorf("%.3f MHz isn't an uplink channel", float64(up.Freq)/1e6)
+		}
+		return 923300000 + uint32(index%8)*600000, clampDR(drBase+dr-offset, 8, 13), nil
+	}
+}
+
+var regions = map[string]*Region{
+	"EU868": {
+		Name:           "EU868",
+		RX2:            Channel{869525000, loraDR(12, 125000)},
+		MaxRX1DROffset: 5,
+		dataRates:      euLikeDataRates,
+		uplinkDRs:      7,
+		rx1: func(up Channel, dr int, offset int) (uint32, int, error) {
+			return up.Freq, clampDR(dr-offset, 0, 6), nil
+		},
+	},
+	"AS923": {
+		Name:           "AS923",
+		RX2:            Channel{923200000, loraDR(10, 125000)},
+		MaxRX1DROffset: 7,
+		dataRates:      euLikeDataRates,
+		uplinkDRs:      7,
+		rx1: func(up Channel, dr int, offset int) (uint32, int, error) {
+			// Offsets 6 and 7 raise the data rate by 1 and 2
+			if offset > 5 {
+				offset = 5 - offset
+			}
+			return up.Freq, clampDR(dr-offset, 0, 5), nil
+		},
+	},
+	"US915": {
+		Name:           "US915",
+		RX2:            Channel{923300000, loraDR(12, 500000)},
+		MaxRX1DROffset: 3,
+		dataRates: append([]DataRate{
+			loraDR(10, 125000), loraDR(9, 125000), loraDR(8, 125000), loraDR(7, 125000),
+			loraDR(8, 500000), {}, {}, {},
+		}, usLikeDownlinkDataRates...),
+		uplinkDRs: 5,
+		rx1:       usLikeRX1(902300000, 903000000, 10),
+	},
+	"AU915": {
+		Name:           "AU915",
+		RX2:            Channel{923300000, loraDR(12, 500000)},
+		MaxRX1DROffset: 5,
+		dataRates: append([]DataRate{
+			loraDR(12, 125000), loraDR(11, 125000), loraDR(10, 125000), loraDR(9, 125000),
+			loraDR(8, 125000), loraDR(7, 125000), loraDR(8, 500000), {},
+		}, usLikeDownlinkDataRates...),
+		uplinkDRs: 7,
+		rx1:       usLikeRX1(915200000, 915900000, 8),
+	},
+}
+
+// RegionByName returns the region with the name, e.g. EU868
+func RegionByName(name string) (*Region, bool) {
+	region, ok := regions[name]
+	return region, ok
+}
+
+// RegionNames returns the names of the regions supported
+func RegionNames() []string {
+	var names []string
+	for name := range regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UplinkDataRate returns the index of an uplink data rate
+func (r *Region) UplinkDataRate(dataRate DataRate) (int, error) {
+	for i, d := range r.dataRates[:r.uplinkDRs] {
+		if d == dataRate {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("SF%d BW%d isn't an uplink data rate of %s", dataRate.SF, dataRate.Bandwidth/1000, r.Name)
+}
+
+// RX1 returns the RX1 window of an uplink received on the channel, with the RX1 data
+// rate offset of the device
+func (r *Region) RX1(up Channel, offset int) (Channel, error) {
+	dr, err := r.UplinkDataRate(up.DataRate)
+	if err != nil {
+		return Channel{}, err
+	}
+	freq, rx1DR, err := r.rx1(up, dr, offset)
+	if err != nil {
+		return Channel{}, err
+	}
+	return Channel{freq, r.dataRates[rx1DR]}, nil
+}
@@ -0,0 +1,69 @@
+package lorawan
+
+import (
+	"testing"
+)
+
+func TestRX1(t *testing.T) {
+	tests := []struct {
+		region string
+		up     Channel
+		offset int
+		rx1    Channel // zero if the uplink has no RX1 window
+	}{
+		// Same channel, the data rate lowered by the offset
+		{"EU868", Channel{868100000, loraDR(12, 125000)}, 0, Channel{868100000, loraDR(12, 125000)}},
+		{"EU868", Channel{868300000, loraDR(7, 125000)}, 2, Channel{868300000, loraDR(9, 125000)}},
+		{"EU868", Channel{868500000, loraDR(9, 125000)}, 5, Channel{868500000, loraDR(12, 125000)}},
+		{"EU868", Channel{868300000, loraDR(7, 250000)}, 0, Channel{868300000, loraDR(7, 250000)}},
+		{"EU868", Channel{868300000, loraDR(7, 250000)}, 1, Channel{868300000, loraDR(7, 125000)}},
+		{"EU868", Channel{868100000, loraDR(7, 500000)}, 0, Channel{}},
+
+		// Offsets 6 and 7 raise the data rate, up to DR5
+		{"AS923", Channel{923200000, loraDR(10, 125000)}, 0, Channel{923200000, loraDR(10, 125000)}},
+		{"AS923", Channel{923200000, loraDR(10, 125000)}, 3, Channel{923200000, loraDR(12, 125000)}},
+		{"AS923", Channel{923200000, loraDR(10, 125000)}, 6, Channel{923200000, loraDR(9, 125000)}},
+		{"AS923", Channel{923400000, loraDR(10, 125000)}, 7, Channel{923400000, loraDR(8, 125000)}},
+		{"AS923", Channel{923400000, loraDR(8, 125000)}, 7, Channel{923400000, loraDR(7, 125000)}},
+		{"AS923", Channel{923400000, loraDR(7, 250000)}, 0, Channel{923400000, loraDR(7, 125000)}},
+
+		// One of the 8 downlink channels, by the index of the uplink channel
+		{"US915", Channel{902300000, loraDR(10, 125000)}, 0, Channel{923300000, loraDR(10, 500000)}},
+		{"US915", Channel{902500000, loraDR(7, 125000)}, 0, Channel{923900000, loraDR(7, 500000)}},
+		{"US915", Channel{903700000, loraDR(7, 125000)}, 3, Channel{927500000, loraDR(10, 500000)}},
+		{"US915", Channel{903900000, loraDR(10, 125000)}, 0, Channel{923300000, loraDR(10, 500000)}},
+		{"US915", Channel{914900000, loraDR(9, 125000)}, 1, Channel{927500000, loraDR(10, 500000)}},
+		{"US915", Channel{903000000, loraDR(8, 500000)}, 0, Channel{923300000, loraDR(7, 500000)}},
+		{"US915", Channel{914200000, loraDR(8, 500000)}, 2, Channel{927500000, loraDR(8, 500000)}},
+		{"US915", Channel{902400000, loraDR(10, 125000)}, 0, Channel{}},
+		{"US915", Channel{915100000, loraDR(10, 125000)}, 0, Channel{}},
+		{"US915", Channel{915800000, loraDR(8, 500000)}, 0, Channel{}},
+		{"US915", Channel{902300000, loraDR(12, 125000)}, 0, Channel{}},
+
+		{"AU915", Channel{915200000, loraDR(12, 125000)}, 0, Channel{923300000, loraDR(12, 500000)}},
+		{"AU915", Channel{915400000, loraDR(7, 125000)}, 0, Channel{923900000, loraDR(7, 500000)}},
+		{"AU915", Channel{916800000, loraDR(9, 125000)}, 2, Channel{923300000, loraDR(11, 500000)}},
+		{"AU915", Channel{927800000, loraDR(8, 125000)}, 5, Channel{927500000, loraDR(12, 500000)}},
+		{"AU915", Channel{915900000, loraDR(8, 500000)}, 0, Channel{923300000, loraDR(7, 500000)}},
+		{"AU915", Channel{927100000, loraDR(8, 500000)}, 1, Channel{927500000, loraDR(7, 500000)}},
+		{"AU915", Channel{928000000, loraDR(12, 125000)}, 0, Channel{}},
+	}
+	for _, test := range tests {
+		region, ok := RegionByName(test.region)
+		if !ok {
+			t.Fatalf("Unknown region %s", test.region)
+		}
+		rx1, err := region.RX1(test.up, test.offset)
+		if test.rx1 == (Channel{}) {
+			if err == nil {
+				t.Errorf("%s %s offset %d: RX1 %s, expected none", test.region, test.up, test.offset, rx1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s offset %d: %v", test.region, test.up, test.offset, err)
+		} else if rx1 != test.rx1 {
+			t.Errorf("%s %s offset %d: RX1 %s, expected %s", test.region, test.up, test.offset, rx1, test.rx1)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package lorawan
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// RelayFPort is the port of the frames between a TS011 relay and the network: the
+// uplinks it forwards, and the downlinks it is asked to forward
+const RelayFPort = 226
+
+// UplinkMetadata describes the reception of a forwarded uplink by a TS011 relay
+type UplinkMetadata struct {
+	DataRate   uint8 // regional data rate index
+	SNR        int   // in dB, -20 to 11
+	RSSI       int   // in dBm, -142 to -15
+	WORChannel uint8 // 0 for the default channel
+}
+
+// ForwardUplinkReq returns the payload of the frame forwarding to the network an
+// uplink received on the frequency, in Hz
+func ForwardUplinkReq(meta UplinkMetadata, freq uint32, phy []byte) []byte {
+	snr := clampInt(meta.SNR, -20, 11) + 20
+	rssi := -clampInt(meta.RSSI, -142, -15) - 15
+	metadata := uint32(meta.DataRate&0x0f) | uint32(snr)<<4 | uint32(rssi)<<9 | uint32(meta.WORChannel&0x03)<<16
+	req := make([]byte, 6, 6+len(phy))
+	req[0], req[1], req[2] = byte(metadata), byte(metadata>>8), byte(metadata>>16)
+	f := freq / 100
+	req[3], req[4], req[5] = byte(f), byte(f>>8), byte(f>>16)
+	return append(req, phy...)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// cryptFRMPayload encrypts or decrypts the FRMPayload of a data frame
+func cryptFRMPayload(key *AES128Key, downlink bool, devAddr uint32, fcnt uint32, payload []byte) []byte {
+	block, _ := aes.NewCipher(key[:]) // only fails for invalid key sizes
+	out := make([]byte, len(payload))
+	a := make([]byte, aes.BlockSize)
+	a[0] = 0x01
+	if downlink {
+		a[5] = 1
+	}
+	binary.LittleEndian.PutUint32(a[6:10], devAddr)
+	binary.LittleEndian.PutUint32(a[10:14], fcnt)
+	s := make([]byte, aes.BlockSize)
+	for i := 0; i < len(payload); i += aes.BlockSize {
+		a[15] = byte(i/aes.BlockSize + 1)
+		block.Encrypt(s, a)
+		subtle.XORBytes(out[i:], payload[i:], s)
+	}
+	return out
+}
+
+// EncodeUplink returns an unconfirmed data uplink of a LoRaWAN 1.0.x device, carrying
+// the payload on the port. fOpts are MAC commands, at most 15 bytes, and ack
+// acknowledges a confirmed downlink. The payload is encrypted and the frame signed
+// with key, which must be the NwkSKey for port 0 and RelayFPort.
+func EncodeUplink(key *AES128Key, devAddr uint32, fcnt uint32, ack bool, fOpts []byte, fPort uint8, payload []byte) []byte {
+	return encodeData(UnconfirmedDataUp, key, devAddr, fcnt, ack, fOpts, fPort, payload)
+}
+
+// EncodeDownlink returns a data downlink of type mType to a LoRaWAN 1.0.x device, as
+// the network would, e.g. to a relay. The arguments are those of EncodeUplink.
+func EncodeDownlink(mType MType, key *AES128Key, devAddr uint32, fcnt uint32, ack bool, fOpts []byte, fPort uint8, payload []byte) []byte {
+	return encodeData(mType, key, devAddr, fcnt, ack, fOpts, fPort, payload)
+}
+
+func encodeData(mType MType, key *AES128Key, devAddr uint32, fcnt uint32, ack bool, fOpts []byte, fPort uint8, payload []byte) []byte {
+	size := mhdrSize + fhdrMinSize + len(fOpts) + 1
+	phy := make([]byte, mhdrSize+fhdrMinSize, size+len(payload)+micSize)
+	phy[0] = byte(mType) << 5
+	binary.LittleEndian.PutUint32(phy[1:5], devAddr)
+	phy[5] = byte(len(fOpts) & 0x0f)
+	if ack {
+		phy[5] |= fCtrlACK
+	}
+	binary.LittleEndian.PutUint16(phy[6:8], uint16(fcnt))
+	phy = append(append(phy, fOpts...), fPort)
+	downlink := mType.Downlink()
+	phy = append(phy, cryptFRMPayload(key, downlink, devAddr, fcnt, payload)...)
+	phy = append(phy, make([]byte, micSize)...)
+	cmac := dataCMAC(key, phy, downlink, devAddr, fcnt)
+	copy(phy[len(phy)-micSize:], cmac[:micSize])
+	return phy
+}
+
+// ErrInvalidMIC is returned for frames whose MIC doesn't match their content
+var ErrInvalidMIC = errors.New("Invalid MIC")
+
+// DecodeDownlink checks the MIC of a data downlink to a LoRaWAN 1.0.x device, and
+// returns its decrypted FRMPayload. fcnt is the full frame counter.
+func DecodeDownlink(key *AES128Key, phy []byte, frame *Frame, fcnt uint32) ([]byte, error) {
+	if len(phy) < mhdrSize+micSize {
+		return nil, ErrTooShort
+	}
+	cmac := dataCMAC(key, phy, true, frame.DevAddr, fcnt)
+	if subtle.ConstantTimeCompare(cmac[:micSize], frame.MIC[:]) != 1 {
+		return nil, ErrInvalidMIC
+	}
+	return cryptFRMPayload(key, true, frame.DevAddr, fcnt, frame.FRMPayload), nil
+}
@@ -3,88 +3,444 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/NaNkeen/packet_repeater/gpio"
+	"github.com/NaNkeen/packet_repeater/gwmp"
+	"github.com/NaNkeen/packet_repeater/store"
 	"github.com/NaNkeen/packet_repeater/wrapper"
+	"io"
 	"os"
 	"os/signal"
-	"sync"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-const initUplinkPollingRate = 100 * time.Microsecond
+// Bounds of the rate at which the concentrator is polled for uplinks. Its FIFO holds
+// 16 packets, far more than can be received in maxUplinkPollingRate.
+const (
+	minUplinkPollingRate = time.Millisecond
+	maxUplinkPollingRate = 20 * time.Millisecond
+)
+
+// txEndMargin is how long past its time on air an emission may take to complete
+const txEndMargin = 100 * time.Millisecond
+
+// receiver fetches the uplink packets received since its last call
+type receiver func() ([]wrapper.Packet, error)
+
+// transmitter repeats a single packet
+type transmitter func(wrapper.Packet, wrapper.TxParams) error
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// repeaterOptions selects where the uplinks come from and what happens to the repeats
+type repeaterOptions struct {
+	replayPath string                    // replay uplinks from this capture file instead of the concentrator
+	recordPath string                    // record received uplinks to this capture file
+	listenOnly bool                      // log repeats instead of transmitting them
+	reload     func() (globalConf, bool) // loads the configuration again on SIGHUP
+}
+
+// runRepeater runs the repeater until a signal is received or a routine fails,
+// and returns the process exit code
+func runRepeater(conf globalConf, opts repeaterOptions) int {
 	// System signals
-	sigc := make(chan os.Signal)
-	signal.Notify(sigc, os.Interrupt, os.Kill, syscall.SIGABRT)
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, os.Kill, syscall.SIGABRT, syscall.SIGHUP)
 
-	// ==================
-	// Setup process
-	// ==================
-	if err := wrapper.SetBoardConf(1, true); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
-	fmt.Println("SX1301 board configured successfully")
+	var receive receiver
+	var transmit transmitter
+	var boards []*wrapper.Concentrator // nil when replaying
+	var board *wrapper.Concentrator    // emitting the repeats
 
-	// Configure TX Gain Lut
-	if err := wrapper.SetTXGainConf(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
+	if opts.replayPath != "" {
+		// Replaying doesn't touch the concentrator, repeats are only logged
+		replay, err := newReplayer(opts.replayPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		defer replay.Close()
+		receive = replay.receive
+		transmit = logPacket
+		fmt.Printf("Replaying uplink packets from %s\n", opts.replayPath)
+	} else {
+		var err error
+		if boards, err = openBoards(&conf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		defer closeBoards(boards)
+		var receivers []receiver
+		for _, i := range conf.receiveBoards() {
+			receivers = append(receivers, boards[i].Receive)
+		}
+		receive = mergeReceivers(receivers)
+		board = boards[conf.Gateway.TransmitBoard]
+		transmit = func(pkt wrapper.Packet, params wrapper.TxParams) error {
+			return sendPacket(board, pkt, params)
+		}
+	}
+	if opts.listenOnly {
+		transmit = logPacket
 	}
-	fmt.Println("TX Gain Lut configured successfully")
 
-	// Configure RF and SF channels
-	if err := wrapper.SetRFChannels(); err != nil {
-		fmt.Println(os.Stderr, err)
-		return
+	var record *recorder
+	if opts.recordPath != "" {
+		var err error
+		if record, err = newRecorder(opts.recordPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		receive = record.tee(receive)
+		fmt.Printf("Recording uplink packets to %s\n", opts.recordPath)
 	}
 
-	if err := wrapper.SetSFChannels(); err != nil {
-		fmt.Println(os.Stderr, err)
-		return
+	// The state of a live repeater is neither resumed nor altered by replays
+	var st *store.Store
+	if conf.Gateway.StatePath != "" && opts.replayPath == "" {
+		var err error
+		if st, err = store.Open(conf.Gateway.StatePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if record != nil {
+				record.Close()
+			}
+			return exitFailure
+		}
+		defer st.Close()
 	}
-	fmt.Println("RF and SF configured successfully")
 
-	// Configure individual LoRa standard and FSK channels
-	if err := configureIndividualChannels(); err != nil {
-		fmt.Println(os.Stderr, err)
-		return
+	if opts.replayPath == "" {
+		if err := setupBoards(boards, &conf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if record != nil {
+				record.Close()
+			}
+			return exitFailure
+		}
+		fmt.Println("LoRa gateway started successfully")
 	}
-	fmt.Println("LoRa std and FSK channel configured successfully")
 
-	// Start LoRa gateway
-	if err := wrapper.StartLoRaGateway(); err != nil {
-		fmt.Println(os.Stderr, err)
-		return
+	// The location is the one of the boards, replays report the recorded one
+	var gps *os.File
+	if conf.Gateway.FakeGPS {
+		for _, board := range boards {
+			board.SetLocation(wrapper.GPSCoordinates{
+				Latitude:  conf.Gateway.RefLatitude,
+				Longitude: conf.Gateway.RefLongitude,
+				Altitude:  conf.Gateway.RefAltitude,
+			})
+		}
+	} else if conf.Gateway.GPSTTYPath != "" && boards != nil {
+		// Without GPS, the repeater still works, only without time reference and location
+		var err error
+		if gps, err = openGPS(conf.Gateway.GPSTTYPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			go gpsRoutine(gps, boards)
+		}
 	}
-	defer wrapper.StopLoRaGateway()
-	fmt.Println("LoRa gateway started successfully")
 
-	// TODO Spawn uplink handler Go routines
+	rep, err := newRepeater(conf.Repeater)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitInvalidConfig
+	}
+	if relay := conf.Repeater.DownlinkRelay; relay != nil {
+		for _, channel := range relay.unheardWindows(conf.transmitSX1301()) {
+			fmt.Fprintf(os.Stderr, "No channel listens to %s, downlinks emitted there can't be relayed\n", channel)
+		}
+	}
+	if st != nil {
+		if err := rep.resume(st); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	var statClient *gwmp.Client
+	if opts.replayPath == "" {
+		statClient = dialStatServers(&conf.Gateway)
+	}
+	go statsRoutine(ctx, rep, time.Duration(conf.Gateway.StatInterval)*time.Second, statClient, board)
+
+	code, running := superviseRoutines(rep, &conf, opts, boards, receive, transmit, sigc)
+
+	// Orderly shutdown. A second signal terminates the process right away.
+	signal.Stop(sigc)
+	fmt.Println("Shutting down")
+
+	// No more uplinks, then let the current emission end
+	if running != nil {
+		rep.stopRoutines(running)
+	}
+	cancel()
+	if gps != nil {
+		gps.Close()
+	}
+	if statClient != nil {
+		statClient.Close()
+	}
+
+	if record != nil {
+		if err := record.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = exitFailure
+		} else {
+			fmt.Printf("Capture %s saved\n", opts.recordPath)
+		}
+	}
+	fmt.Printf("Statistics: %s\n", rep.stats.snapshot())
 
+	if boards != nil {
+		if err := stopBoards(boards); err != nil {
+			code = exitFailure
+		} else {
+			fmt.Println("LoRa gateway stopped")
+		}
+	}
+	return code
+}
+
+// superviseRoutines runs the routines, restarting the concentrator when they report
+// HAL errors and reloading the configuration on SIGHUP, until a signal is received or
+// a routine fails. It returns the exit code and the routines still running, if any.
+func superviseRoutines(rep *repeater, conf *globalConf, opts repeaterOptions, boards []*wrapper.Concentrator, receive receiver, transmit transmitter, sigc chan os.Signal) (int, *routines) {
 	errc := make(chan error)
-	pktc := make(chan wrapper.Packet)
+	running := rep.start(receive, transmit, errc)
+	sup := newSupervisor(&rep.stats, boards)
 
-	go uplinkRoutine(ctx, errc, pktc)
-	go broadcastRoutine(ctx, errc, pktc)
+	for {
+		var failed, reconfigure bool
+		select {
+		case err := <-errc:
+			if err == io.EOF {
+				fmt.Println("Replay finished, repeating the queued packets")
+				return finishReplay(running, errc, sigc), running
+			}
+			fmt.Fprintln(os.Stderr, err)
+			if !isHALError(err) || opts.replayPath != "" {
+				return exitFailure, running
+			}
+			// Repeated HAL errors: bring the concentrator back
+			failed = true
+		case sig := <-sigc:
+			if sig != syscall.SIGHUP {
+				fmt.Fprintf(os.Stderr, "[!] Signal %s\n", sig.String())
+				return exitOK, running
+			}
+			reconfigure = reload(rep, conf, opts)
+		}
+		if !failed && !reconfigure {
+			continue
+		}
 
+		rep.stopRoutines(running)
+		reloadConf := func() bool { return reload(rep, conf, opts) }
+		var sig os.Signal
+		if reconfigure {
+			sig = sup.reconfigure(conf, sigc, reloadConf)
+		} else {
+			sig = sup.recover(conf, sigc, reloadConf)
+		}
+		if sig != nil {
+			fmt.Fprintf(os.Stderr, "[!] Signal %s\n", sig.String())
+			return exitOK, nil
+		}
+		running = rep.start(receive, transmit, errc)
+	}
+}
+
+// finishReplay waits for the repeats of the replayed packets to be emitted, unless a
+// routine fails or a signal is received first, and returns the exit code
+func finishReplay(running *routines, errc chan error, sigc chan os.Signal) int {
+	running.finish()
 	select {
+	case <-running.broadcastDone:
+		return exitOK
 	case err := <-errc:
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	case sig := <-sigc:
+		fmt.Fprintf(os.Stderr, "[!] Signal %s\n", sig.String())
+		return exitOK
+	}
+}
+
+// reload loads the configuration again and applies the repeater policy. It returns
+// whether the concentrator has to be restarted for the new SX1301 configuration.
+func reload(rep *repeater, conf *globalConf, opts repeaterOptions) bool {
+	if opts.reload == nil {
+		return false
+	}
+	newConf, ok := opts.reload()
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Configuration not reloaded, keeping the current one")
+		return false
+	}
+	if err := rep.setConf(newConf.Repeater); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Configuration not reloaded, keeping the current one")
+		return false
+	}
+	fmt.Println("Repeater configuration reloaded")
+
+	// The servers, the GPS and the state file are set up once, the settings in effect
+	// are kept until the repeater restarts
+	if changed := conf.Gateway.changes(&newConf.Gateway); len(changed) > 0 {
+		fmt.Fprintf(os.Stderr, "Not reloaded, restart the repeater to apply: %s\n", strings.Join(changed, ", "))
+		newConf.Gateway = conf.Gateway
+	}
+	// The workers are started once too
+	if len(newConf.Boards) != len(conf.Boards) {
+		fmt.Fprintln(os.Stderr, "Not reloaded, restart the repeater to apply: boards")
+		newConf.Boards = conf.Boards
+	}
+	var restart bool
+	boards := conf.boards()
+	for i, board := range newConf.boards() {
+		if board.Worker != boards[i].Worker {
+			fmt.Fprintf(os.Stderr, "Not reloaded, restart the repeater to apply: boards[%d].worker\n", i-1)
+			newConf.Boards[i-1].Worker = boards[i].Worker
+		}
+		if !reflect.DeepEqual(board.Reset, boards[i].Reset) {
+			path := "reset_conf"
+			if i > 0 {
+				path = fmt.Sprintf("boards[%d].reset_conf", i-1)
+			}
+			fmt.Printf("%s changed, applied the next time the concentrator is restarted\n", path)
+		}
+		restart = restart || !reflect.DeepEqual(board.SX1301, boards[i].SX1301)
+	}
+
+	restart = restart && opts.replayPath == ""
+	if restart {
+		fmt.Println("SX1301 configuration changed, restarting the concentrator")
+	}
+	*conf = newConf
+	return restart
+}
+
+// resetConcentrator pulses the reset pin of the concentrator, if configured
+func resetConcentrator(conf *resetConf) error {
+	if conf == nil {
+		return nil
+	}
+	if err := gpio.Reset(conf.opener(), conf.Pin, conf.ActiveLow); err != nil {
+		return fmt.Errorf("Concentrator reset failed: %v", err)
+	}
+	fmt.Printf("SX1301 reset through GPIO %d\n", conf.Pin)
+	return nil
+}
+
+// openBoards opens the board of SX1301_conf, and starts the workers of the other ones
+func openBoards(conf *globalConf) ([]*wrapper.Concentrator, error) {
+	board, err := wrapper.Open()
+	if err != nil {
+		return nil, err
+	}
+	boards := []*wrapper.Concentrator{board}
+	for i, b := range conf.Boards {
+		worker, err := wrapper.StartWorker(b.Worker, "board")
 		if err != nil {
+			closeBoards(boards)
+			return nil, fmt.Errorf("boards[%d]: %v", i, err)
+		}
+		boards = append(boards, worker)
+	}
+	return boards, nil
+}
+
+func closeBoards(boards []*wrapper.Concentrator) {
+	for _, board := range boards {
+		board.Close()
+	}
+}
+
+// setupBoards resets, configures and starts every board
+func setupBoards(boards []*wrapper.Concentrator, conf *globalConf) error {
+	for i, b := range conf.boards() {
+		if len(boards) > 1 {
+			fmt.Printf("Starting board %d\n", i)
+		}
+		if err := resetConcentrator(b.Reset); err != nil {
+			return err
+		}
+		if err := setupConcentrator(boards[i], b.SX1301); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopBoards stops every board, printing the errors, and returns the first one
+func stopBoards(boards []*wrapper.Concentrator) error {
+	var first error
+	for _, board := range boards {
+		if err := board.Stop(); err != nil {
 			fmt.Fprintln(os.Stderr, err)
+			if first == nil {
+				first = err
+			}
 		}
-	case sig := <-sigc:
-		fmt.Fprintf(os.Stderr, "[!] Signal %s\n", sig.String())
 	}
+	return first
+}
+
+// setupConcentrator configures the board, gains, radios and channels, then starts the concentrator
+func setupConcentrator(board *wrapper.Concentrator, conf wrapper.SX1301Conf) error {
+	if err := board.SetBoardConf(uint(conf.Clksrc), conf.LorawanPublic); err != nil {
+		return err
+	}
+	fmt.Println("SX1301 board configured successfully")
+
+	// Configure TX Gain Lut
+	if err := board.SetTXGainConf(conf.TxLuts()); err != nil {
+		return err
+	}
+	fmt.Println("TX Gain Lut configured successfully")
+
+	// Configure RF and SF channels
+	if err := board.SetRFChannels(conf.Radios()); err != nil {
+		return err
+	}
+
+	if err := board.SetSFChannels(conf.MultiSFChannels()); err != nil {
+		return err
+	}
+	fmt.Println("RF and SF configured successfully")
+
+	// Configure individual LoRa standard and FSK channels
+	if err := configureIndividualChannels(board, conf); err != nil {
+		return err
+	}
+	fmt.Println("LoRa std and FSK channel configured successfully")
+
+	// Configure listen-before-talk, disabled if missing
+	var lbt wrapper.LbtConf
+	if conf.LbtConfig != nil {
+		lbt = *conf.LbtConfig
+	}
+	if err := board.SetLBTConf(lbt); err != nil {
+		return err
+	}
+	if lbt.Enabled {
+		fmt.Println("LBT configured successfully")
+	}
+
+	// Start LoRa gateway
+	return board.Start()
 }
 
-func configureIndividualChannels() error {
+func configureIndividualChannels(board *wrapper.Concentrator, conf wrapper.SX1301Conf) error {
 	// Configuring LoRa standard channel
-	if lora := wrapper.GetLoraSTDChannel(); lora != nil {
-		err := wrapper.SetStandardChannel(*lora)
+	if lora := conf.LoraSTDChannel; lora != nil {
+		err := board.SetStandardChannel(*lora)
 		if err != nil {
 			return err
 		}
@@ -93,8 +449,8 @@ func configureIndividualChannels() error {
 	}
 
 	// Configuring FSK channel
-	if fsk := wrapper.GetFSKChannel(); fsk != nil {
-		err := wrapper.SetFSKChannel(*fsk)
+	if fsk := conf.FSKChannel; fsk != nil {
+		err := board.SetFSKChannel(*fsk)
 		if err != nil {
 			return err
 		}
@@ -105,75 +461,110 @@ func configureIndividualChannels() error {
 	return nil
 }
 
-func uplinkRoutine(ctx context.Context, errc chan error, pktc chan wrapper.Packet) {
+// uplinkRoutine polls the concentrator and queues the received packets for broadcastRoutine.
+// The polling rate adapts to the traffic: it backs off while no packet is received, and
+// tightens again as soon as one is. Packets which don't fit in the queue are dropped.
+func (r *repeater) uplinkRoutine(ctx context.Context, errc chan error, pktc chan wrapper.Packet, receive receiver) {
 	fmt.Println("Awaiting uplink packets")
+	var halErrors int
+	pollingRate := minUplinkPollingRate
+	timer := time.NewTimer(pollingRate)
+	defer timer.Stop()
 	for {
-		packets, err := wrapper.Receive()
-		if err != nil {
-			errc <- err
+		packets, err := receive()
+		if err != nil && isHALError(err) {
+			atomic.AddUint64(&r.stats.halErrors, 1)
+			halErrors++
+		}
+		if err != nil && (!isHALError(err) || halErrors >= maxConsecutiveHALErrors) {
+			select {
+			case errc <- err:
+			case <-ctx.Done():
+			}
 			return
 		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			halErrors = 0
+		}
 
 		if len(packets) == 0 {
-			time.Sleep(initUplinkPollingRate)
-			continue
-		}
+			pollingRate *= 2
+			if pollingRate > maxUplinkPollingRate {
+				pollingRate = maxUplinkPollingRate
+			}
+		} else {
+			pollingRate = minUplinkPollingRate
 
-		fmt.Printf("Received: %+v\n", packets)
+			fmt.Printf("Received: %+v\n", packets)
+			atomic.AddUint64(&r.stats.received, uint64(len(packets)))
 
-		for _, pkt := range packets {
-			pktc <- pkt
+			for _, pkt := range packets {
+				if pkt.Status == wrapper.StatusCRCOK {
+					atomic.AddUint64(&r.stats.receivedOK, 1)
+				}
+				select {
+				case pktc <- pkt:
+				default:
+					atomic.AddUint64(&r.stats.dropped, 1)
+					fmt.Fprintf(os.Stderr, "Repeat queue full, dropping: %+v\n", pkt)
+				}
+			}
 		}
 
-		// Check for cancel from context
+		timer.Reset(pollingRate)
 		select {
 		case <-ctx.Done():
-			errc <- nil
 			return
-		default:
-			continue
+		case <-timer.C:
 		}
 	}
 }
 
-func broadcastRoutine(ctx context.Context, errc chan error, pktc chan wrapper.Packet) {
-	fmt.Println("Waiting to repeat")
-	crc_stack := make([]uint16, 0, 16)
-	lock := &sync.Mutex{}
-	go sliceTimeout(lock, &crc_stack)
-OUTER:
-	for {
-		select {
-		case pkt := <-pktc:
-			fmt.Println(crc_stack)
-			lock.Lock()
-			for _, crc := range crc_stack {
-				if pkt.CRC == crc {
-					lock.Unlock()
-					continue OUTER
-				}
-			}
-			if err := wrapper.SendPacket(pkt); err != nil {
-				fmt.Fprintln(os.Stderr, err)
+// mergeReceivers returns a receiver fetching the uplinks of every receiver. The packets
+// received by the others are still returned when one fails, with its error.
+func mergeReceivers(receivers []receiver) receiver {
+	if len(receivers) == 1 {
+		return receivers[0]
+	}
+	return func() ([]wrapper.Packet, error) {
+		var all []wrapper.Packet
+		var first error
+		for _, receive := range receivers {
+			packets, err := receive()
+			if err != nil && first == nil {
+				first = err
 			}
-			wrapper.WaitForConcentrator()
-			crc_stack = append(crc_stack, pkt.CRC)
-			fmt.Printf("Repeated: %+v\n", pkt)
-			lock.Unlock()
-		case <-ctx.Done():
-			errc <- nil
-			return
-		default:
-			continue
+			all = append(all, packets...)
 		}
+		return all, first
 	}
 }
 
-func sliceTimeout(lock *sync.Mutex, slice *[]uint16) {
-	for {
-		time.Sleep(5 * time.Second)
-		lock.Lock()
-		*slice = (*slice)[:0]
-		lock.Unlock()
+// sendPacket repeats the packet through the concentrator and waits for the emission to
+// end, which for a scheduled repeat includes waiting for its time to come
+func sendPacket(board *wrapper.Concentrator, pkt wrapper.Packet, params wrapper.TxParams) error {
+	airtime, err := wrapper.TimeOnAir(pkt, params)
+	if err != nil {
+		return err
 	}
+	var delay time.Duration
+	if params.Mode == wrapper.TxOnGPS && pkt.GPSTime != nil {
+		delay = params.GPSTime - *pkt.GPSTime - time.Since(pkt.ReceivedAt)
+	} else if params.Mode == wrapper.TxTimestamped {
+		delay = time.Duration(int32(params.CountUS-pkt.CountUS))*time.Microsecond - time.Since(pkt.ReceivedAt)
+	} else if params.Mode == wrapper.TxImmediate && board.LBTEnabled() {
+		delay = wrapper.LBTTxDelay
+	}
+	if err := board.SendPacket(pkt, params); err != nil {
+		return err
+	}
+	return board.WaitForConcentrator(delay + airtime + txEndMargin)
+}
+
+// logPacket stands in for sendPacket when no concentrator is available
+func logPacket(pkt wrapper.Packet, params wrapper.TxParams) error {
+	fmt.Printf("Would repeat: %+v with %+v\n", pkt, params)
+	return nil
 }
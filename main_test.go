@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"testing"
+	"time"
+)
+
+func TestMergeReceivers(t *testing.T) {
+	halErr := &wrapper.HALError{}
+	board := func(crc uint16, err error) receiver {
+		return func() ([]wrapper.Packet, error) {
+			if err != nil {
+				return nil, err
+			}
+			return []wrapper.Packet{testPacket(crc, time.Now())}, nil
+		}
+	}
+
+	receive := mergeReceivers([]receiver{board(1, nil), board(2, halErr), board(3, nil)})
+	packets, err := receive()
+	if err != halErr {
+		t.Errorf("Error %v, expected the one of the failing board", err)
+	}
+	// The packets of the other boards aren't lost
+	if len(packets) != 2 || packets[0].CRC != 1 || packets[1].CRC != 3 {
+		t.Errorf("Received %+v", packets)
+	}
+}
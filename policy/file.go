@@ -0,0 +1,40 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+)
+
+// ErrRuleFileType is returned by LoadRules for a file which is neither JSON nor YAML
+var ErrRuleFileType = errors.New("Rule files should be .json, .yaml or .yml")
+
+// LoadRules reads a list of rules from a JSON or YAML file, depending on its extension.
+// Unknown keys are reported as errors.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	switch filepath.Ext(path) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&rules)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&rules)
+	default:
+		return nil, ErrRuleFileType
+	}
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return rules, nil
+}
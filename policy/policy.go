@@ -0,0 +1,84 @@
+// Package policy decides which received packets the repeater repeats, and how.
+package policy
+
+import (
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+)
+
+// History is what the repeater remembers of the packets it handled
+type History interface {
+	// Repeated tells whether the same packet was repeated recently, or is about to be
+	Repeated(pkt wrapper.Packet) bool
+}
+
+// TxOverrides changes how a packet is repeated. Unset fields keep the settings of the
+// repeater and of the packet.
+type TxOverrides struct {
+	RfPower   *int8  // TX power, in dBm
+	InvertPol *bool  // emit with inverted IQ or not
+	Preamble  uint16 // preamble length, in symbols for LoRa and bytes for FSK
+	Immediate bool   // emit right away, outside the GPS slots
+}
+
+// Priority ranks the repeats when airtime is scarce: the repeater emits the higher
+// priority ones first, and sheds the lower priority ones first
+type Priority uint8
+
+// Priorities, PriorityUnset leaves it to DefaultPriority
+const (
+	PriorityUnset Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = [...]string{"", "low", "normal", "high"}
+
+func (p Priority) String() string {
+	if int(p) < len(priorityNames) {
+		return priorityNames[p]
+	}
+	return fmt.Sprintf("Priority(%d)", uint8(p))
+}
+
+// ParsePriority returns the priority with the given name: low, normal or high
+func ParsePriority(name string) (Priority, bool) {
+	for i, n := range priorityNames {
+		if n == name && n != "" {
+			return Priority(i), true
+		}
+	}
+	return PriorityUnset, false
+}
+
+// DefaultPriority is the priority of a frame when the policy didn't set one: join
+// requests and confirmed uplinks are high, as devices retry them at a cost, unconfirmed
+// uplinks are low, and anything else is normal
+func DefaultPriority(frame *lorawan.Frame) Priority {
+	if frame == nil {
+		return PriorityNormal
+	}
+	switch frame.MType {
+	case lorawan.JoinRequest, lorawan.RejoinRequest, lorawan.ConfirmedDataUp:
+		return PriorityHigh
+	case lorawan.UnconfirmedDataUp:
+		return PriorityLow
+	}
+	return PriorityNormal
+}
+
+// Decision is the outcome of a policy for a packet
+type Decision struct {
+	Repeat   bool
+	Reason   string   // why the packet is repeated or dropped, for the logs
+	Priority Priority // of the repeat, the default of the frame if unset
+	Tx       TxOverrides
+}
+
+// Policy decides the fate of each received packet. frame is nil if the payload isn't a
+// LoRaWAN frame.
+type Policy interface {
+	Decide(pkt wrapper.Packet, frame *lorawan.Frame, history History) Decision
+}
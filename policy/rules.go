@@ -0,0 +1,278 @@
+package policy
+
+import (
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"strconv"
+	"strings"
+)
+
+// Actions of a rule
+const (
+	ActionRepeat = "repeat"
+	ActionDrop   = "drop"
+)
+
+// Range bounds a value, on either or both sides, bounds included
+type Range struct {
+	Min *float64 `json:"min,omitempty" yaml:"min,omitempty"`
+	Max *float64 `json:"max,omitempty" yaml:"max,omitempty"`
+}
+
+func (r *Range) contains(v float64) bool {
+	return r == nil || ((r.Min == nil || v >= *r.Min) && (r.Max == nil || v <= *r.Max))
+}
+
+// Match selects packets: a packet matches if it meets every condition set. Conditions
+// on the frame header never match packets which aren't LoRaWAN data frames.
+type Match struct {
+	Frequencies      []uint32 `json:"frequencies,omitempty" yaml:"frequencies,omitempty"` // in Hz
+	Modulation       string   `json:"modulation,omitempty" yaml:"modulation,omitempty"`   // LORA or FSK
+	SpreadingFactors []uint8  `json:"sf,omitempty" yaml:"sf,omitempty"`
+	RSSI             *Range   `json:"rssi,omitempty" yaml:"rssi,omitempty"` // in dB
+	SNR              *Range   `json:"snr,omitempty" yaml:"snr,omitempty"`   // in dB
+	Size             *Range   `json:"size,omitempty" yaml:"size,omitempty"` // payload size, in bytes
+	MTypes           []string `json:"mtype,omitempty" yaml:"mtype,omitempty"`
+	DevAddrs         []string `json:"dev_addr,omitempty" yaml:"dev_addr,omitempty"` // hexadecimal address, or prefix/length
+	FPorts           []uint8  `json:"fport,omitempty" yaml:"fport,omitempty"`
+}
+
+// Rule applies its action to the packets it matches
+type Rule struct {
+	Name      string `json:"name,omitempty" yaml:"name,omitempty"`
+	Match     Match  `json:"match" yaml:"match"`
+	Action    string `json:"action" yaml:"action"`                             // repeat or drop
+	RfPower   *int8  `json:"rf_power,omitempty" yaml:"rf_power,omitempty"`     // for repeats
+	InvertPol *bool  `json:"invert_pol,omitempty" yaml:"invert_pol,omitempty"` // for repeats
+	Preamble  uint16 `json:"preamble,omitempty" yaml:"preamble,omitempty"`     // for repeats
+	Priority  string `json:"priority,omitempty" yaml:"priority,omitempty"`     // for repeats: low, normal or high
+	Immediate bool   `json:"immediate,omitempty" yaml:"immediate,omitempty"`   // for repeats: right away, outside the GPS slots
+}
+
+// devAddrPrefix matches the DevAddr whose bits bits most significant bits are those of addr
+type devAddrPrefix struct {
+	addr uint32
+	bits uint
+}
+
+func (p devAddrPrefix) matches(addr uint32) bool {
+	if p.bits == 0 {
+		return true
+	}
+	shift := 32 - p.bits
+	return addr>>shift == p.addr>>shift
+}
+
+func parseDevAddrPrefix(s string) (devAddrPrefix, error) {
+	prefix := devAddrPrefix{bits: 32}
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		bits, err := strconv.ParseUint(s[i+1:], 10, 8)
+		if err != nil || bits > 32 {
+			return prefix, fmt.Errorf("invalid DevAddr prefix length in %q, should be between 0 and 32", s)
+		}
+		prefix.bits = uint(bits)
+		s = s[:i]
+	}
+	addr, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 8 {
+		return prefix, fmt.Errorf("invalid DevAddr %q, should be 8 hexadecimal digits", s)
+	}
+	prefix.addr = uint32(addr)
+	return prefix, nil
+}
+
+// compiledRule is a Rule with its conditions parsed
+type compiledRule struct {
+	*Rule
+	name       string // the name of the rule, or its index
+	modulation uint8
+	priority   Priority
+	mTypes     []lorawan.MType
+	devAddrs   []devAddrPrefix
+}
+
+// Validate checks the rule, and returns every problem found as a field and a message
+func (r *Rule) Validate() []FieldError {
+	_, errs := r.compile()
+	return errs
+}
+
+// FieldError is a problem with a field of a rule
+type FieldError struct {
+	Field   string // e.g. match.dev_addr[1]
+	Message string
+}
+
+func (r *Rule) compile() (*compiledRule, []FieldError) {
+	var errs []FieldError
+	c := &compiledRule{Rule: r}
+
+	switch r.Action {
+	case ActionRepeat, ActionDrop:
+	default:
+		errs = append(errs, FieldError{"action", fmt.Sprintf("invalid action %q, should be %s or %s", r.Action, ActionRepeat, ActionDrop)})
+	}
+	if r.Priority != "" {
+		priority, ok := ParsePriority(r.Priority)
+		if !ok {
+			errs = append(errs, FieldError{"priority", fmt.Sprintf("invalid priority %q, should be low, normal or high", r.Priority)})
+		}
+		c.priority = priority
+	}
+	switch r.Match.Modulation {
+	case "":
+	case "LORA":
+		c.modulation = wrapper.ModulationLoRa
+	case "FSK":
+		c.modulation = wrapper.ModulationFSK
+	default:
+		errs = append(errs, FieldError{"match.modulation", fmt.Sprintf("invalid modulation %q, should be LORA or FSK", r.Match.Modulation)})
+	}
+	for i, sf := range r.Match.SpreadingFactors {
+		if sf < 7 || sf > 12 {
+			errs = append(errs, FieldError{fmt.Sprintf("match.sf[%d]", i), fmt.Sprintf("%d is not a valid spreading factor, should be between 7 and 12", sf)})
+		}
+	}
+	for i, name := range r.Match.MTypes {
+		mType, ok := lorawan.ParseMType(name)
+		if !ok {
+			errs = append(errs, FieldError{fmt.Sprintf("match.mtype[%d]", i), fmt.Sprintf("unknown frame type %q", name)})
+		}
+		c.mTypes = append(c.mTypes, mType)
+	}
+	for i, s := range r.Match.DevAddrs {
+		prefix, err := parseDevAddrPrefix(s)
+		if err != nil {
+			errs = append(errs, FieldError{fmt.Sprintf("match.dev_addr[%d]", i), err.Error()})
+		}
+		c.devAddrs = append(c.devAddrs, prefix)
+	}
+	return c, errs
+}
+
+func (c *compiledRule) matches(pkt *wrapper.Packet, frame *lorawan.Frame) bool {
+	m := &c.Match
+	if c.modulation != 0 && pkt.Modulation != c.modulation {
+		return false
+	}
+	if len(m.Frequencies) > 0 && !containsUint32(m.Frequencies, pkt.Freq) {
+		return false
+	}
+	if len(m.SpreadingFactors) > 0 && !containsUint8(m.SpreadingFactors, pkt.SpreadingFactor()) {
+		return false
+	}
+	if !m.RSSI.contains(float64(pkt.RSSI)) || !m.SNR.contains(float64(pkt.SNR)) || !m.Size.contains(float64(pkt.Size)) {
+		return false
+	}
+
+	if len(c.mTypes) > 0 {
+		if frame == nil || !containsMType(c.mTypes, frame.MType) {
+			return false
+		}
+	}
+	if len(c.devAddrs) > 0 {
+		if frame == nil || !frame.MType.Data() || !c.matchesDevAddr(frame.DevAddr) {
+			return false
+		}
+	}
+	if len(m.FPorts) > 0 {
+		if frame == nil || frame.FPort == nil || !containsUint8(m.FPorts, *frame.FPort) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *compiledRule) matchesDevAddr(addr uint32) bool {
+	for _, prefix := range c.devAddrs {
+		if prefix.matches(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compiledRule) decision() Decision {
+	d := Decision{
+		Repeat: c.Action == ActionRepeat,
+		Reason: "rule " + c.name,
+	}
+	if d.Repeat {
+		d.Priority = c.priority
+		d.Tx = TxOverrides{RfPower: c.RfPower, InvertPol: c.InvertPol, Preamble: c.Preamble, Immediate: c.Immediate}
+	}
+	return d
+}
+
+// RuleSet is the rule-based Policy: packets already repeated are dropped, the others
+// get the action of the first rule they match, or the default action if none.
+type RuleSet struct {
+	rules         []*compiledRule
+	defaultRepeat bool
+}
+
+// NewRuleSet compiles the rules. defaultAction applies to the packets which match no
+// rule, repeat if empty.
+func NewRuleSet(rules []Rule, defaultAction string) (*RuleSet, error) {
+	rs := &RuleSet{defaultRepeat: true}
+	switch defaultAction {
+	case "", ActionRepeat:
+	case ActionDrop:
+		rs.defaultRepeat = false
+	default:
+		return nil, fmt.Errorf("Invalid default action %q, should be %s or %s", defaultAction, ActionRepeat, ActionDrop)
+	}
+	for i := range rules {
+		c, errs := rules[i].compile()
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("Invalid rule %d: %s: %s", i, errs[0].Field, errs[0].Message)
+		}
+		c.name = c.Name
+		if c.name == "" {
+			c.name = strconv.Itoa(i)
+		}
+		rs.rules = append(rs.rules, c)
+	}
+	return rs, nil
+}
+
+// Decide implements Policy
+func (rs *RuleSet) Decide(pkt wrapper.Packet, frame *lorawan.Frame, history History) Decision {
+	if history != nil && history.Repeated(pkt) {
+		return Decision{Reason: "duplicate"}
+	}
+	for _, rule := range rs.rules {
+		if rule.matches(&pkt, frame) {
+			return rule.decision()
+		}
+	}
+	return Decision{Repeat: rs.defaultRepeat, Reason: "default"}
+}
+
+func containsUint32(values []uint32, v uint32) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint8(values []uint8, v uint8) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMType(values []lorawan.MType, v lorawan.MType) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package policy
+
+import (
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"testing"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func loraPacket(t *testing.T, freq uint32, sf uint8) wrapper.Packet {
+	t.Helper()
+	pkt := wrapper.Packet{Freq: freq, RSSI: -90, SNR: 5, Size: 20, Status: wrapper.StatusCRCOK}
+	if err := pkt.SetLoRa(sf, 125000); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func dataFrame(devAddr uint32, fPort uint8) *lorawan.Frame {
+	return &lorawan.Frame{MType: lorawan.UnconfirmedDataUp, DevAddr: devAddr, FPort: &fPort}
+}
+
+func TestParseDevAddrPrefix(t *testing.T) {
+	tests := []struct {
+		s       string
+		prefix  devAddrPrefix
+		err     bool
+		matches []uint32
+		misses  []uint32
+	}{
+		{"01020304", devAddrPrefix{0x01020304, 32}, false, []uint32{0x01020304}, []uint32{0x01020305}},
+		{"26000000/7", devAddrPrefix{0x26000000, 7}, false, []uint32{0x26000000, 0x27ffffff}, []uint32{0x28000000, 0x25ffffff}},
+		{"12345678/0", devAddrPrefix{0x12345678, 0}, false, []uint32{0, 0xffffffff}, nil},
+		{"0102030", devAddrPrefix{}, true, nil, nil},
+		{"0102030G", devAddrPrefix{}, true, nil, nil},
+		{"01020304/33", devAddrPrefix{}, true, nil, nil},
+		{"01020304/", devAddrPrefix{}, true, nil, nil},
+	}
+	for _, test := range tests {
+		prefix, err := parseDevAddrPrefix(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.s, err)
+		}
+		if test.err {
+			continue
+		}
+		if prefix != test.prefix {
+			t.Errorf("%s: parsed as %+v, expected %+v", test.s, prefix, test.prefix)
+		}
+		for _, addr := range test.matches {
+			if !prefix.matches(addr) {
+				t.Errorf("%s doesn't match %08X", test.s, addr)
+			}
+		}
+		for _, addr := range test.misses {
+			if prefix.matches(addr) {
+				t.Errorf("%s matches %08X", test.s, addr)
+			}
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	join := &lorawan.Frame{MType: lorawan.JoinRequest}
+	tests := []struct {
+		name  string
+		match Match
+		pkt   wrapper.Packet
+		frame *lorawan.Frame
+		want  bool
+	}{
+		{"empty", Match{}, loraPacket(t, 922100000, 7), nil, true},
+		{"frequency", Match{Frequencies: []uint32{922100000, 922300000}}, loraPacket(t, 922300000, 7), nil, true},
+		{"other frequency", Match{Frequencies: []uint32{922100000}}, loraPacket(t, 922300000, 7), nil, false},
+		{"modulation", Match{Modulation: "LORA"}, loraPacket(t, 922100000, 7), nil, true},
+		{"other modulation", Match{Modulation: "FSK"}, loraPacket(t, 922100000, 7), nil, false},
+		{"spreading factor", Match{SpreadingFactors: []uint8{9, 10}}, loraPacket(t, 922100000, 10), nil, true},
+		{"other spreading factor", Match{SpreadingFactors: []uint8{9, 10}}, loraPacket(t, 922100000, 12), nil, false},
+		{"RSSI", Match{RSSI: &Range{Min: float(-100), Max: float(-90)}}, loraPacket(t, 922100000, 7), nil, true},
+		{"weaker RSSI", Match{RSSI: &Range{Min: float(-80)}}, loraPacket(t, 922100000, 7), nil, false},
+		{"SNR", Match{SNR: &Range{Max: float(5)}}, loraPacket(t, 922100000, 7), nil, true},
+		{"better SNR", Match{SNR: &Range{Max: float(0)}}, loraPacket(t, 922100000, 7), nil, false},
+		{"size", Match{Size: &Range{Min: float(20), Max: float(20)}}, loraPacket(t, 922100000, 7), nil, true},
+		{"larger", Match{Size: &Range{Max: float(10)}}, loraPacket(t, 922100000, 7), nil, false},
+		{"frame type", Match{MTypes: []string{"JoinRequest"}}, loraPacket(t, 922100000, 7), join, true},
+		{"other frame type", Match{MTypes: []string{"JoinRequest"}}, loraPacket(t, 922100000, 7), dataFrame(1, 1), false},
+		{"frame type, not LoRaWAN", Match{MTypes: []string{"JoinRequest"}}, loraPacket(t, 922100000, 7), nil, false},
+		{"DevAddr", Match{DevAddrs: []string{"01000000/8"}}, loraPacket(t, 922100000, 7), dataFrame(0x01020304, 1), true},
+		{"other DevAddr", Match{DevAddrs: []string{"01000000/8"}}, loraPacket(t, 922100000, 7), dataFrame(0x02020304, 1), false},
+		{"DevAddr, join", Match{DevAddrs: []string{"00000000/0"}}, loraPacket(t, 922100000, 7), join, false},
+		{"FPort", Match{FPorts: []uint8{1, 2}}, loraPacket(t, 922100000, 7), dataFrame(1, 2), true},
+		{"other FPort", Match{FPorts: []uint8{1, 2}}, loraPacket(t, 922100000, 7), dataFrame(1, 3), false},
+		{"FPort, join", Match{FPorts: []uint8{1, 2}}, loraPacket(t, 922100000, 7), join, false},
+		{
+			"every condition",
+			Match{Frequencies: []uint32{922100000}, SpreadingFactors: []uint8{7}, DevAddrs: []string{"00000001"}, FPorts: []uint8{1}},
+			loraPacket(t, 922100000, 7), dataFrame(1, 1), true,
+		},
+		{
+			"all but one condition",
+			Match{Frequencies: []uint32{922100000}, SpreadingFactors: []uint8{8}, DevAddrs: []string{"00000001"}, FPorts: []uint8{1}},
+			loraPacket(t, 922100000, 7), dataFrame(1, 1), false,
+		},
+	}
+	for _, test := range tests {
+		rule := Rule{Match: test.match, Action: ActionRepeat}
+		c, errs := rule.compile()
+		if len(errs) > 0 {
+			t.Fatalf("%s: %v", test.name, errs)
+		}
+		if got := c.matches(&test.pkt, test.frame); got != test.want {
+			t.Errorf("%s: matches %v, expected %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	rule := Rule{
+		Match:    Match{Modulation: "CSS", SpreadingFactors: []uint8{7, 13}, MTypes: []string{"Beacon"}, DevAddrs: []string{"01020304", "0102/8"}},
+		Action:   "forward",
+		Priority: "urgent",
+	}
+	fields := []string{"action", "priority", "match.modulation", "match.sf[1]", "match.mtype[0]", "match.dev_addr[1]"}
+	errs := rule.Validate()
+	if len(errs) != len(fields) {
+		t.Fatalf("Errors %+v, expected on %v", errs, fields)
+	}
+	for i, err := range errs {
+		if err.Field != fields[i] {
+			t.Errorf("Error on %s, expected %s", err.Field, fields[i])
+		}
+	}
+}
+
+// sameDecision compares decisions, and the values of their TX overrides
+func sameDecision(a, b Decision) bool {
+	if (a.Tx.RfPower == nil) != (b.Tx.RfPower == nil) || (a.Tx.RfPower != nil && *a.Tx.RfPower != *b.Tx.RfPower) {
+		return false
+	}
+	if (a.Tx.InvertPol == nil) != (b.Tx.InvertPol == nil) || (a.Tx.InvertPol != nil && *a.Tx.InvertPol != *b.Tx.InvertPol) {
+		return false
+	}
+	return a.Repeat == b.Repeat && a.Reason == b.Reason && a.Priority == b.Priority && a.Tx.Preamble == b.Tx.Preamble && a.Tx.Immediate == b.Tx.Immediate
+}
+
+// history reports the packets of a frequency as repeated
+type history uint32
+
+func (h history) Repeated(pkt wrapper.Packet) bool {
+	return pkt.Freq == uint32(h)
+}
+
+func TestRuleSet(t *testing.T) {
+	power := int8(20)
+	rules := []Rule{
+		{Name: "quiet", Match: Match{SpreadingFactors: []uint8{12}}, Action: ActionDrop, RfPower: &power},
+		{Match: Match{Frequencies: []uint32{922100000}}, Action: ActionRepeat, RfPower: &power, Priority: "high", Immediate: true},
+		{Name: "never", Match: Match{Frequencies: []uint32{922100000}}, Action: ActionDrop},
+	}
+	tests := []struct {
+		name          string
+		defaultAction string
+		pkt           wrapper.Packet
+		history       History
+		want          Decision
+	}{
+		{"first match", "", loraPacket(t, 922100000, 12), nil, Decision{Reason: "rule quiet"}},
+		{"second match", "", loraPacket(t, 922100000, 7), nil, Decision{Repeat: true, Reason: "rule 1", Priority: PriorityHigh, Tx: TxOverrides{RfPower: &power, Immediate: true}}},
+		{"default repeat", "", loraPacket(t, 922300000, 7), nil, Decision{Repeat: true, Reason: "default"}},
+		{"default drop", ActionDrop, loraPacket(t, 922300000, 7), nil, Decision{Reason: "default"}},
+		{"duplicate", "", loraPacket(t, 922100000, 7), history(922100000), Decision{Reason: "duplicate"}},
+	}
+	for _, test := range tests {
+		rs, err := NewRuleSet(rules, test.defaultAction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := rs.Decide(test.pkt, nil, test.history)
+		if !sameDecision(got, test.want) {
+			t.Errorf("%s: decided %+v, expected %+v", test.name, got, test.want)
+		}
+	}
+
+	if _, err := NewRuleSet(rules, "forward"); err == nil {
+		t.Error("Invalid default action accepted")
+	}
+	if _, err := NewRuleSet([]Rule{{Action: "forward"}}, ""); err == nil {
+		t.Error("Invalid rule accepted")
+	}
+}
@@ -0,0 +1,229 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"github.com/yuin/gopher-lua"
+	"os"
+	"sync"
+	"time"
+)
+
+// scriptFunction is the Lua function called for each packet
+const scriptFunction = "decide"
+
+// Script is a Policy written in Lua. The script defines a global function
+//
+//	decide(packet, frame)
+//
+// where packet is a table of the fields of the packet, and frame a table of the fields
+// of the LoRaWAN frame, or nil. It returns "repeat" or "drop", or a table with an
+// action field and optionally rf_power, invert_pol, preamble, immediate, priority and
+// reason, or nil to leave the decision to the fallback policy. The FRMPayload of data
+// frames is encrypted: only unencrypted application payloads can be inspected.
+//
+// Each call is interrupted past the time budget, the fallback policy then decides.
+type Script struct {
+	path     string
+	budget   time.Duration
+	fallback Policy
+
+	mutex sync.Mutex // a Lua state can't be used concurrently
+	state *lua.LState
+}
+
+// NewScript loads the script at path. Packets already repeated are dropped without
+// calling it.
+func NewScript(path string, budget time.Duration, fallback Policy) (*Script, error) {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+	// No access to the file system from the script, nor code loaded past the checks
+	// of the configuration
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		state.SetGlobal(name, lua.LNil)
+	}
+
+	if err := state.DoFile(path); err != nil {
+		state.Close()
+		return nil, err
+	}
+	if state.GetGlobal(scriptFunction).Type() != lua.LTFunction {
+		state.Close()
+		return nil, fmt.Errorf("%s: no %s function defined", path, scriptFunction)
+	}
+	return &Script{path: path, budget: budget, fallback: fallback, state: state}, nil
+}
+
+// Decide implements Policy
+func (s *Script) Decide(pkt wrapper.Packet, frame *lorawan.Frame, history History) Decision {
+	if history != nil && history.Repeated(pkt) {
+		return Decision{Reason: "duplicate"}
+	}
+
+	decision, ok, err := s.call(pkt, frame)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", s.path, err)
+	}
+	if !ok {
+		// The fallback must not drop the packet as a duplicate of itself
+		return s.fallback.Decide(pkt, frame, nil)
+	}
+	return decision
+}
+
+// Close releases the Lua state. The fallback policy decides the packets left.
+func (s *Script) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.state != nil {
+		s.state.Close()
+		s.state = nil
+	}
+	return nil
+}
+
+// call runs the script on the packet. It returns false if the script left the decision
+// to the fallback policy, or failed.
+func (s *Script) call(pkt wrapper.Packet, frame *lorawan.Frame) (Decision, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	L := s.state
+	if L == nil {
+		return Decision{}, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.budget)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	var luaFrame lua.LValue = lua.LNil
+	if frame != nil {
+		luaFrame = frameTable(L, frame)
+	}
+	err := L.CallByParam(lua.P{
+		Fn:      L.GetGlobal(scriptFunction),
+		NRet:    1,
+		Protect: true,
+	}, packetTable(L, &pkt), luaFrame)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Decision{}, false, fmt.Errorf("time budget of %v exceeded", s.budget)
+		}
+		return Decision{}, false, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return parseScriptDecision(ret)
+}
+
+func parseScriptDecision(ret lua.LValue) (Decision, bool, error) {
+	var decision Decision
+	var action lua.LValue
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return decision, false, nil
+	case lua.LString:
+		action = ret
+	case *lua.LTable:
+		action = ret.RawGetString("action")
+		if reason, ok := ret.RawGetString("reason").(lua.LString); ok {
+			decision.Reason = string(reason)
+		}
+		if v, ok := ret.RawGetString("rf_power").(lua.LNumber); ok {
+			power := int8(v)
+			decision.Tx.RfPower = &power
+		}
+		if v, ok := ret.RawGetString("invert_pol").(lua.LBool); ok {
+			invert := bool(v)
+			decision.Tx.InvertPol = &invert
+		}
+		if v, ok := ret.RawGetString("preamble").(lua.LNumber); ok {
+			decision.Tx.Preamble = uint16(v)
+		}
+		if v, ok := ret.RawGetString("immediate").(lua.LBool); ok {
+			decision.Tx.Immediate = bool(v)
+		}
+		if v, ok := ret.RawGetString("priority").(lua.LString); ok {
+			priority, valid := ParsePriority(string(v))
+			if !valid {
+				return Decision{}, false, fmt.Errorf("invalid priority %q, should be low, normal or high", string(v))
+			}
+			decision.Priority = priority
+		}
+	default:
+		return decision, false, errors.New("decide should return an action, a table or nil")
+	}
+
+	switch action.String() {
+	case ActionRepeat:
+		decision.Repeat = true
+	case ActionDrop:
+		decision.Priority = PriorityUnset
+		decision.Tx = TxOverrides{}
+	default:
+		return Decision{}, false, fmt.Errorf("invalid action %q, should be %s or %s", action.String(), ActionRepeat, ActionDrop)
+	}
+	if decision.Reason == "" {
+		decision.Reason = "script"
+	}
+	return decision, true, nil
+}
+
+func packetTable(L *lua.LState, pkt *wrapper.Packet) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("freq", lua.LNumber(pkt.Freq))
+	switch pkt.Modulation {
+	case wrapper.ModulationLoRa:
+		t.RawSetString("modulation", lua.LString("LORA"))
+		t.RawSetString("sf", lua.LNumber(pkt.SpreadingFactor()))
+	case wrapper.ModulationFSK:
+		t.RawSetString("modulation", lua.LString("FSK"))
+	}
+	t.RawSetString("datarate", lua.LNumber(pkt.Datarate))
+	t.RawSetString("rssi", lua.LNumber(pkt.RSSI))
+	t.RawSetString("snr", lua.LNumber(pkt.SNR))
+	t.RawSetString("crc_ok", lua.LBool(pkt.Status == wrapper.StatusCRCOK))
+	t.RawSetString("size", lua.LNumber(pkt.Size))
+	t.RawSetString("payload", lua.LString(pkt.Payload))
+	if pkt.Time != nil {
+		t.RawSetString("time", lua.LNumber(float64(pkt.Time.UnixNano())/1e9))
+	}
+	return t
+}
+
+func frameTable(L *lua.LState, frame *lorawan.Frame) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("mtype", lua.LString(frame.MType.String()))
+	switch {
+	case frame.MType.Data():
+		t.RawSetString("dev_addr", lua.LString(fmt.Sprintf("%08X", frame.DevAddr)))
+		t.RawSetString("fctrl", lua.LNumber(frame.FCtrl))
+		t.RawSetString("fcnt", lua.LNumber(frame.FCnt))
+		t.RawSetString("fopts", lua.LString(frame.FOpts))
+		if frame.FPort != nil {
+			t.RawSetString("fport", lua.LNumber(*frame.FPort))
+		}
+		t.RawSetString("frm_payload", lua.LString(frame.FRMPayload))
+	case frame.MType == lorawan.JoinRequest:
+		t.RawSetString("join_eui", lua.LString(fmt.Sprintf("%016X", frame.JoinEUI)))
+		t.RawSetString("dev_eui", lua.LString(fmt.Sprintf("%016X", frame.DevEUI)))
+		t.RawSetString("dev_nonce", lua.LNumber(frame.DevNonce))
+	}
+	return t
+}
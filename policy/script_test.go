@@ -0,0 +1,92 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, source string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.lua")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScriptDecisions(t *testing.T) {
+	// The fallback drops every packet, with its own reason
+	fallback, err := NewRuleSet(nil, ActionDrop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	power, invert := int8(14), true
+	tests := []struct {
+		name   string
+		decide string
+		want   Decision
+	}{
+		{"repeat", `return "repeat"`, Decision{Repeat: true, Reason: "script"}},
+		{"drop", `return "drop"`, Decision{Reason: "script"}},
+		{"fallback", `return nil`, Decision{Reason: "default"}},
+		{
+			"table",
+			`return {action = "repeat", rf_power = 14, invert_pol = true, preamble = 16, immediate = true, priority = "high", reason = "near"}`,
+			Decision{Repeat: true, Reason: "near", Priority: PriorityHigh, Tx: TxOverrides{RfPower: &power, InvertPol: &invert, Preamble: 16, Immediate: true}},
+		},
+		{"drop table", `return {action = "drop", priority = "high", preamble = 16}`, Decision{Reason: "script"}},
+		{"packet fields", `if packet.freq == 922100000 and packet.sf == 7 and packet.crc_ok then return "repeat" end`, Decision{Repeat: true, Reason: "script"}},
+		{"frame fields", `if frame.dev_addr == "01000000" and frame.fport == 3 then return "repeat" end`, Decision{Repeat: true, Reason: "script"}},
+		{"invalid action", `return "forward"`, Decision{Reason: "default"}},
+		{"invalid priority", `return {action = "repeat", priority = "urgent"}`, Decision{Reason: "default"}},
+		{"invalid return", `return 1`, Decision{Reason: "default"}},
+		{"error", `error("failed")`, Decision{Reason: "default"}},
+		{"time budget", `while true do end`, Decision{Reason: "default"}},
+		{"load", `return load("return 'repeat'")()`, Decision{Reason: "default"}},
+		{"loadstring", `return loadstring("return 'repeat'")()`, Decision{Reason: "default"}},
+	}
+	for _, test := range tests {
+		path := writeScript(t, "function decide(packet, frame)\n"+test.decide+"\nend\n")
+		script, err := NewScript(path, 50*time.Millisecond, fallback)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got := script.Decide(loraPacket(t, 922100000, 7), dataFrame(0x01000000, 3), nil)
+		script.Close()
+		if !sameDecision(got, test.want) {
+			t.Errorf("%s: decided %+v, expected %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	fallback, err := NewRuleSet(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewScript(writeScript(t, `function other() end`), time.Second, fallback); err == nil {
+		t.Error("Script without decide loaded")
+	}
+	if _, err := NewScript(writeScript(t, `function decide(`), time.Second, fallback); err == nil {
+		t.Error("Invalid script loaded")
+	}
+
+	script, err := NewScript(writeScript(t, `function decide(packet, frame) return "drop" end`), time.Second, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Duplicates are dropped without calling the script
+	pkt := loraPacket(t, 922100000, 7)
+	if d := script.Decide(pkt, nil, history(922100000)); d.Repeat || d.Reason != "duplicate" {
+		t.Errorf("Duplicate decided %+v", d)
+	}
+	// Once closed, the fallback decides
+	if err := script.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := script.Decide(pkt, nil, nil); !d.Repeat || d.Reason != "default" {
+		t.Errorf("Closed script decided %+v", d)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/policy"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+)
+
+// queuedRepeat is a packet the policy decided to repeat, or a downlink to relay,
+// waiting for its turn
+type queuedRepeat struct {
+	pkt      wrapper.Packet
+	frame    *lorawan.Frame // nil if not a LoRaWAN frame
+	decision policy.Decision
+	params   *wrapper.TxParams // set for relayed downlinks, whose emission is already scheduled
+	priority policy.Priority
+	rateKey  string // device whose rate limits the repeat consumed, see deviceKey, empty if none
+	fcnt     uint32 // full frame counter of a data uplink, recorded once emitted
+	verified bool   // the MIC of the data uplink is verified
+	forward  bool   // to forward in a ForwardUplinkReq frame of the TS011 relay
+	seq      uint64 // order of arrival
+}
+
+// txQueue holds the repeats waiting to be emitted, highest priority first and in order
+// of arrival within a priority. It is only used by broadcastRoutine, and small enough
+// for linear searches.
+type txQueue struct {
+	repeats []*queuedRepeat
+	size    int
+	seq     uint64
+}
+
+func newTxQueue(size int) *txQueue {
+	return &txQueue{repeats: make([]*queuedRepeat, 0, size), size: size}
+}
+
+func (q *txQueue) len() int {
+	return len(q.repeats)
+}
+
+// push queues the repeat. When the queue is full, the lowest priority repeat is shed to
+// make room, the most recent one among equals: it is either a queued repeat or the new
+// one, which is returned.
+func (q *txQueue) push(repeat *queuedRepeat) (shed *queuedRepeat) {
+	repeat.seq = q.seq
+	q.seq++
+	if len(q.repeats) < q.size {
+		q.repeats = append(q.repeats, repeat)
+		return nil
+	}
+
+	lowest := -1
+	for i, queued := range q.repeats {
+		if queued.priority < repeat.priority && (lowest < 0 || !q.before(i, lowest)) {
+			lowest = i
+		}
+	}
+	if lowest < 0 {
+		return repeat
+	}
+	shed = q.repeats[lowest]
+	q.repeats[lowest] = repeat
+	return shed
+}
+
+// pop removes and returns the next repeat to emit, nil if the queue is empty
+func (q *txQueue) pop() *queuedRepeat {
+	if len(q.repeats) == 0 {
+		return nil
+	}
+	next := 0
+	for i := range q.repeats {
+		if q.before(i, next) {
+			next = i
+		}
+	}
+	repeat := q.repeats[next]
+	q.repeats = append(q.repeats[:next], q.repeats[next+1:]...)
+	return repeat
+}
+
+// has tells whether a packet with the CRC is queued
+func (q *txQueue) has(crc uint16) bool {
+	for _, queued := range q.repeats {
+		if queued.pkt.CRC == crc {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFCnt tells whether a data uplink of the device with the frame counter is queued
+func (q *txQueue) hasFCnt(devAddr uint32, fcnt uint16) bool {
+	for _, queued := range q.repeats {
+		if frame := queued.frame; frame != nil && frame.MType.Data() && frame.MType.Uplink() && frame.DevAddr == devAddr && frame.FCnt == fcnt {
+			return true
+		}
+	}
+	return false
+}
+
+// before tells whether the repeat at i is to be emitted before the one at j
+func (q *txQueue) before(i, j int) bool {
+	a, b := q.repeats[i], q.repeats[j]
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.seq < b.seq
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/policy"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func queuedPacket(crc uint16, priority policy.Priority) *queuedRepeat {
+	return &queuedRepeat{pkt: testPacket(crc, time.Now()), priority: priority}
+}
+
+// popAll empties the queue, and returns the CRCs of the repeats in the order popped
+func popAll(q *txQueue) []uint16 {
+	var crcs []uint16
+	for repeat := q.pop(); repeat != nil; repeat = q.pop() {
+		crcs = append(crcs, repeat.pkt.CRC)
+	}
+	return crcs
+}
+
+func TestTxQueueOrder(t *testing.T) {
+	q := newTxQueue(8)
+	for _, repeat := range []*queuedRepeat{
+		queuedPacket(1, policy.PriorityLow),
+		queuedPacket(2, policy.PriorityNormal),
+		queuedPacket(3, policy.PriorityHigh),
+		queuedPacket(4, policy.PriorityLow),
+		queuedPacket(5, policy.PriorityHigh),
+		queuedPacket(6, policy.PriorityNormal),
+	} {
+		if shed := q.push(repeat); shed != nil {
+			t.Fatalf("CRC %04X shed", shed.pkt.CRC)
+		}
+	}
+	if !q.has(4) || q.has(7) {
+		t.Error("Queued CRCs not told apart")
+	}
+	// Highest priority first, in order of arrival within a priority
+	if crcs, expected := popAll(q), []uint16{3, 5, 2, 6, 1, 4}; !reflect.DeepEqual(crcs, expected) {
+		t.Errorf("Popped %v, expected %v", crcs, expected)
+	}
+	if q.len() != 0 || q.pop() != nil {
+		t.Error("Queue not empty")
+	}
+}
+
+func TestTxQueueShedding(t *testing.T) {
+	tests := []struct {
+		name     string
+		queued   []policy.Priority
+		pushed   policy.Priority
+		shed     uint16 // CRC of the repeat shed, the one pushed being 0
+		expected []uint16
+	}{
+		{"lowest", []policy.Priority{policy.PriorityNormal, policy.PriorityLow, policy.PriorityHigh}, policy.PriorityHigh, 2, []uint16{3, 0, 1}},
+		{"most recent lowest", []policy.Priority{policy.PriorityLow, policy.PriorityLow, policy.PriorityHigh}, policy.PriorityNormal, 2, []uint16{3, 0, 1}},
+		{"pushed lowest", []policy.Priority{policy.PriorityNormal, policy.PriorityNormal, policy.PriorityHigh}, policy.PriorityLow, 0, []uint16{3, 1, 2}},
+		{"pushed equal", []policy.Priority{policy.PriorityNormal, policy.PriorityNormal, policy.PriorityNormal}, policy.PriorityNormal, 0, []uint16{1, 2, 3}},
+	}
+	for _, test := range tests {
+		q := newTxQueue(len(test.queued))
+		for i, priority := range test.queued {
+			q.push(queuedPacket(uint16(i+1), priority))
+		}
+		shed := q.push(queuedPacket(0, test.pushed))
+		if shed == nil || shed.pkt.CRC != test.shed {
+			t.Errorf("%s: shed %+v, expected CRC %04X", test.name, shed, test.shed)
+		}
+		if crcs := popAll(q); !reflect.DeepEqual(crcs, test.expected) {
+			t.Errorf("%s: popped %v, expected %v", test.name, crcs, test.expected)
+		}
+	}
+}
+
+func TestTxQueueHasFCnt(t *testing.T) {
+	q := newTxQueue(4)
+	uplink := queuedPacket(1, policy.PriorityLow)
+	uplink.frame = &lorawan.Frame{MType: lorawan.UnconfirmedDataUp, DevAddr: 0x01020304, FCnt: 7}
+	downlink := queuedPacket(2, policy.PriorityHigh)
+	downlink.frame = &lorawan.Frame{MType: lorawan.UnconfirmedDataDown, DevAddr: 0x01020304, FCnt: 8}
+	downlink.params = &wrapper.TxParams{}
+	q.push(uplink)
+	q.push(downlink)
+	q.push(queuedPacket(3, policy.PriorityNormal))
+
+	tests := []struct {
+		devAddr uint32
+		fcnt    uint16
+		queued  bool
+	}{
+		{0x01020304, 7, true},
+		{0x01020304, 8, false}, // downlinks don't count
+		{0x01020305, 7, false},
+	}
+	for _, test := range tests {
+		if queued := q.hasFCnt(test.devAddr, test.fcnt); queued != test.queued {
+			t.Errorf("FCnt %d of %08X queued %v, expected %v", test.fcnt, test.devAddr, queued, test.queued)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/store"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// bucketSweepInterval is how often the buckets of the devices which stopped sending
+// are forgotten
+const bucketSweepInterval = time.Minute
+
+// globalBucketKey is the key of the global bucket in the store, device keys are
+// described by deviceKey
+const globalBucketKey = "global"
+
+// tokenBucketConf is a token bucket: up to Burst repeats in a row, then one every
+// Refill milliseconds
+type tokenBucketConf struct {
+	Burst  int `json:"burst"`
+	Refill int `json:"refill_ms"` // time to regain one repeat, in milliseconds
+}
+
+func (c *tokenBucketConf) validate(prefix string) wrapper.ConfigErrors {
+	var errs wrapper.ConfigErrors
+	if c.Burst <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".burst", Message: fmt.Sprintf("%d is not a valid burst", c.Burst)})
+	}
+	if c.Refill <= 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".refill_ms", Message: fmt.Sprintf("%d ms is not a valid refill interval", c.Refill)})
+	}
+	return errs
+}
+
+// rateLimitConf limits the repeats of each device, and of all of them. Missing limits
+// aren't enforced.
+type rateLimitConf struct {
+	Device *tokenBucketConf `json:"device,omitempty"`
+	Global *tokenBucketConf `json:"global,omitempty"`
+}
+
+func (c *rateLimitConf) validate(prefix string) wrapper.ConfigErrors {
+	var errs wrapper.ConfigErrors
+	if c.Device != nil {
+		errs = append(errs, c.Device.validate(prefix+".device")...)
+	}
+	if c.Global != nil {
+		errs = append(errs, c.Global.validate(prefix+".global")...)
+	}
+	return errs
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was last refilled
+}
+
+// refill adds the tokens regained since the last refill, and tells whether the bucket
+// is full
+func (b *tokenBucket) refill(conf *tokenBucketConf, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(conf.Burst)
+	} else {
+		b.tokens += float64(now.Sub(b.last)) / float64(time.Duration(conf.Refill)*time.Millisecond)
+	}
+	b.last = now
+	if b.tokens >= float64(conf.Burst) {
+		b.tokens = float64(conf.Burst)
+		return true
+	}
+	return false
+}
+
+// rateLimiter enforces the rate limits on the repeats
+type rateLimiter struct {
+	mutex     sync.Mutex
+	conf      rateLimitConf
+	global    tokenBucket
+	devices   map[string]*tokenBucket
+	throttled deviceCounts // repeats denied per device
+	lastSweep time.Time
+	store     *store.Store // where the buckets are saved, if not nil
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{devices: make(map[string]*tokenBucket)}
+}
+
+// load restores the buckets saved in st, where they are next saved. A restart doesn't
+// grant a full burst to the devices which just used theirs.
+func (l *rateLimiter) load(st *store.Store) error {
+	limits, err := st.Limits()
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, limit := range limits {
+		bucket := &tokenBucket{tokens: limit.Tokens, last: limit.Last}
+		if key == globalBucketKey {
+			l.global = *bucket
+		} else {
+			l.devices[key] = bucket
+		}
+	}
+	l.store = st
+	return nil
+}
+
+// save records the state of a bucket, or forgets it if nil
+func (l *rateLimiter) save(key string, bucket *tokenBucket) {
+	if l.store == nil {
+		return
+	}
+	if bucket == nil {
+		l.store.PutLimit(key, nil)
+		return
+	}
+	l.store.PutLimit(key, &store.Limit{Tokens: bucket.tokens, Last: bucket.last})
+}
+
+// setConf changes the limits, keeping the current state of the buckets
+func (l *rateLimiter) setConf(conf *rateLimitConf) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.conf = rateLimitConf{}
+	if conf != nil {
+		l.conf = *conf
+	}
+}
+
+// deviceKey identifies the device which sent the packet: its DevAddr or DevEUI, or a
+// hash of the payload for packets which aren't LoRaWAN frames
+func deviceKey(pkt *wrapper.Packet, frame *lorawan.Frame) string {
+	switch {
+	case frame != nil && frame.MType.Data():
+		return fmt.Sprintf("DevAddr %08X", frame.DevAddr)
+	case frame != nil && frame.MType == lorawan.JoinRequest:
+		return fmt.Sprintf("DevEUI %016X", frame.DevEUI)
+	}
+	h := fnv.New64a()
+	h.Write(pkt.Payload)
+	return fmt.Sprintf("payload %016x", h.Sum64())
+}
+
+// allow tells whether a packet of the device can be repeated, and consumes a repeat
+// from the buckets if so. A repeat needs both the device and the global bucket. key
+// identifies the device, see deviceKey.
+func (l *rateLimiter) allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conf.Device == nil && l.conf.Global == nil {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= bucketSweepInterval {
+		l.sweep(now)
+	}
+
+	var device *tokenBucket
+	if l.conf.Device != nil {
+		if device = l.devices[key]; device == nil {
+			device = &tokenBucket{}
+			l.devices[key] = device
+		}
+		device.refill(l.conf.Device, now)
+	}
+	if l.conf.Global != nil {
+		l.global.refill(l.conf.Global, now)
+	}
+
+	if (device != nil && device.tokens < 1) || (l.conf.Global != nil && l.global.tokens < 1) {
+		l.throttled.add(key)
+		return false
+	}
+	if device != nil {
+		device.tokens--
+		l.save(key, device)
+	}
+	if l.conf.Global != nil {
+		l.global.tokens--
+		l.save(globalBucketKey, &l.global)
+	}
+	return true
+}
+
+// refund gives back the repeat allow consumed for the device, when the repeat isn't
+// emitted after all. The empty key is the one of the repeats allow wasn't asked for,
+// e.g. relayed downlinks, which have nothing to give back.
+func (l *rateLimiter) refund(key string) {
+	if key == "" {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if device := l.devices[key]; device != nil && l.conf.Device != nil {
+		device.tokens = math.Min(device.tokens+1, float64(l.conf.Device.Burst))
+		l.save(key, device)
+	}
+	if l.conf.Global != nil && !l.global.last.IsZero() {
+		l.global.tokens = math.Min(l.global.tokens+1, float64(l.conf.Global.Burst))
+		l.save(globalBucketKey, &l.global)
+	}
+}
+
+// sweep forgets the buckets which are full again, as if their device never sent
+func (l *rateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, bucket := range l.devices {
+		if l.conf.Device == nil || bucket.refill(l.conf.Device, now) {
+			delete(l.devices, key)
+			l.save(key, nil)
+		}
+	}
+}
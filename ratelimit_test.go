@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRateLimiterRefund(t *testing.T) {
+	limiter := newRateLimiter()
+	limiter.setConf(&rateLimitConf{
+		Device: &tokenBucketConf{Burst: 2, Refill: 3600000},
+		Global: &tokenBucketConf{Burst: 3, Refill: 3600000},
+	})
+
+	if !limiter.allow("DevAddr 00000001") || !limiter.allow("DevAddr 00000001") {
+		t.Fatal("Burst denied")
+	}
+	if limiter.allow("DevAddr 00000001") {
+		t.Fatal("Repeat allowed beyond the burst")
+	}
+
+	// A repeat given up gives its token back, to the device and globally
+	limiter.refund("DevAddr 00000001")
+	if !limiter.allow("DevAddr 00000001") {
+		t.Fatal("Refunded repeat denied")
+	}
+	if !limiter.allow("DevAddr 00000002") {
+		t.Fatal("Global bucket not refunded")
+	}
+	if limiter.allow("DevAddr 00000003") {
+		t.Fatal("Repeat allowed beyond the global burst")
+	}
+
+	// Refunds never fill the buckets beyond their burst
+	for i := 0; i < 10; i++ {
+		limiter.refund("DevAddr 00000002")
+	}
+	allowed := 0
+	for limiter.allow("DevAddr 00000002") {
+		allowed++
+	}
+	if allowed != 2 {
+		t.Errorf("%d repeats allowed after the refunds, expected 2", allowed)
+	}
+
+	throttled, more := limiter.throttled.take()
+	if len(throttled) != 3 || more != 0 {
+		t.Fatalf("Throttled %v and %d more", throttled, more)
+	}
+	stat := gwmpStat(counters{}, 0, throttled, nil, nil)
+	devices := stat.Repeater.(repeaterStat).ThrottledDevices
+	if devices["DevAddr 00000001"] != 1 || devices["DevAddr 00000002"] != 1 || devices["DevAddr 00000003"] != 1 {
+		t.Errorf("Throttled devices reported %v", devices)
+	}
+}
+
+func TestRateLimiterRefundUnlimited(t *testing.T) {
+	limiter := newRateLimiter()
+	limiter.setConf(&rateLimitConf{Global: &tokenBucketConf{Burst: 1, Refill: 3600000}})
+	if !limiter.allow("DevAddr 00000001") {
+		t.Fatal("Burst denied")
+	}
+
+	// Relayed downlinks consume no token, so give none back when not emitted
+	limiter.refund("")
+	if limiter.allow("DevAddr 00000002") {
+		t.Error("Repeat allowed beyond the global burst after a downlink refund")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"strings"
+	"time"
+)
+
+// relayLead is how long before a receive window a relayed downlink must be handed to
+// the concentrator
+const relayLead = 50 * time.Millisecond
+
+// downlinkRelayConf enables the relay of the downlinks answering the repeated uplinks,
+// into the RX1 or RX2 window of their device
+//
+// The network emits a downlink in a receive window of the repeat, on the channel the
+// regional parameters derive from the repeat, i.e. from the uplink. The windows of the
+// repeat open later than those of the device: the downlink goes into the first window
+// of the device still far enough ahead, which is usually RX2, as RX1 opens before the
+// network answers. The concentrator only demodulates packets with uplink polarity, and
+// networks invert the IQ of their downlinks: the relay requires the gateway serving
+// the repeater to emit them without inversion, on a channel the concentrator listens
+// to, which uninverted_downlinks confirms.
+type downlinkRelayConf struct {
+	Region       string `json:"region,omitempty"`        // regional parameters, e.g. EU868, for the RX1 window
+	RX1Delay     int    `json:"rx1_delay_s,omitempty"`   // RX1 delay of the devices, in seconds, 1 if 0
+	RX1DROffset  int    `json:"rx1_dr_offset,omitempty"` // RX1 data rate offset of the devices
+	RX2Freq      uint32 `json:"rx2_freq,omitempty"`      // in Hz, the regional default if 0
+	RX2SF        uint8  `json:"rx2_sf,omitempty"`        // spreading factor
+	RX2Bandwidth uint32 `json:"rx2_bandwidth,omitempty"` // in Hz
+	Uninverted   bool   `json:"uninverted_downlinks"`    // the network emits the downlinks to the repeat without IQ inversion
+}
+
+func (c *downlinkRelayConf) validate(prefix string) wrapper.ConfigErrors {
+	var errs wrapper.ConfigErrors
+	if !c.Uninverted {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".uninverted_downlinks", Message: "the concentrator can't receive downlinks with inverted IQ, the network must emit them without inversion"})
+	}
+	region, ok := lorawan.RegionByName(c.Region)
+	switch {
+	case c.Region != "" && !ok:
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".region", Message: fmt.Sprintf("unknown region %q, should be one of %s", c.Region, strings.Join(lorawan.RegionNames(), ", "))})
+	case ok && (c.RX1DROffset < 0 || c.RX1DROffset > region.MaxRX1DROffset):
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".rx1_dr_offset", Message: fmt.Sprintf("%d is not a valid offset in %s, should be between 0 and %d", c.RX1DROffset, region.Name, region.MaxRX1DROffset)})
+	case !ok && c.RX1DROffset != 0:
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".rx1_dr_offset", Message: "requires region"})
+	}
+	if c.RX1Delay < 0 || c.RX1Delay > 15 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".rx1_delay_s", Message: fmt.Sprintf("%d s is not a valid delay, should be between 1 and 15", c.RX1Delay)})
+	}
+
+	// Without a region, the RX2 window must be given
+	if c.RX2Freq == 0 && c.RX2SF == 0 && c.RX2Bandwidth == 0 && ok {
+		return errs
+	}
+	if c.RX2Freq == 0 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".rx2_freq", Message: "missing"})
+	}
+	if c.RX2SF < 7 || c.RX2SF > 12 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".rx2_sf", Message: fmt.Sprintf("%d is not a valid spreading factor, should be between 7 and 12", c.RX2SF)})
+	}
+	switch c.RX2Bandwidth {
+	case 125000, 250000, 500000:
+	default:
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".rx2_bandwidth", Message: fmt.Sprintf("%d Hz is not a valid bandwidth, should be 125000, 250000 or 500000", c.RX2Bandwidth)})
+	}
+	return errs
+}
+
+// region returns the regional parameters, nil if none are set
+func (c *downlinkRelayConf) region() *lorawan.Region {
+	region, _ := lorawan.RegionByName(c.Region)
+	return region
+}
+
+// rx2 returns the RX2 window channel of the devices
+func (c *downlinkRelayConf) rx2() lorawan.Channel {
+	if c.RX2Freq == 0 {
+		return c.region().RX2
+	}
+	return lorawan.Channel{Freq: c.RX2Freq, DataRate: lorawan.DataRate{SF: c.RX2SF, Bandwidth: c.RX2Bandwidth}}
+}
+
+// rxWindow is a receive window of a device
+type rxWindow struct {
+	name    string
+	delay   time.Duration // after the end of the uplink
+	channel lorawan.Channel
+}
+
+// windows returns the receive windows of the device which sent the uplink, in order.
+// The RX1 window is missing without regional parameters, or if the uplink channel
+// isn't one of the region.
+func (c *downlinkRelayConf) windows(pkt *wrapper.Packet, join bool) []rxWindow {
+	rx1Delay := time.Duration(c.RX1Delay) * time.Second
+	if rx1Delay == 0 {
+		rx1Delay = lorawan.ReceiveDelay1
+	}
+	offset := c.RX1DROffset
+	if join {
+		// Devices only get their delay and offset in the join accept
+		rx1Delay, offset = lorawan.JoinAcceptDelay1, 0
+	}
+	rx2 := rxWindow{"RX2", rx1Delay + time.Second, c.rx2()}
+
+	region := c.region()
+	if region == nil {
+		return []rxWindow{rx2}
+	}
+	up := lorawan.Channel{Freq: pkt.Freq, DataRate: lorawan.DataRate{SF: pkt.SpreadingFactor(), Bandwidth: pkt.BandwidthHz()}}
+	rx1, err := region.RX1(up, offset)
+	if err != nil {
+		return []rxWindow{rx2}
+	}
+	return []rxWindow{{"RX1", rx1Delay, rx1}, rx2}
+}
+
+// repeatedUplink is a repeated uplink, whose device may expect a downlink
+type repeatedUplink struct {
+	join       bool   // join request, answered by a join accept
+	devAddr    uint32 // of data uplinks
+	countUS    uint32 // concentrator counter at the end of the reception
+	receivedAt time.Time
+	windows    []rxWindow // receive windows of the device, in order
+}
+
+// downlinkRelay remembers the repeated uplinks until their last receive window, to
+// relay the downlinks answering them. It is only used by broadcastRoutine.
+type downlinkRelay struct {
+	uplinks []repeatedUplink // in order of reception
+}
+
+// remember records a repeated join request or data uplink
+func (d *downlinkRelay) remember(pkt *wrapper.Packet, frame *lorawan.Frame, conf *downlinkRelayConf) {
+	if frame == nil || !frame.MType.Uplink() || (frame.MType != lorawan.JoinRequest && !frame.MType.Data()) {
+		return
+	}
+	d.expire(time.Now())
+	join := frame.MType == lorawan.JoinRequest
+	d.uplinks = append(d.uplinks, repeatedUplink{
+		join:       join,
+		devAddr:    frame.DevAddr,
+		countUS:    pkt.CountUS,
+		receivedAt: pkt.ReceivedAt,
+		windows:    conf.windows(pkt, join),
+	})
+}
+
+// expire forgets the uplinks whose last window is over
+func (d *downlinkRelay) expire(now time.Time) {
+	kept := d.uplinks[:0]
+	for _, uplink := range d.uplinks {
+		last := uplink.windows[len(uplink.windows)-1]
+		if now.Sub(uplink.receivedAt) < last.delay+time.Second {
+			kept = append(kept, uplink)
+		}
+	}
+	d.uplinks = kept
+}
+
+// match returns the uplink the downlink answers, and forgets it: the last data uplink
+// of the device, or for a join accept, whose content is encrypted, the last join
+// request. The downlink must be heard on a window channel of the uplink.
+func (d *downlinkRelay) match(pkt *wrapper.Packet, frame *lorawan.Frame) (repeatedUplink, bool) {
+	d.expire(time.Now())
+	heard := lorawan.Channel{Freq: pkt.Freq, DataRate: lorawan.DataRate{SF: pkt.SpreadingFactor(), Bandwidth: pkt.BandwidthHz()}}
+	for i := len(d.uplinks) - 1; i >= 0; i-- {
+		uplink := d.uplinks[i]
+		if frame.MType == lorawan.JoinAccept && !uplink.join {
+			continue
+		}
+		if frame.MType != lorawan.JoinAccept && (uplink.join || uplink.devAddr != frame.DevAddr) {
+			continue
+		}
+		if !uplink.heardIn(heard) {
+			continue
+		}
+		d.uplinks = append(d.uplinks[:i], d.uplinks[i+1:]...)
+		return uplink, true
+	}
+	return repeatedUplink{}, false
+}
+
+// heardIn tells whether a downlink heard on the channel may answer the uplink. Without
+// regional parameters, the channel of the RX1 window is unknown and any is accepted.
+func (u *repeatedUplink) heardIn(heard lorawan.Channel) bool {
+	if len(u.windows) == 1 {
+		return true
+	}
+	for _, window := range u.windows {
+		if window.channel == heard {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule prepares the downlink for the first receive window of the device which
+// sent the uplink still far enough ahead. It fails if all are too close.
+func (c *downlinkRelayConf) schedule(pkt *wrapper.Packet, uplink repeatedUplink, rfPower int8) (wrapper.TxParams, error) {
+	// Concentrator counter now, from the reception of the downlink
+	now := pkt.CountUS + uint32(time.Since(pkt.ReceivedAt)/time.Microsecond)
+	var ahead time.Duration
+	for _, window := range uplink.windows {
+		countUS := uplink.countUS + uint32(window.delay/time.Microsecond)
+		ahead = time.Duration(int32(countUS-now)) * time.Microsecond
+		if ahead < relayLead {
+			continue
+		}
+
+		if err := pkt.SetLoRa(window.channel.SF, window.channel.Bandwidth); err != nil {
+			return wrapper.TxParams{}, err
+		}
+		pkt.Freq = window.channel.Freq
+		// Downlinks have no payload CRC, and inverted IQ so that only devices hear them
+		pkt.NoCRC = true
+		return wrapper.TxParams{
+			RfPower:   rfPower,
+			Mode:      wrapper.TxTimestamped,
+			CountUS:   countUS,
+			InvertPol: true,
+		}, nil
+	}
+	last := uplink.windows[len(uplink.windows)-1]
+	return wrapper.TxParams{}, fmt.Errorf("%s window in %v, too close", last.name, ahead)
+}
+
+// unheardWindows returns the window channels of the uplinks received by the
+// concentrator which it doesn't listen to itself: the downlinks emitted there are
+// missed. In US915 and AU915, RX1 and RX2 are on downlink channels, which the
+// concentrator must listen to besides the uplink channels.
+func (c *downlinkRelayConf) unheardWindows(sx *wrapper.SX1301Conf) []lorawan.Channel {
+	if c.region() == nil {
+		// The RX1 windows are unknown, and the downlinks heard on any channel
+		return nil
+	}
+	var uplinks []lorawan.Channel
+	for _, channel := range sx.MultiSFChannels() {
+		if channel == nil || !channel.Enabled {
+			continue
+		}
+		if freq, ok := sx.ChannelFreq(channel); ok {
+			for sf := uint8(7); sf <= 12; sf++ {
+				uplinks = append(uplinks, lorawan.Channel{Freq: freq, DataRate: lorawan.DataRate{SF: sf, Bandwidth: 125000}})
+			}
+		}
+	}
+	if std := sx.LoraSTDChannel; std != nil && std.Enabled && std.Bandwidth != nil && std.Datarate != nil {
+		if freq, ok := sx.ChannelFreq(std); ok {
+			uplinks = append(uplinks, lorawan.Channel{Freq: freq, DataRate: lorawan.DataRate{SF: uint8(*std.Datarate), Bandwidth: *std.Bandwidth}})
+		}
+	}
+
+	var unheard []lorawan.Channel
+	seen := make(map[lorawan.Channel]bool)
+	for _, uplink := range uplinks {
+		pkt := wrapper.Packet{Freq: uplink.Freq}
+		if err := pkt.SetLoRa(uplink.SF, uplink.Bandwidth); err != nil {
+			continue
+		}
+		for _, window := range c.windows(&pkt, false) {
+			heard := false
+			for _, channel := range uplinks {
+				heard = heard || channel == window.channel
+			}
+			if !heard && !seen[window.channel] {
+				seen[window.channel] = true
+				unheard = append(unheard, window.channel)
+			}
+		}
+	}
+	return unheard
+}
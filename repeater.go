@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/policy"
+	"github.com/NaNkeen/packet_repeater/store"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// crcStackTimeout is how often the CRCs of the repeated packets are forgotten
+const crcStackTimeout = 5 * time.Second
+
+// gpsSlotLead is how long before its slot a repeat must be handed to the concentrator
+const gpsSlotLead = 100 * time.Millisecond
+
+// repeater holds the state shared by the routines, kept when they are restarted
+type repeater struct {
+	confLock sync.RWMutex
+	conf     repeaterConf
+	policy   policy.Policy
+	limiter  *rateLimiter
+	store    *store.Store // nil without state file
+	fcnts    *fcntTracker
+
+	micFailures deviceCounts // data uplinks refused for their MIC, per DevAddr
+	relay       downlinkRelay
+	ts011       ts011Relay
+
+	dutyCycle dutyCycle
+	crc_stack []uint16  // CRCs of the packets repeated
+	crc_reset time.Time // when crc_stack is next cleared
+
+	stats counters
+}
+
+func newRepeater(conf repeaterConf) (*repeater, error) {
+	r := &repeater{
+		crc_stack: make([]uint16, 0, 16),
+		limiter:   newRateLimiter(),
+		fcnts:     newFCntTracker(),
+	}
+	return r, r.setConf(conf)
+}
+
+// resume restores the state saved in st, where the next changes are saved
+func (r *repeater) resume(st *store.Store) error {
+	crcs, reset, err := st.Repeats(time.Now())
+	if err != nil {
+		return err
+	}
+	r.crc_stack = append(r.crc_stack, crcs...)
+	r.crc_reset = reset
+	r.store = st
+	r.fcnts.store = st
+	if err := r.ts011.load(st); err != nil {
+		return err
+	}
+	if err := r.limiter.load(st); err != nil {
+		return err
+	}
+	return r.dutyCycle.load(st)
+}
+
+// setConf applies a new repeater configuration to the running routines
+func (r *repeater) setConf(conf repeaterConf) error {
+	p, err := conf.policy()
+	if err != nil {
+		return err
+	}
+	r.confLock.Lock()
+	r.conf = conf
+	old := r.policy
+	r.policy = p
+	r.confLock.Unlock()
+	// A policy running a script holds its interpreter until closed
+	if closer, ok := old.(io.Closer); ok {
+		closer.Close()
+	}
+	r.limiter.setConf(conf.RateLimit)
+	r.dutyCycle.setConf(conf.DutyCycle)
+	return nil
+}
+
+func (r *repeater) getConf() (repeaterConf, policy.Policy) {
+	r.confLock.RLock()
+	defer r.confLock.RUnlock()
+	return r.conf, r.policy
+}
+
+// Repeated implements policy.History: packets are identified by their CRC, which is
+// remembered from when they are emitted for up to crcStackTimeout
+func (r *repeater) Repeated(pkt wrapper.Packet) bool {
+	r.expireRepeats()
+	for _, crc := range r.crc_stack {
+		if pkt.CRC == crc {
+			return true
+		}
+	}
+	return false
+}
+
+// expireRepeats forgets the CRCs of the repeats, every crcStackTimeout
+func (r *repeater) expireRepeats() {
+	if now := time.Now(); now.After(r.crc_reset) {
+		r.crc_stack = r.crc_stack[:0]
+		r.crc_reset = now.Add(crcStackTimeout)
+	}
+}
+
+// addRepeat remembers the CRC of a packet once repeated
+func (r *repeater) addRepeat(crc uint16) {
+	r.expireRepeats()
+	r.crc_stack = append(r.crc_stack, crc)
+	if r.store != nil {
+		r.store.AddRepeat(crc, r.crc_reset)
+	}
+}
+
+// recordFCnt records the frame counter of the repeat of a data uplink, once emitted
+func (r *repeater) recordFCnt(repeat *queuedRepeat) {
+	frame := repeat.frame
+	if frame == nil || !frame.MType.Data() || !frame.MType.Uplink() {
+		return
+	}
+	if repeat.verified {
+		r.fcnts.update(frame.DevAddr, repeat.fcnt, time.Now())
+	} else {
+		r.fcnts.updateUnverified(frame.DevAddr, frame.FCnt, time.Now())
+	}
+}
+
+// queueHistory is the policy.History of the packets received: those repeated, and
+// those still queued for repetition
+type queueHistory struct {
+	*repeater
+	queue *txQueue
+}
+
+func (h queueHistory) Repeated(pkt wrapper.Packet) bool {
+	return h.repeater.Repeated(pkt) || h.queue.has(pkt.CRC)
+}
+
+// routines is a running set of uplink and broadcast routines
+type routines struct {
+	pktc            chan wrapper.Packet
+	cancelUplink    context.CancelFunc
+	cancelBroadcast context.CancelFunc
+	uplinkDone      chan struct{}
+	broadcastDone   chan struct{}
+	unsent          int // repeats left in the queue by broadcastRoutine, once done
+}
+
+// start spawns the uplink and broadcast routines. Errors are reported on errc.
+func (r *repeater) start(receive receiver, transmit transmitter, errc chan error) *routines {
+	uplinkCtx, cancelUplink := context.WithCancel(context.Background())
+	broadcastCtx, cancelBroadcast := context.WithCancel(context.Background())
+	conf, _ := r.getConf()
+	pktc := make(chan wrapper.Packet, conf.QueueSize)
+	rt := &routines{
+		pktc:            pktc,
+		cancelUplink:    cancelUplink,
+		cancelBroadcast: cancelBroadcast,
+		uplinkDone:      make(chan struct{}),
+		broadcastDone:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(rt.uplinkDone)
+		r.uplinkRoutine(uplinkCtx, errc, pktc, receive)
+	}()
+	go func() {
+		defer close(rt.broadcastDone)
+		rt.unsent = r.broadcastRoutine(broadcastCtx, errc, pktc, transmit)
+	}()
+	return rt
+}
+
+// stop stops receiving uplinks, then stops repeating once the current emission is
+// over, and waits for both routines to return. It returns how many received packets
+// and queued repeats were left unrepeated.
+func (rt *routines) stop() int {
+	rt.cancelUplink()
+	<-rt.uplinkDone
+	rt.cancelBroadcast()
+	<-rt.broadcastDone
+	return len(rt.pktc) + rt.unsent
+}
+
+// finish stops receiving uplinks, and lets the broadcast routine return once it has
+// emitted the repeats received so far. broadcastDone is closed then.
+func (rt *routines) finish() {
+	rt.cancelUplink()
+	<-rt.uplinkDone
+	close(rt.pktc)
+}
+
+// stopRoutines stops the routines, accounting the packets left in the queue as dropped
+func (r *repeater) stopRoutines(rt *routines) {
+	if dropped := rt.stop(); dropped > 0 {
+		atomic.AddUint64(&r.stats.dropped, uint64(dropped))
+		fmt.Fprintf(os.Stderr, "Dropped %d queued packets\n", dropped)
+	}
+}
+
+// enqueue passes a received packet through the filters, the policy and the rate
+// limits, and queues the repeat if it is decided
+func (r *repeater) enqueue(queue *txQueue, pkt wrapper.Packet) {
+	conf, p := r.getConf()
+	if !conf.accepts(pkt) {
+		return
+	}
+	frame, _ := lorawan.Decode(pkt.Payload)
+	now := time.Now()
+	if relay := conf.TS011Relay; relay != nil && frame != nil && frame.MType.Data() && frame.MType.Downlink() && frame.DevAddr == relay.devAddr() {
+		r.forwardDownlink(queue, pkt, frame, &conf)
+		return
+	}
+	if conf.DownlinkRelay != nil && frame != nil && frame.MType.Downlink() {
+		r.relayDownlink(queue, pkt, frame, &conf)
+		return
+	}
+
+	// Frame counters tell new frames from retransmissions and replays, which CRCs can't.
+	// Only the counters of devices whose MIC is verified tell replays, as forged frames
+	// would otherwise advance them and get the genuine ones refused.
+	dataUplink := frame != nil && frame.MType.Data() && frame.MType.Uplink()
+	var fcnt uint32
+	var verified bool
+	if dataUplink {
+		if keys, ok := conf.keys[frame.DevAddr]; ok {
+			full, last, verdict := r.fcnts.check(frame.DevAddr, frame.FCnt, conf.MaxFCntGap, crcStackTimeout, now)
+			switch {
+			case verdict == fcntRetransmission:
+				fmt.Printf("Not repeating (duplicate FCnt %d of %08X)\n", full, frame.DevAddr)
+				return
+			case verdict == fcntReplay && conf.ReplayProtect:
+				atomic.AddUint64(&r.stats.replays, 1)
+				fmt.Printf("Not repeating (replayed FCnt %d of %08X, last %d)\n", frame.FCnt, frame.DevAddr, *last)
+				return
+			}
+			for _, candidate := range fcntCandidates(full, last, frame.FCnt, !conf.ReplayProtect) {
+				if keys.VerifyUplink(pkt.Payload, frame.DevAddr, candidate) {
+					fcnt, verified = candidate, true
+					break
+				}
+			}
+			if !verified {
+				atomic.AddUint64(&r.stats.badMIC, 1)
+				r.micFailures.add(fmt.Sprintf("DevAddr %08X", frame.DevAddr))
+				fmt.Printf("Not repeating (invalid MIC): %s\n", frame)
+				return
+			}
+		} else if conf.KnownOnly {
+			fmt.Printf("Not repeating (unknown device): %s\n", frame)
+			return
+		} else if r.fcnts.retransmission(frame.DevAddr, frame.FCnt, crcStackTimeout, now) {
+			fmt.Printf("Not repeating (duplicate FCnt %d of %08X)\n", frame.FCnt, frame.DevAddr)
+			return
+		} else {
+			fcnt = uint32(frame.FCnt)
+		}
+		if queue.hasFCnt(frame.DevAddr, frame.FCnt) {
+			fmt.Printf("Not repeating (FCnt %d of %08X already queued)\n", frame.FCnt, frame.DevAddr)
+			return
+		}
+	}
+
+	// A TS011 relay only forwards uplinks, and the downlinks it is sent
+	if conf.TS011Relay != nil && (frame == nil || !frame.MType.Uplink()) {
+		fmt.Println("Not forwarding (not an uplink)")
+		return
+	}
+
+	decision := p.Decide(pkt, frame, queueHistory{r, queue})
+	if !decision.Repeat {
+		fmt.Printf("Not repeating (%s)\n", decision.Reason)
+		return
+	}
+	rateKey := deviceKey(&pkt, frame)
+	if !r.limiter.allow(rateKey) {
+		atomic.AddUint64(&r.stats.throttled, 1)
+		fmt.Printf("Not repeating (rate limited): %+v\n", pkt)
+		return
+	}
+	priority := decision.Priority
+	if priority == policy.PriorityUnset {
+		priority = policy.DefaultPriority(frame)
+	}
+	// Downlinks are heard with uplink polarity, devices only hear them inverted
+	if frame != nil && frame.MType.Downlink() && decision.Tx.InvertPol == nil {
+		invert := true
+		decision.Tx.InvertPol = &invert
+	}
+	// The join accept can only be relayed if the network answers the repeat early enough
+	if conf.DownlinkRelay != nil && frame != nil && frame.MType == lorawan.JoinRequest {
+		decision.Tx.Immediate = true
+	}
+	forward := conf.TS011Relay != nil
+	r.push(queue, &queuedRepeat{pkt: pkt, frame: frame, decision: decision, priority: priority, rateKey: rateKey, fcnt: fcnt, verified: verified, forward: forward})
+}
+
+// relayDownlink queues the downlink for the receive window of the device whose
+// repeated uplink it answers
+func (r *repeater) relayDownlink(queue *txQueue, pkt wrapper.Packet, frame *lorawan.Frame, conf *repeaterConf) {
+	uplink, ok := r.relay.match(&pkt, frame)
+	if !ok {
+		fmt.Printf("Not relaying (no uplink repeated for it): %s\n", frame)
+		return
+	}
+	params, err := conf.DownlinkRelay.schedule(&pkt, uplink, conf.RfPower)
+	if err != nil {
+		atomic.AddUint64(&r.stats.dropped, 1)
+		fmt.Printf("Not relaying (%v): %s\n", err, frame)
+		return
+	}
+	r.push(queue, &queuedRepeat{pkt: pkt, frame: frame, params: &params, priority: policy.PriorityHigh})
+}
+
+// forwardDownlink queues the downlink the network sent the TS011 relay to forward, for
+// the receive window of its device
+func (r *repeater) forwardDownlink(queue *txQueue, pkt wrapper.Packet, frame *lorawan.Frame, conf *repeaterConf) {
+	phy, err := r.ts011.open(frame, pkt.Payload, pkt.SNR, conf.TS011Relay)
+	if err != nil {
+		fmt.Printf("Not relaying (%v): %s\n", err, frame)
+		return
+	}
+	if phy == nil {
+		return
+	}
+	forwarded, err := lorawan.Decode(phy)
+	if err != nil || !forwarded.MType.Downlink() {
+		fmt.Printf("Not relaying (invalid ForwardDownlinkReq): %s\n", frame)
+		return
+	}
+	pkt.Payload = phy
+	pkt.Size = uint32(len(phy))
+	r.relayDownlink(queue, pkt, forwarded, conf)
+}
+
+func (r *repeater) push(queue *txQueue, repeat *queuedRepeat) {
+	if shed := queue.push(repeat); shed != nil {
+		r.limiter.refund(shed.rateKey)
+		atomic.AddUint64(&r.stats.shed, 1)
+		fmt.Printf("Not repeating (queue full, %s priority): %+v\n", shed.priority, shed.pkt)
+	}
+}
+
+// broadcastRoutine queues the received packets to repeat, and repeats them one at a
+// time, highest priority first. It returns how many repeats were left in the queue.
+func (r *repeater) broadcastRoutine(ctx context.Context, errc chan error, pktc chan wrapper.Packet, transmit transmitter) int {
+	fmt.Println("Waiting to repeat")
+	conf, _ := r.getConf()
+	queue := newTxQueue(conf.QueueSize)
+	var halErrors int
+	for {
+		if queue.len() == 0 {
+			if pktc == nil {
+				return 0
+			}
+			select {
+			case pkt, ok := <-pktc:
+				if !ok {
+					return 0
+				}
+				r.enqueue(queue, pkt)
+			case <-ctx.Done():
+				return 0
+			}
+		}
+		// Take in the packets received during the last emission, so that the next
+		// repeat is picked among all of them. Once pktc is closed, the routine returns
+		// when the queue is empty.
+		for drained := false; !drained; {
+			select {
+			case pkt, ok := <-pktc:
+				if !ok {
+					pktc = nil
+					continue
+				}
+				r.enqueue(queue, pkt)
+			case <-ctx.Done():
+				return queue.len()
+			default:
+				drained = true
+			}
+		}
+		repeat := queue.pop()
+		if repeat == nil {
+			continue
+		}
+
+		pkt := repeat.pkt
+		conf, _ := r.getConf()
+		// Relayed downlinks are scheduled in the window of their device instead
+		if age := time.Since(pkt.ReceivedAt); repeat.params == nil && age > time.Duration(conf.MaxQueueAge)*time.Millisecond {
+			r.limiter.refund(repeat.rateKey)
+			atomic.AddUint64(&r.stats.shed, 1)
+			fmt.Printf("Not repeating (queued for %v, %s priority): %+v\n", age.Round(time.Millisecond), repeat.priority, pkt)
+			continue
+		}
+		// The frame of the TS011 relay carries its state when emitted
+		var answers int
+		if repeat.forward {
+			var err error
+			if conf.TS011Relay == nil {
+				err = errors.New("TS011 relay disabled")
+			} else {
+				pkt, answers, err = r.ts011.forward(pkt, &conf)
+			}
+			if err != nil {
+				r.limiter.refund(repeat.rateKey)
+				atomic.AddUint64(&r.stats.dropped, 1)
+				fmt.Printf("Not forwarding (%v): %s\n", err, repeat.frame)
+				continue
+			}
+		}
+		var params wrapper.TxParams
+		var err error
+		if repeat.params != nil {
+			params = *repeat.params
+		} else {
+			params, err = txParams(pkt, &conf, repeat.decision.Tx)
+		}
+		if err != nil {
+			r.limiter.refund(repeat.rateKey)
+			atomic.AddUint64(&r.stats.dropped, 1)
+			fmt.Fprintln(os.Stderr, "Dropped packet:", err)
+			continue
+		}
+		airtime, airtimeErr := wrapper.TimeOnAir(pkt, params)
+		if airtimeErr == nil && !r.dutyCycle.allow(repeat.priority, airtime) {
+			r.limiter.refund(repeat.rateKey)
+			atomic.AddUint64(&r.stats.shed, 1)
+			fmt.Printf("Not repeating (duty cycle, %s priority): %+v\n", repeat.priority, pkt)
+			continue
+		}
+		if repeat.params != nil {
+			// A relayed downlink is due in its window, there's no retrying it later
+			err = transmit(pkt, params)
+		} else {
+			atomic.AddUint64(&r.stats.forwarded, 1)
+			err = r.transmitWithRetries(ctx, pkt, params, &conf, repeat.decision.Tx, transmit)
+		}
+		if err == nil {
+			halErrors = 0
+			if airtimeErr == nil {
+				r.stats.addAirtime(pkt.Modulation, airtime)
+				r.dutyCycle.add(airtime)
+			}
+			if repeat.params != nil {
+				atomic.AddUint64(&r.stats.relayed, 1)
+				fmt.Printf("Relayed downlink: %+v\n", pkt)
+				continue
+			}
+			atomic.AddUint64(&r.stats.repeated, 1)
+			r.addRepeat(pkt.CRC)
+			r.recordFCnt(repeat)
+			if repeat.forward {
+				r.ts011.sent(answers)
+			}
+			if conf.DownlinkRelay != nil {
+				r.relay.remember(&pkt, repeat.frame, conf.DownlinkRelay)
+			}
+			fmt.Printf("Repeated: %+v\n", pkt)
+			continue
+		}
+
+		// Not emitted, the rate limits don't account it
+		r.limiter.refund(repeat.rateKey)
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, wrapper.ErrLBT) {
+			atomic.AddUint64(&r.stats.dropped, 1)
+			continue
+		}
+		if !isHALError(err) {
+			continue
+		}
+		atomic.AddUint64(&r.stats.halErrors, 1)
+		if halErrors++; halErrors >= maxConsecutiveHALErrors {
+			select {
+			case errc <- err:
+			case <-ctx.Done():
+			}
+			return queue.len()
+		}
+	}
+}
+
+// txParams returns how to repeat the packet: with its own settings and those of the
+// repeater, unless the policy overrides them. With GPS slots, the repeat is scheduled
+// at the start of the next slot, which requires the packet to carry its GPS time.
+func txParams(pkt wrapper.Packet, conf *repeaterConf, tx policy.TxOverrides) (wrapper.TxParams, error) {
+	params := wrapper.TxParams{
+		RfPower:   conf.RfPower,
+		InvertPol: pkt.InvertPol,
+		Preamble:  tx.Preamble,
+	}
+	if tx.RfPower != nil {
+		params.RfPower = *tx.RfPower
+	}
+	if tx.InvertPol != nil {
+		params.InvertPol = *tx.InvertPol
+	}
+
+	slots := conf.GPSSlots
+	if slots == nil || tx.Immediate {
+		return params, nil
+	}
+	if pkt.GPSTime == nil {
+		return params, errors.New("No GPS time to schedule the repeat")
+	}
+	airtime, err := wrapper.TimeOnAir(pkt, params)
+	if err != nil {
+		return params, err
+	}
+	if airtime > time.Duration(slots.Length)*time.Millisecond {
+		return params, fmt.Errorf("Time on air of %v doesn't fit in a %d ms slot", airtime, slots.Length)
+	}
+
+	now := *pkt.GPSTime + time.Since(pkt.ReceivedAt)
+	params.Mode = wrapper.TxOnGPS
+	params.GPSTime = slots.next(now + gpsSlotLead)
+	return params, nil
+}
+
+// transmitWithRetries transmits the packet, retrying with an exponential backoff while
+// LBT finds the channel busy. Scheduled repeats are moved to a later slot on retry.
+func (r *repeater) transmitWithRetries(ctx context.Context, pkt wrapper.Packet, params wrapper.TxParams, conf *repeaterConf, tx policy.TxOverrides, transmit transmitter) error {
+	backoff := time.Duration(conf.LBTBackoff) * time.Millisecond
+	for retry := 0; ; retry++ {
+		err := transmit(pkt, params)
+		if !errors.Is(err, wrapper.ErrLBT) {
+			return err
+		}
+		atomic.AddUint64(&r.stats.lbtBusy, 1)
+		if retry >= conf.LBTRetries {
+			return err
+		}
+
+		// Random jitter, so that repeaters contending for the channel don't retry together
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+
+		if conf.GPSSlots != nil && !tx.Immediate {
+			if params, err = txParams(pkt, conf, tx); err != nil {
+				return err
+			}
+		}
+	}
+}
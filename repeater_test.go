@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/policy"
+	"github.com/NaNkeen/packet_repeater/store"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConf returns the default configuration of the repeater, without LBT retries
+func testConf() repeaterConf {
+	conf := defaultConf().Repeater
+	conf.LBTRetries = 0
+	return conf
+}
+
+// testRepeater runs broadcastRoutine with the configuration, the packets of pktc being
+// emitted through transmit
+func testRepeater(t *testing.T, conf repeaterConf, pktc chan wrapper.Packet, transmit transmitter) *repeater {
+	t.Helper()
+	r, err := newRepeater(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.broadcastRoutine(ctx, make(chan error, 1), pktc, transmit)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return r
+}
+
+func testPacket(crc uint16, receivedAt time.Time) wrapper.Packet {
+	return wrapper.Packet{Freq: 922100000, CRC: crc, Status: wrapper.StatusCRCOK, ReceivedAt: receivedAt}
+}
+
+func expectEmission(t *testing.T, emitted chan wrapper.Packet, crc uint16) {
+	t.Helper()
+	select {
+	case pkt := <-emitted:
+		if pkt.CRC != crc {
+			t.Fatalf("Emitted CRC %04X, expected %04X", pkt.CRC, crc)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("CRC %04X not emitted", crc)
+	}
+}
+
+func TestBroadcastShedsStaleRepeats(t *testing.T) {
+	pktc := make(chan wrapper.Packet, 2)
+	pktc <- testPacket(1, time.Now().Add(-3*time.Second))
+	pktc <- testPacket(2, time.Now())
+	emitted := make(chan wrapper.Packet, 2)
+	r := testRepeater(t, testConf(), pktc, func(pkt wrapper.Packet, params wrapper.TxParams) error {
+		emitted <- pkt
+		return nil
+	})
+
+	expectEmission(t, emitted, 2)
+	if shed := atomic.LoadUint64(&r.stats.shed); shed != 1 {
+		t.Errorf("%d repeats shed, expected 1", shed)
+	}
+}
+
+func TestBroadcastRemembersEmittedRepeats(t *testing.T) {
+	pktc := make(chan wrapper.Packet)
+	emitted := make(chan wrapper.Packet, 4)
+	var attempts int32
+	testRepeater(t, testConf(), pktc, func(pkt wrapper.Packet, params wrapper.TxParams) error {
+		// The first emission finds the channel busy
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return wrapper.ErrLBT
+		}
+		emitted <- pkt
+		return nil
+	})
+
+	// Not emitted, so the packet is repeated when heard again
+	pktc <- testPacket(1, time.Now())
+	pktc <- testPacket(1, time.Now())
+	expectEmission(t, emitted, 1)
+
+	// Emitted, so it isn't repeated again
+	pktc <- testPacket(1, time.Now())
+	pktc <- testPacket(2, time.Now())
+	expectEmission(t, emitted, 2)
+}
+
+// testUplink returns a data uplink of the device signed with the key, its CRC told
+// apart by crc
+func testUplink(key *lorawan.AES128Key, devAddr uint32, fcnt uint32, crc uint16) wrapper.Packet {
+	pkt := testPacket(crc, time.Now())
+	pkt.Payload = lorawan.EncodeUplink(key, devAddr, fcnt, false, nil, 1, []byte{byte(crc)})
+	return pkt
+}
+
+func TestBroadcastFCnt(t *testing.T) {
+	const devAddr = 0x49BE7DF1
+	key := &lorawan.AES128Key{1, 2, 3, 4}
+	forger := &lorawan.AES128Key{5, 6, 7, 8}
+	tests := []struct {
+		name    string
+		protect bool
+		last    uint32 // 0 if the device is unknown
+		fcnt    uint32
+		key     *lorawan.AES128Key
+		repeat  bool
+		tracked uint32 // frame counter of the device afterwards
+	}{
+		{"unknown", true, 0, 2, key, true, 2},
+		{"unknown rolled over", true, 0, 0x30002, key, true, 0x30002},
+		{"unknown forged", true, 0, 0x30002, forger, false, 0},
+		{"next", true, 0x10000, 0x10001, key, true, 0x10001},
+		{"rollover", true, 0x1fffe, 0x20003, key, true, 0x20003},
+		{"forged", true, 0x10000, 0x10001, forger, false, 0x10000},
+		{"forged ahead", false, 0x10000, 0x30000, forger, false, 0x10000},
+		{"replay", true, 0x10005, 0x10003, key, false, 0x10005},
+		{"older", false, 0x10005, 0x10003, key, true, 0x10003},
+		{"far ahead", false, 0x10000, 0x18000, key, true, 0x18000},
+		{"rolled over", false, 0x10000, 0x30000, key, true, 0x30000},
+		{"reset", false, 0x30000, 1, key, true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf := testConf()
+			conf.ReplayProtect = test.protect
+			conf.keys = map[uint32]lorawan.SessionKeys{devAddr: {NwkSKey: key}}
+			pktc := make(chan wrapper.Packet)
+			emitted := make(chan wrapper.Packet, 2)
+			r := testRepeater(t, conf, pktc, func(pkt wrapper.Packet, params wrapper.TxParams) error {
+				emitted <- pkt
+				return nil
+			})
+			if test.last != 0 {
+				r.fcnts.devices[devAddr] = store.Device{FCnt: test.last, LastSeen: time.Now().Add(-time.Hour)}
+			}
+
+			pktc <- testUplink(test.key, devAddr, test.fcnt, 1)
+			// Any other device isn't tracked
+			pktc <- testUplink(forger, devAddr+1, 1, 2)
+			if test.repeat {
+				expectEmission(t, emitted, 1)
+			}
+			expectEmission(t, emitted, 2)
+			if tracked := r.fcnts.devices[devAddr].FCnt; tracked != test.tracked {
+				t.Errorf("Frame counter %X, expected %X", tracked, test.tracked)
+			}
+			if _, ok := r.fcnts.devices[devAddr+1]; ok {
+				t.Error("Frame counter of a device without keys tracked")
+			}
+		})
+	}
+}
+
+func TestBroadcastRetransmissionAfterFailure(t *testing.T) {
+	const devAddr = 0x49BE7DF1
+	key := &lorawan.AES128Key{1, 2, 3, 4}
+	for _, withKeys := range []bool{true, false} {
+		conf := testConf()
+		if withKeys {
+			conf.keys = map[uint32]lorawan.SessionKeys{devAddr: {NwkSKey: key}}
+		}
+		pktc := make(chan wrapper.Packet)
+		emitted := make(chan wrapper.Packet, 4)
+		busy := make(chan struct{})
+		var attempts int32
+		testRepeater(t, conf, pktc, func(pkt wrapper.Packet, params wrapper.TxParams) error {
+			// The first emission finds the channel busy
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				close(busy)
+				return wrapper.ErrLBT
+			}
+			emitted <- pkt
+			return nil
+		})
+
+		// Retransmissions of LoRaWAN 1.1 devices differ, so do their CRCs. Not emitted,
+		// the first one doesn't get the second refused.
+		pktc <- testUplink(key, devAddr, 7, 1)
+		<-busy
+		pktc <- testUplink(key, devAddr, 7, 2)
+		expectEmission(t, emitted, 2)
+
+		// Emitted, the second one gets the third refused
+		pktc <- testUplink(key, devAddr, 7, 3)
+		pktc <- testUplink(key, devAddr, 8, 4)
+		expectEmission(t, emitted, 4)
+	}
+}
+
+func TestTxParamsGPSSlots(t *testing.T) {
+	conf := testConf()
+	conf.GPSSlots = &gpsSlotsConf{Period: 1000, Offset: 300, Length: 100}
+	pkt := testPacket(1, time.Now())
+	if err := pkt.SetLoRa(7, 125000); err != nil {
+		t.Fatal(err)
+	}
+	pkt.Payload = make([]byte, 12)
+	pkt.Size = 12
+
+	// Without GPS time, only repeats bypassing the slots can be scheduled
+	if _, err := txParams(pkt, &conf, policy.TxOverrides{}); err == nil {
+		t.Error("Repeat scheduled without GPS time")
+	}
+	params, err := txParams(pkt, &conf, policy.TxOverrides{Immediate: true})
+	if err != nil || params.Mode != wrapper.TxImmediate {
+		t.Errorf("Immediate repeat in mode %v, error %v", params.Mode, err)
+	}
+
+	// The repeat is scheduled in the first slot starting after the lead
+	gpsTime := 1445000000220 * time.Millisecond
+	pkt.GPSTime = &gpsTime
+	params, err = txParams(pkt, &conf, policy.TxOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 1445000001300 * time.Millisecond; params.Mode != wrapper.TxOnGPS || params.GPSTime != expected {
+		t.Errorf("Repeat in mode %v at %v, expected at %v", params.Mode, params.GPSTime, expected)
+	}
+	if params, err := txParams(pkt, &conf, policy.TxOverrides{Immediate: true}); err != nil || params.Mode != wrapper.TxImmediate {
+		t.Errorf("Immediate repeat in mode %v, error %v", params.Mode, err)
+	}
+
+	// Repeats longer than the slot can't be scheduled
+	conf.GPSSlots.Length = 10
+	if _, err := txParams(pkt, &conf, policy.TxOverrides{}); err == nil {
+		t.Error("Repeat scheduled in a slot too short")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/gwmp"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counters are the statistics of the repeater, only accessed atomically
+type counters struct {
+	received   uint64 // packets received
+	receivedOK uint64 // packets received with a valid CRC
+	forwarded  uint64 // packets handed over for repetition, after filtering and deduplication
+	repeated   uint64 // packets repeated
+	relayed    uint64 // downlinks relayed to the devices
+	dropped    uint64 // packets not repeated because the queue was full, they couldn't be scheduled or the channel stayed busy
+	lbtBusy    uint64 // emissions cancelled by LBT
+	throttled  uint64 // repeats denied by the rate limits
+	replays    uint64 // data uplinks refused by the replay protection
+	badMIC     uint64 // data uplinks from known devices refused for their MIC
+	shed       uint64 // repeats given up for higher priority ones, as the queue was full or the duty cycle budget short, or queued for too long
+	halErrors  uint64 // errors reported by the HAL
+	restarts   uint64 // concentrator restarts following HAL errors
+
+	airtimeLoRa uint64 // time spent emitting LoRa repeats, in nanoseconds
+	airtimeFSK  uint64 // time spent emitting FSK repeats, in nanoseconds
+}
+
+// addAirtime accounts the time on air of a repeat
+func (c *counters) addAirtime(modulation uint8, airtime time.Duration) {
+	if modulation == wrapper.ModulationFSK {
+		atomic.AddUint64(&c.airtimeFSK, uint64(airtime))
+	} else {
+		atomic.AddUint64(&c.airtimeLoRa, uint64(airtime))
+	}
+}
+
+func (c *counters) snapshot() counters {
+	return counters{
+		received:   atomic.LoadUint64(&c.received),
+		receivedOK: atomic.LoadUint64(&c.receivedOK),
+		forwarded:  atomic.LoadUint64(&c.forwarded),
+		repeated:   atomic.LoadUint64(&c.repeated),
+		relayed:    atomic.LoadUint64(&c.relayed),
+		dropped:    atomic.LoadUint64(&c.dropped),
+		lbtBusy:    atomic.LoadUint64(&c.lbtBusy),
+		throttled:  atomic.LoadUint64(&c.throttled),
+		replays:    atomic.LoadUint64(&c.replays),
+		badMIC:     atomic.LoadUint64(&c.badMIC),
+		shed:       atomic.LoadUint64(&c.shed),
+		halErrors:  atomic.LoadUint64(&c.halErrors),
+		restarts:   atomic.LoadUint64(&c.restarts),
+
+		airtimeLoRa: atomic.LoadUint64(&c.airtimeLoRa),
+		airtimeFSK:  atomic.LoadUint64(&c.airtimeFSK),
+	}
+}
+
+func (c counters) String() string {
+	return fmt.Sprintf("received %d, repeated %d, relayed %d, dropped %d, channel busy %d, throttled %d, replays %d, bad MIC %d, shed %d, HAL errors %d, concentrator restarts %d, airtime LoRa %v, FSK %v",
+		c.received, c.repeated, c.relayed, c.dropped, c.lbtBusy, c.throttled, c.replays, c.badMIC, c.shed, c.halErrors, c.restarts,
+		time.Duration(c.airtimeLoRa), time.Duration(c.airtimeFSK))
+}
+
+// since returns the counters accumulated since prev
+func (c counters) since(prev counters) counters {
+	return counters{
+		received:    c.received - prev.received,
+		receivedOK:  c.receivedOK - prev.receivedOK,
+		forwarded:   c.forwarded - prev.forwarded,
+		repeated:    c.repeated - prev.repeated,
+		relayed:     c.relayed - prev.relayed,
+		dropped:     c.dropped - prev.dropped,
+		lbtBusy:     c.lbtBusy - prev.lbtBusy,
+		throttled:   c.throttled - prev.throttled,
+		replays:     c.replays - prev.replays,
+		badMIC:      c.badMIC - prev.badMIC,
+		shed:        c.shed - prev.shed,
+		halErrors:   c.halErrors - prev.halErrors,
+		restarts:    c.restarts - prev.restarts,
+		airtimeLoRa: c.airtimeLoRa - prev.airtimeLoRa,
+		airtimeFSK:  c.airtimeFSK - prev.airtimeFSK,
+	}
+}
+
+// maxReportedDevices is how many of the devices with the most events are logged
+const maxReportedDevices = 5
+
+// deviceCounts counts events per device, e.g. throttled repeats
+type deviceCounts struct {
+	mutex  sync.Mutex
+	counts map[string]uint64
+}
+
+func (d *deviceCounts) add(device string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.counts == nil {
+		d.counts = make(map[string]uint64)
+	}
+	d.counts[device]++
+}
+
+// deviceCount is the number of events of a device
+type deviceCount struct {
+	device string
+	count  uint64
+}
+
+// take returns the devices with the most events since the last call, most first and
+// up to maxReportedDevices, then how many other devices had events, and resets the
+// counts
+func (d *deviceCounts) take() ([]deviceCount, int) {
+	d.mutex.Lock()
+	counts := d.counts
+	d.counts = nil
+	d.mutex.Unlock()
+
+	devices := make([]deviceCount, 0, len(counts))
+	for device, count := range counts {
+		devices = append(devices, deviceCount{device, count})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].count != devices[j].count {
+			return devices[i].count > devices[j].count
+		}
+		return devices[i].device < devices[j].device
+	})
+	if len(devices) > maxReportedDevices {
+		return devices[:maxReportedDevices], len(devices) - maxReportedDevices
+	}
+	return devices, 0
+}
+
+func formatDeviceCounts(devices []deviceCount, more int) string {
+	var reported []string
+	for _, d := range devices {
+		reported = append(reported, fmt.Sprintf("%s (%d)", d.device, d.count))
+	}
+	if more > 0 {
+		reported = append(reported, fmt.Sprintf("and %d more", more))
+	}
+	return strings.Join(reported, ", ")
+}
+
+// deviceCountsMap returns the counts by device, nil if there are none
+func deviceCountsMap(devices []deviceCount) map[string]uint64 {
+	if len(devices) == 0 {
+		return nil
+	}
+	m := make(map[string]uint64, len(devices))
+	for _, d := range devices {
+		m[d.device] = d.count
+	}
+	return m
+}
+
+// repeaterStat holds the counters without GWMP equivalent, reported along the stat object
+type repeaterStat struct {
+	Relayed     uint64  `json:"relayed"`
+	Dropped     uint64  `json:"dropped"`
+	LBTBusy     uint64  `json:"lbt_busy"`
+	Throttled   uint64  `json:"throttled"`
+	Replays     uint64  `json:"replays"`
+	BadMIC      uint64  `json:"bad_mic"`
+	Shed        uint64  `json:"shed"`
+	HALErrors   uint64  `json:"hal_errors"`
+	Restarts    uint64  `json:"restarts"`
+	AirtimeLoRa float64 `json:"airtime_lora"` // in seconds
+	AirtimeFSK  float64 `json:"airtime_fsk"`  // in seconds
+
+	ThrottledDevices map[string]uint64 `json:"throttled_devices,omitempty"` // repeats denied to the most throttled devices
+	BadMICDevices    map[string]uint64 `json:"bad_mic_devices,omitempty"`   // uplinks refused to the devices with the most MIC failures
+}
+
+// gwmpStat builds the GWMP status report of an interval, with the devices most
+// throttled and failing their MIC, and the location if known. The repeater forwards the packets over the air:
+// rxfw counts those handed over for repetition, and txnb the ones actually emitted.
+// There are no downlinks from the servers, so dwnb is 0.
+func gwmpStat(interval counters, ackr float64, throttled, badMIC []deviceCount, location *wrapper.GPSCoordinates) gwmp.Stat {
+	stat := gwmp.Stat{
+		Time: gwmp.FormatTime(time.Now()),
+		RxNb: interval.received,
+		RxOK: interval.receivedOK,
+		RxFw: interval.forwarded,
+		AckR: ackr,
+		TxNb: interval.repeated,
+		Repeater: repeaterStat{
+			Relayed:     interval.relayed,
+			Dropped:     interval.dropped,
+			LBTBusy:     interval.lbtBusy,
+			Throttled:   interval.throttled,
+			Replays:     interval.replays,
+			BadMIC:      interval.badMIC,
+			Shed:        interval.shed,
+			HALErrors:   interval.halErrors,
+			Restarts:    interval.restarts,
+			AirtimeLoRa: time.Duration(interval.airtimeLoRa).Seconds(),
+			AirtimeFSK:  time.Duration(interval.airtimeFSK).Seconds(),
+
+			ThrottledDevices: deviceCountsMap(throttled),
+			BadMICDevices:    deviceCountsMap(badMIC),
+		},
+	}
+	if location != nil {
+		stat.Lati = &location.Latitude
+		stat.Long = &location.Longitude
+		stat.Alti = &location.Altitude
+	}
+	return stat
+}
+
+// dialStatServers connects to the enabled servers of the configuration, to report the
+// statistics. It returns nil if there is none, or no gateway ID to report them with.
+func dialStatServers(conf *gatewayConf) *gwmp.Client {
+	servers := conf.upstreamServers()
+	if len(servers) == 0 {
+		return nil
+	}
+	if conf.GatewayID == nil {
+		fmt.Fprintln(os.Stderr, "No gateway_ID configured, statistics won't be reported to the servers")
+		return nil
+	}
+	id, err := gwmp.ParseGatewayID(*conf.GatewayID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+	client, err := gwmp.Dial(id, servers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Some servers are unreachable:", err)
+	}
+	return client
+}
+
+// statsRoutine logs the statistics at every interval until the context is done, and
+// reports them to the servers through client if not nil. The TX status and the
+// location are those of board, the one emitting the repeats, if not nil.
+func statsRoutine(ctx context.Context, r *repeater, interval time.Duration, client *gwmp.Client, board *wrapper.Concentrator) {
+	if interval <= 0 {
+		return
+	}
+	c := &r.stats
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	prev := c.snapshot()
+	var prevAcks gwmp.AckCounts
+	for {
+		select {
+		case <-ticker.C:
+			current := c.snapshot()
+			fmt.Printf("Statistics: %s\n", current)
+			var location *wrapper.GPSCoordinates
+			if board != nil {
+				if coordinates, ok := board.Location(); ok {
+					fmt.Printf("Location: %s\n", formatCoordinates(coordinates))
+					location = &coordinates
+				}
+			}
+			throttled, moreThrottled := r.limiter.throttled.take()
+			if len(throttled) > 0 {
+				fmt.Printf("Throttled devices: %s\n", formatDeviceCounts(throttled, moreThrottled))
+			}
+			badMIC, moreBadMIC := r.micFailures.take()
+			if len(badMIC) > 0 {
+				fmt.Printf("MIC failures: %s\n", formatDeviceCounts(badMIC, moreBadMIC))
+			}
+			if usage, ok := r.dutyCycle.usage(); ok {
+				fmt.Printf("Duty cycle budget used: %.1f%%\n", usage)
+			}
+			if board != nil {
+				if status, err := board.TxStatus(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				} else {
+					fmt.Printf("Concentrator TX status: %s\n", status)
+				}
+			}
+
+			// The reports sent during the interval are acknowledged by now, the
+			// acknowledgements being awaited when sending them
+			var ackr float64
+			if client != nil {
+				acks := client.AckCounts()
+				ackr = acks.Ratio(prevAcks)
+				prevAcks = acks
+			}
+			stat := gwmpStat(current.since(prev), ackr, throttled, badMIC, location)
+			fmt.Printf("Interval: rxnb %d, rxok %d, rxfw %d, ackr %.1f%%, dwnb %d, txnb %d\n",
+				stat.RxNb, stat.RxOK, stat.RxFw, stat.AckR, stat.DwNb, stat.TxNb)
+			if client != nil {
+				if err := client.PushStat(stat); err != nil {
+					fmt.Fprintln(os.Stderr, "Failed to report statistics:", err)
+				}
+			}
+			prev = current
+		case <-ctx.Done():
+			return
+		}
+	}
+}
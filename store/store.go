@@ -0,0 +1,458 @@
+// Package store keeps the state of the repeater on disk, so that it survives restarts:
+// the packets recently repeated, the frame counters of the devices, the emissions
+// accounted in the duty cycle and the rate limits. It is a bbolt database. Changes are
+// buffered, so that recording them never waits for the disk, and committed together
+// every FlushInterval in a transaction, which is either entirely on disk or not at all
+// after a crash: a crash loses the changes of the last interval at most.
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Buckets of the database
+var (
+	repeatsBucket   = []byte("repeats")   // CRC -> expiry, of the packets recently repeated
+	devicesBucket   = []byte("devices")   // DevAddr -> frame counter and when last seen
+	emissionsBucket = []byte("emissions") // end -> airtime, of the repeats
+	countersBucket  = []byte("counters")  // name -> value, of the repeater itself
+	limitsBucket    = []byte("limits")    // key -> tokens and when last refilled, of the rate limits
+)
+
+// FlushInterval is how often the changes are committed
+const FlushInterval = time.Second
+
+// deviceRetention is how long the frame counter of a silent device is kept
+const deviceRetention = 30 * 24 * time.Hour
+
+// Compaction rewrites the database when at least compactMinFree bytes, and half of the
+// file, are free pages
+const compactMinFree = 1 << 20
+
+// openTimeout is how long to wait for another process to release the database
+const openTimeout = time.Second
+
+// ErrLocked is returned when another process uses the database
+var ErrLocked = errors.New("State file in use by another process")
+
+// Store is the state database. Its methods are safe for concurrent use.
+type Store struct {
+	db   *bbolt.DB
+	path string
+
+	flushMutex sync.Mutex // held while committing
+	mutex      sync.Mutex
+	pending    map[string]map[string][]byte // bucket -> key -> value of the changes not committed yet, nil values are deletions
+	flushing   map[string]map[string][]byte // the changes being committed
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// Device is the state of an end device
+type Device struct {
+	FCnt     uint32    // last frame counter
+	LastSeen time.Time // when FCnt was last updated
+}
+
+// Emission is a repeat accounted in the duty cycle
+type Emission struct {
+	End     time.Time
+	Airtime time.Duration
+}
+
+// Open opens the database at path, creating it if needed. Devices silent for too long
+// are forgotten, and the file is compacted if mostly empty.
+func Open(path string) (*Store, error) {
+	// A compaction interrupted by a crash left the original database intact
+	os.Remove(path + ".compact")
+
+	s := &Store{
+		path:    path,
+		pending: make(map[string]map[string][]byte),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if err := s.forgetDevices(time.Now().Add(-deviceRetention)); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		// Not fatal, the database is still usable
+		fmt.Fprintf(os.Stderr, "%s: compaction failed: %v\n", path, err)
+	}
+	go s.flushRoutine()
+	return s, nil
+}
+
+func (s *Store) open() error {
+	db, err := bbolt.Open(s.path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return fmt.Errorf("%s: %w", s.path, ErrLocked)
+	} else if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{repeatsBucket, devicesBucket, emissionsBucket, countersBucket, limitsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// compact rewrites the database without its free pages, if they take up most of the
+// file. The copy replaces the database atomically once complete.
+func (s *Store) compact() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	free := int64(s.db.Stats().FreeAlloc)
+	if free < compactMinFree || 2*free < info.Size() {
+		return nil
+	}
+
+	tmpPath := s.path + ".compact"
+	dst, err := bbolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = bbolt.Compact(dst, s.db, 0)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(tmpPath, s.path)
+	if renameErr != nil {
+		os.Remove(tmpPath)
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	fmt.Printf("%s: compacted, %d bytes freed\n", s.path, free)
+	return nil
+}
+
+// Close commits the pending changes and closes the database
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.done
+	err := s.Flush()
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *Store) flushRoutine() {
+	defer close(s.done)
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: failed to save state: %v\n", s.path, err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Flush commits the pending changes. They are lost if that fails.
+func (s *Store) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = make(map[string]map[string][]byte)
+	s.flushing = pending
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.flushing = nil
+		s.mutex.Unlock()
+	}()
+	if len(pending) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for name, changes := range pending {
+			bucket := tx.Bucket([]byte(name))
+			for key, value := range changes {
+				var err error
+				if value == nil {
+					err = bucket.Delete([]byte(key))
+				} else {
+					err = bucket.Put([]byte(key), value)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// put records a change, committed by the next flush. A nil value deletes the key.
+func (s *Store) put(bucket []byte, key []byte, value []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changes := s.pending[string(bucket)]
+	if changes == nil {
+		changes = make(map[string][]byte)
+		s.pending[string(bucket)] = changes
+	}
+	changes[string(key)] = value
+}
+
+// get returns the value of the key, pending changes included, nil if missing
+func (s *Store) get(bucket []byte, key []byte) ([]byte, error) {
+	s.mutex.Lock()
+	value, pending := s.pending[string(bucket)][string(key)]
+	if !pending {
+		value, pending = s.flushing[string(bucket)][string(key)]
+	}
+	s.mutex.Unlock()
+	if pending {
+		return value, nil
+	}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(bucket).Get(key); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func keyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)))
+}
+
+// AddRepeat records the CRC of a packet repeated, to be remembered until expiry
+func (s *Store) AddRepeat(crc uint16, expiry time.Time) {
+	key := make([]byte, 2)
+	binary.BigEndian.PutUint16(key, crc)
+	s.put(repeatsBucket, key, timeKey(expiry))
+}
+
+// Repeats forgets the CRCs expired at now, and returns the others with their latest
+// expiry
+func (s *Store) Repeats(now time.Time) ([]uint16, time.Time, error) {
+	if err := s.Flush(); err != nil {
+		return nil, time.Time{}, err
+	}
+	var crcs []uint16
+	var latest time.Time
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(repeatsBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			expiry := keyTime(v)
+			if !expiry.After(now) {
+				expired = append(expired, k)
+				return nil
+			}
+			crcs = append(crcs, binary.BigEndian.Uint16(k))
+			if expiry.After(latest) {
+				latest = expiry
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return deleteKeys(bucket, expired)
+	})
+	return crcs, latest, err
+}
+
+// PutDevice records the state of the device with the address
+func (s *Store) PutDevice(devAddr uint32, device Device) {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, devAddr)
+	value := make([]byte, 12)
+	binary.BigEndian.PutUint32(value, device.FCnt)
+	copy(value[4:], timeKey(device.LastSeen))
+	s.put(devicesBucket, key, value)
+}
+
+// Device returns the state of the device with the address, false if unknown
+func (s *Store) Device(devAddr uint32) (Device, bool, error) {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, devAddr)
+	value, err := s.get(devicesBucket, key)
+	if err != nil || len(value) != 12 {
+		return Device{}, false, err
+	}
+	return Device{FCnt: binary.BigEndian.Uint32(value), LastSeen: keyTime(value[4:])}, true, nil
+}
+
+// PutCounter records a counter of the repeater, e.g. the frame counter of its uplinks
+func (s *Store) PutCounter(name string, value uint32) {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, value)
+	s.put(countersBucket, []byte(name), v)
+}
+
+// Counter returns a counter of the repeater, 0 if never recorded
+func (s *Store) Counter(name string) (uint32, error) {
+	v, err := s.get(countersBucket, []byte(name))
+	if err != nil || len(v) != 4 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(v), nil
+}
+
+// Limit is the state of a token bucket of the rate limits
+type Limit struct {
+	Tokens float64
+	Last   time.Time // when Tokens was last refilled
+}
+
+// PutLimit records the state of the token bucket with the key, or forgets it if nil
+func (s *Store) PutLimit(key string, limit *Limit) {
+	var value []byte
+	if limit != nil {
+		value = make([]byte, 16)
+		binary.BigEndian.PutUint64(value, math.Float64bits(limit.Tokens))
+		copy(value[8:], timeKey(limit.Last))
+	}
+	s.put(limitsBucket, []byte(key), value)
+}
+
+// Limits returns the state of the token buckets, by key
+func (s *Store) Limits() (map[string]Limit, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	limits := make(map[string]Limit)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(limitsBucket).ForEach(func(k, v []byte) error {
+			if len(v) == 16 {
+				limits[string(k)] = Limit{math.Float64frombits(binary.BigEndian.Uint64(v)), keyTime(v[8:])}
+			}
+			return nil
+		})
+	})
+	return limits, err
+}
+
+// forgetDevices forgets the devices last seen before the time
+func (s *Store) forgetDevices(before time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(devicesBucket)
+		var silent [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			if len(v) != 12 || keyTime(v[4:]).Before(before) {
+				silent = append(silent, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return deleteKeys(bucket, silent)
+	})
+}
+
+// deleteKeys deletes the keys from the bucket, once done iterating over it
+func deleteKeys(bucket *bbolt.Bucket, keys [][]byte) error {
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddEmission accounts a repeat in the duty cycle
+func (s *Store) AddEmission(e Emission) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(e.Airtime))
+	s.put(emissionsBucket, timeKey(e.End), value)
+}
+
+// ExpireEmissions forgets the emissions which ended before the time
+func (s *Store) ExpireEmissions(before time.Time) error {
+	var expired [][]byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(emissionsBucket).Cursor()
+		for k, _ := c.First(); k != nil && keyTime(k).Before(before); k, _ = c.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Emissions being committed are expired next time
+	s.mutex.Lock()
+	for key := range s.pending[string(emissionsBucket)] {
+		if keyTime([]byte(key)).Before(before) {
+			delete(s.pending[string(emissionsBucket)], key)
+		}
+	}
+	s.mutex.Unlock()
+	for _, key := range expired {
+		s.put(emissionsBucket, key, nil)
+	}
+	return nil
+}
+
+// Emissions returns the emissions which ended at or after the time, in chronological
+// order
+func (s *Store) Emissions(since time.Time) ([]Emission, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	var emissions []Emission
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(emissionsBucket).Cursor()
+		k, v := c.First()
+		if !since.IsZero() { // whose UnixNano overflows
+			k, v = c.Seek(timeKey(since))
+		}
+		for ; k != nil; k, v = c.Next() {
+			emissions = append(emissions, Emission{keyTime(k), time.Duration(binary.BigEndian.Uint64(v))})
+		}
+		return nil
+	})
+	return emissions, err
+}
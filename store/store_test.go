@@ -0,0 +1,74 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	// Changes are visible before they are committed
+	s.PutDevice(0x01020304, Device{FCnt: 42, LastSeen: time.Now()})
+	s.PutCounter("fcnt", 7)
+	if device, ok, err := s.Device(0x01020304); err != nil || !ok || device.FCnt != 42 {
+		t.Errorf("Device %+v, %v, %v before commit", device, ok, err)
+	}
+	if fcnt, err := s.Counter("fcnt"); err != nil || fcnt != 7 {
+		t.Errorf("Counter %d, %v before commit", fcnt, err)
+	}
+
+	s.AddRepeat(0xbeef, time.Now().Add(time.Hour))
+	s.PutLimit("global", &Limit{Tokens: 1.5, Last: now})
+	s.PutLimit("DevAddr 01020304", &Limit{Tokens: 0.25, Last: now})
+	s.PutLimit("DevAddr 01020304", nil)
+	for i := 0; i < 3; i++ {
+		s.AddEmission(Emission{End: now.Add(time.Duration(i) * time.Minute), Airtime: time.Second})
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.AddEmission(Emission{End: now.Add(-time.Minute), Airtime: time.Second})
+	if err := s.ExpireEmissions(now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is committed on close
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if device, ok, err := s.Device(0x01020304); err != nil || !ok || device.FCnt != 42 {
+		t.Errorf("Device %+v, %v, %v after reopening", device, ok, err)
+	}
+	if fcnt, err := s.Counter("fcnt"); err != nil || fcnt != 7 {
+		t.Errorf("Counter %d, %v after reopening", fcnt, err)
+	}
+	if crcs, _, err := s.Repeats(time.Now()); err != nil || len(crcs) != 1 || crcs[0] != 0xbeef {
+		t.Errorf("Repeats %v, %v after reopening", crcs, err)
+	}
+	limits, err := s.Limits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 1 || limits["global"].Tokens != 1.5 || !limits["global"].Last.Equal(now) {
+		t.Errorf("Limits %v after reopening", limits)
+	}
+	emissions, err := s.Emissions(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emissions) != 2 || !emissions[0].End.Equal(now.Add(time.Minute)) {
+		t.Errorf("Emissions %v after expiry", emissions)
+	}
+}
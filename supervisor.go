@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	maxConsecutiveHALErrors = 5                // HAL errors in a row tolerated by a routine before the concentrator is restarted
+	initRestartBackoff      = time.Second      // delay before the first restart attempt
+	maxRestartBackoff       = 2 * time.Minute  // upper bound of the delay between restart attempts
+	stableRunDuration       = 10 * time.Minute // the backoff starts over once the concentrator ran this long
+)
+
+func isHALError(err error) bool {
+	var halErr *wrapper.HALError
+	return errors.As(err, &halErr)
+}
+
+// supervisor brings the concentrator back after HAL errors
+type supervisor struct {
+	stats       *counters
+	boards      []*wrapper.Concentrator
+	backoff     time.Duration
+	lastRestart time.Time
+}
+
+func newSupervisor(stats *counters, boards []*wrapper.Concentrator) *supervisor {
+	return &supervisor{
+		stats:   stats,
+		boards:  boards,
+		backoff: initRestartBackoff,
+	}
+}
+
+// recover stops, resets, configures and starts the concentrator again, retrying with
+// an exponential backoff until it succeeds. A SIGHUP received meanwhile reloads the
+// configuration through reload, which returns whether the SX1301 configuration changed,
+// in which case it is attempted at once. It returns nil once the concentrator is
+// running, or the signal that interrupted the recovery.
+func (s *supervisor) recover(conf *globalConf, sigc chan os.Signal, reload func() bool) os.Signal {
+	if time.Since(s.lastRestart) > stableRunDuration {
+		s.backoff = initRestartBackoff
+	}
+
+	for {
+		fmt.Printf("Restarting the concentrator in %s\n", s.backoff)
+		timer := time.NewTimer(s.backoff)
+	WAIT:
+		for {
+			select {
+			case sig := <-sigc:
+				if sig != syscall.SIGHUP {
+					timer.Stop()
+					return sig
+				}
+				if reload() {
+					timer.Stop()
+					break WAIT
+				}
+			case <-timer.C:
+				break WAIT
+			}
+		}
+
+		s.backoff *= 2
+		if s.backoff > maxRestartBackoff {
+			s.backoff = maxRestartBackoff
+		}
+		s.lastRestart = time.Now()
+
+		if err := restartConcentrator(s.boards, conf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		restarts := atomic.AddUint64(&s.stats.restarts, 1)
+		fmt.Printf("LoRa gateway restarted successfully (%d restarts so far)\n", restarts)
+		return nil
+	}
+}
+
+// reconfigure restarts the concentrator at once with a new SX1301 configuration. This
+// isn't counted as a restart, and only falls back to recover if it fails.
+func (s *supervisor) reconfigure(conf *globalConf, sigc chan os.Signal, reload func() bool) os.Signal {
+	if err := restartConcentrator(s.boards, conf); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return s.recover(conf, sigc, reload)
+	}
+	fmt.Println("LoRa gateway restarted with the new configuration")
+	return nil
+}
+
+// restartConcentrator stops the boards, resets them and applies the full configuration again
+func restartConcentrator(boards []*wrapper.Concentrator, conf *globalConf) error {
+	stopBoards(boards)
+	return setupBoards(boards, conf)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/store"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"strconv"
+)
+
+// Names of the frame counters of the relay in the store
+const (
+	relayFCntCounter     = "ts011_fcnt_up"
+	relayFCntDownCounter = "ts011_fcnt_down"
+)
+
+// ts011RelayConf makes the repeater a LoRaWAN relay as specified by TS011, joined to
+// the network as an ABP LoRaWAN 1.0.x device. Instead of echoing the uplinks, it
+// forwards them to the network in ForwardUplinkReq frames on port 226, and emits the
+// downlinks the network sends back in ForwardDownlinkReq frames into the windows of
+// their device, as configured by downlink_relay.
+//
+// Only this forwarding is implemented. The SX1301 can't emit WOR acknowledgements
+// nor run the WOR channel activity detection, so devices must reach the relay with
+// plain uplinks rather than after a WOR frame. The MAC commands of the network are
+// answered in the next forwarded uplink, refusing those the relay can't apply: the
+// relay MAC commands configuring WOR, and the LoRaWAN ones changing the channels, data
+// rate, power or receive windows of the relay, as its uplinks take the channel and
+// data rate of the uplinks they carry. Without state file, the frame counters of the
+// relay restart from 0 and the network refuses its uplinks until they are reset there
+// too.
+type ts011RelayConf struct {
+	DevAddr string             `json:"dev_addr"`  // 8 hexadecimal digits
+	NwkSKey *lorawan.AES128Key `json:"nwk_s_key"` // also encrypts port 226
+}
+
+func (c *ts011RelayConf) validate(prefix string, downlinkRelay *downlinkRelayConf) wrapper.ConfigErrors {
+	var errs wrapper.ConfigErrors
+	if _, err := strconv.ParseUint(c.DevAddr, 16, 32); err != nil || len(c.DevAddr) != 8 {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".dev_addr", Message: fmt.Sprintf("%q is not valid, should be 8 hexadecimal digits", c.DevAddr)})
+	}
+	if c.NwkSKey == nil {
+		errs = append(errs, wrapper.ConfigError{Path: prefix + ".nwk_s_key", Message: "missing"})
+	}
+	if downlinkRelay == nil || downlinkRelay.region() == nil {
+		errs = append(errs, wrapper.ConfigError{Path: prefix, Message: "requires downlink_relay with a region"})
+	}
+	return errs
+}
+
+// devAddr returns the DevAddr of the relay, once validated
+func (c *ts011RelayConf) devAddr() uint32 {
+	addr, _ := strconv.ParseUint(c.DevAddr, 16, 32)
+	return uint32(addr)
+}
+
+// ts011Relay holds the frame counters of the relay, and its answers to the MAC commands
+// of the network. It is only used by broadcastRoutine.
+type ts011Relay struct {
+	fcntUp   uint32 // of the next uplink
+	fcntDown uint32 // of the next downlink, at least
+	answers  []lorawan.Command
+	ack      bool // the last downlink is confirmed
+	store    *store.Store
+}
+
+// load restores the frame counters saved in st, where they are next saved
+func (t *ts011Relay) load(st *store.Store) error {
+	fcntUp, err := st.Counter(relayFCntCounter)
+	if err != nil {
+		return err
+	}
+	fcntDown, err := st.Counter(relayFCntDownCounter)
+	if err != nil {
+		return err
+	}
+	t.fcntUp, t.fcntDown = fcntUp, fcntDown
+	t.store = st
+	return nil
+}
+
+// forward returns the uplink of the relay to emit on the channel of the received one,
+// carrying it in a ForwardUplinkReq frame along with the answers to the MAC commands
+// of the network, and how many answers it carries. Nothing changes until the uplink is
+// emitted and sent records it.
+func (t *ts011Relay) forward(pkt wrapper.Packet, conf *repeaterConf) (wrapper.Packet, int, error) {
+	dataRate := lorawan.DataRate{SF: pkt.SpreadingFactor(), Bandwidth: pkt.BandwidthHz()}
+	dr, err := conf.DownlinkRelay.region().UplinkDataRate(dataRate)
+	if err != nil {
+		return pkt, 0, err
+	}
+	meta := lorawan.UplinkMetadata{
+		DataRate: uint8(dr),
+		SNR:      int(pkt.SNR),
+		RSSI:     int(pkt.RSSI),
+	}
+	req := lorawan.ForwardUplinkReq(meta, pkt.Freq, pkt.Payload)
+	fOpts, answers := lorawan.EncodeCommands(t.answers)
+	pkt.Payload = lorawan.EncodeUplink(conf.TS011Relay.NwkSKey, conf.TS011Relay.devAddr(), t.fcntUp, t.ack, fOpts, lorawan.RelayFPort, req)
+	pkt.Size = uint32(len(pkt.Payload))
+	return pkt, answers, nil
+}
+
+// sent records the emission of the uplink forward returned last, with its answers
+func (t *ts011Relay) sent(answers int) {
+	t.fcntUp++
+	if t.store != nil {
+		t.store.PutCounter(relayFCntCounter, t.fcntUp)
+	}
+
+	// The answers to the commands changing the receive windows are sent until the
+	// next downlink, the others once
+	var sticky []lorawan.Command
+	for _, answer := range t.answers[:answers] {
+		switch answer.CID {
+		case lorawan.RXParamSetupReq, lorawan.RXTimingSetupReq, lorawan.DlChannelReq:
+			sticky = append(sticky, answer)
+		}
+	}
+	t.answers = append(sticky, t.answers[answers:]...)
+	t.ack = false
+}
+
+// open checks a downlink of the network to the relay, and returns the frame carried by
+// its ForwardDownlinkReq, nil if it has none. snr is the one of the downlink, in dB.
+func (t *ts011Relay) open(frame *lorawan.Frame, phy []byte, snr float32, conf *ts011RelayConf) ([]byte, error) {
+	// The full frame counter is never behind the next one expected, so the MIC of
+	// replayed downlinks doesn't match
+	fcnt := fullFCnt(t.fcntDown, frame.FCnt)
+	payload, err := lorawan.DecodeDownlink(conf.NwkSKey, phy, frame, fcnt)
+	if err != nil {
+		return nil, err
+	}
+	t.fcntDown = fcnt + 1
+	if t.store != nil {
+		t.store.PutCounter(relayFCntDownCounter, t.fcntDown)
+	}
+
+	// MAC commands are in FOpts, or in the payload on port 0
+	data := frame.FOpts
+	if frame.FPort != nil && *frame.FPort == 0 {
+		data = payload
+	}
+	commands, err := lorawan.ParseDownlinkCommands(data)
+	if err != nil {
+		fmt.Printf("Ignoring MAC commands of the network (%v)\n", err)
+	}
+	t.answers = answerCommands(commands, snr)
+	t.ack = frame.MType == lorawan.ConfirmedDataDown
+	if frame.FPort == nil || *frame.FPort != lorawan.RelayFPort || len(payload) == 0 {
+		return nil, nil
+	}
+	return payload, nil
+}
+
+// answerCommands returns the answers of the relay to the MAC commands of the network,
+// snr being the one of the downlink carrying them, in dB
+func answerCommands(commands []lorawan.Command, snr float32) []lorawan.Command {
+	var answers []lorawan.Command
+	for _, command := range commands {
+		var payload []byte
+		switch command.CID {
+		case lorawan.LinkCheckAns, lorawan.DeviceTimeAns:
+			// Answers to requests the relay never sends
+			continue
+		case lorawan.DevStatusReq:
+			// Powered externally, with the margin of the downlink over 6 bits
+			margin := max(-32, min(int(snr), 31))
+			payload = []byte{0, byte(margin) & 0x3f}
+		case lorawan.DutyCycleReq, lorawan.RXTimingSetupReq, lorawan.TxParamSetupReq, lorawan.UpdateUplinkListReq, lorawan.ConfigureFwdLimitReq:
+			// Answers without status
+		case lorawan.CtrlUplinkListReq:
+			// Refused, with a WOR frame counter of 0
+			payload = make([]byte, 5)
+		default:
+			// Refused
+			payload = []byte{0}
+		}
+		fmt.Printf("Answering %s of the network\n", command)
+		answers = append(answers, lorawan.Command{CID: command.CID, Payload: payload})
+	}
+	return answers
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"github.com/NaNkeen/packet_repeater/lorawan"
+	"github.com/NaNkeen/packet_repeater/store"
+	"github.com/NaNkeen/packet_repeater/wrapper"
+	"path/filepath"
+	"testing"
+)
+
+func testRelayConf(t *testing.T) *repeaterConf {
+	t.Helper()
+	var key lorawan.AES128Key
+	if err := key.UnmarshalText([]byte("44024241ed4ce9a68c6a8bc055233fd3")); err != nil {
+		t.Fatal(err)
+	}
+	conf := testConf()
+	conf.DownlinkRelay = &downlinkRelayConf{Region: "AS923", Uninverted: true}
+	conf.TS011Relay = &ts011RelayConf{DevAddr: "01020304", NwkSKey: &key}
+	return &conf
+}
+
+// forwardUplink makes the relay forward an uplink, and returns the frame it emits
+func forwardUplink(t *testing.T, relay *ts011Relay, conf *repeaterConf) *lorawan.Frame {
+	t.Helper()
+	pkt := wrapper.Packet{Freq: 923200000, Payload: []byte{0x40, 1, 2, 3, 4, 0, 0, 0, 1, 2, 3, 4}}
+	if err := pkt.SetLoRa(10, 125000); err != nil {
+		t.Fatal(err)
+	}
+	pkt, answers, err := relay.forward(pkt, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.sent(answers)
+	frame, err := lorawan.Decode(pkt.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestTS011Relay(t *testing.T) {
+	conf := testRelayConf(t)
+	st, err := store.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	var relay ts011Relay
+	if err := relay.load(st); err != nil {
+		t.Fatal(err)
+	}
+
+	// A confirmed downlink with MAC commands, carrying one to forward
+	forwarded := []byte{0x60, 4, 3, 2, 1, 0, 0, 0, 0, 0, 0, 0}
+	commands := []byte{
+		lorawan.DevStatusReq,
+		lorawan.RXTimingSetupReq, 1,
+		lorawan.LinkADRReq, 0x51, 0xff, 0x00, 0x01,
+		lorawan.LinkCheckAns, 10, 1,
+	}
+	down := func(fcnt uint32) []byte {
+		return lorawan.EncodeDownlink(lorawan.ConfirmedDataDown, conf.TS011Relay.NwkSKey, conf.TS011Relay.devAddr(), fcnt, false, commands, lorawan.RelayFPort, forwarded)
+	}
+	open := func(phy []byte) ([]byte, error) {
+		frame, err := lorawan.Decode(phy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return relay.open(frame, phy, -7, conf.TS011Relay)
+	}
+	phy := down(0x10005)
+	relay.fcntDown = 0x10000
+	payload, err := open(phy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, forwarded) {
+		t.Errorf("Forwarding % X, expected % X", payload, forwarded)
+	}
+
+	// Replays and older downlinks are refused
+	for _, phy := range [][]byte{phy, down(0x10004)} {
+		if _, err := open(phy); err == nil {
+			t.Error("Replayed downlink opened")
+		}
+	}
+
+	// An uplink which isn't emitted keeps the answers, the acknowledgement and the
+	// frame counter for the next one
+	pkt := wrapper.Packet{Freq: 923200000, Payload: []byte{0x40, 1, 2, 3, 4, 0, 0, 0, 1, 2, 3, 4}}
+	if err := pkt.SetLoRa(10, 125000); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := relay.forward(pkt, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The answers and the acknowledgement go in the next uplink, the answer to
+	// RXTimingSetupReq in the following ones too
+	margin := byte(0x40 - 7) // -7 over 6 bits
+	frame := forwardUplink(t, &relay, conf)
+	answers := []byte{lorawan.DevStatusReq, 0, margin, lorawan.RXTimingSetupReq, lorawan.LinkADRReq, 0}
+	if frame.FCnt != 0 {
+		t.Errorf("First uplink FCnt %d, expected 0", frame.FCnt)
+	}
+	if !bytes.Equal(frame.FOpts, answers) || frame.FCtrl&0x20 == 0 {
+		t.Errorf("First uplink FCtrl %02X FOpts % X, expected ACK and % X", frame.FCtrl, frame.FOpts, answers)
+	}
+	frame = forwardUplink(t, &relay, conf)
+	if answers := []byte{lorawan.RXTimingSetupReq}; !bytes.Equal(frame.FOpts, answers) || frame.FCtrl&0x20 != 0 {
+		t.Errorf("Second uplink FCtrl %02X FOpts % X, expected % X", frame.FCtrl, frame.FOpts, answers)
+	}
+
+	// The frame counters are restored from the state file
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var restored ts011Relay
+	if err := restored.load(st); err != nil {
+		t.Fatal(err)
+	}
+	if restored.fcntUp != 2 || restored.fcntDown != 0x10006 {
+		t.Errorf("Restored FCntUp %d FCntDown %X, expected 2 and 10006", restored.fcntUp, restored.fcntDown)
+	}
+}
@@ -1,5 +1,10 @@
 package wrapper
 
+import (
+	"reflect"
+	"strings"
+)
+
 // LBTConf wraps lbt configuration for SX1301
 type LbtConf struct {
 	Enabled        bool              `json:"enable"`
@@ -20,6 +25,7 @@ type ChannelConf struct {
 	Bandwidth    *uint32 `json:"bandwidth,omitempty"`
 	Datarate     *uint32 `json:"datarate,omitempty"`
 	SpreadFactor *uint8  `json:"spread_factor,omitempty"`
+	FDev         *uint8  `json:"f_dev,omitempty"` // FSK frequency deviation in kHz, half the datarate if missing
 	Description  *string `json:"desc,omitempty"`
 }
 
@@ -136,9 +142,182 @@ type SX1301Conf struct {
 	TxLut15                *GainTableConf `json:"tx_lut_15,omitempty"`
 }
 
+// Radios returns the configuration of the two radios, indexed by RF chain
+func (c *SX1301Conf) Radios() []*RadioConf {
+	return []*RadioConf{c.Radio0, c.Radio1}
+}
+
+// ChannelFreq returns the center frequency of an IF channel, in Hz, false if its radio
+// isn't configured
+func (c *SX1301Conf) ChannelFreq(channel *ChannelConf) (uint32, bool) {
+	radios := c.Radios()
+	if int(channel.Radio) >= len(radios) || radios[channel.Radio] == nil {
+		return 0, false
+	}
+	return uint32(int32(radios[channel.Radio].Freq) + channel.IfValue), true
+}
+
+// MultiSFChannels returns the configuration of the multi-SF channels, indexed
+// by IF chain. Channels missing from the configuration are nil.
+func (c *SX1301Conf) MultiSFChannels() []*ChannelConf {
+	return []*ChannelConf{
+		c.MultiSFChan0,
+		c.MultiSFChan1,
+		c.MultiSFChan2,
+		c.MultiSFChan3,
+		c.MultiSFChan4,
+		c.MultiSFChan5,
+		c.MultiSFChan6,
+		c.MultiSFChan7,
+		c.MultiSFChan8,
+		c.MultiSFChan9,
+		c.MultiSFChan10,
+		c.MultiSFChan11,
+		c.MultiSFChan12,
+		c.MultiSFChan13,
+		c.MultiSFChan14,
+		c.MultiSFChan15,
+		c.MultiSFChan16,
+		c.MultiSFChan17,
+		c.MultiSFChan18,
+		c.MultiSFChan19,
+		c.MultiSFChan20,
+		c.MultiSFChan21,
+		c.MultiSFChan22,
+		c.MultiSFChan23,
+		c.MultiSFChan24,
+		c.MultiSFChan25,
+		c.MultiSFChan26,
+		c.MultiSFChan27,
+		c.MultiSFChan28,
+		c.MultiSFChan29,
+		c.MultiSFChan30,
+		c.MultiSFChan31,
+		c.MultiSFChan32,
+		c.MultiSFChan33,
+		c.MultiSFChan34,
+		c.MultiSFChan35,
+		c.MultiSFChan36,
+		c.MultiSFChan37,
+		c.MultiSFChan38,
+		c.MultiSFChan39,
+		c.MultiSFChan40,
+		c.MultiSFChan41,
+		c.MultiSFChan42,
+		c.MultiSFChan43,
+		c.MultiSFChan44,
+		c.MultiSFChan45,
+		c.MultiSFChan46,
+		c.MultiSFChan47,
+		c.MultiSFChan48,
+		c.MultiSFChan49,
+		c.MultiSFChan50,
+		c.MultiSFChan51,
+		c.MultiSFChan52,
+		c.MultiSFChan53,
+		c.MultiSFChan54,
+		c.MultiSFChan55,
+		c.MultiSFChan56,
+		c.MultiSFChan57,
+		c.MultiSFChan58,
+		c.MultiSFChan59,
+		c.MultiSFChan60,
+		c.MultiSFChan61,
+		c.MultiSFChan62,
+		c.MultiSFChan63,
+	}
+}
+
+// TxLuts returns the TX gain table entries, indexed by their position in the table.
+// Entries missing from the configuration are nil.
+func (c *SX1301Conf) TxLuts() []*GainTableConf {
+	return []*GainTableConf{
+		c.TxLut0,
+		c.TxLut1,
+		c.TxLut2,
+		c.TxLut3,
+		c.TxLut4,
+		c.TxLut5,
+		c.TxLut6,
+		c.TxLut7,
+		c.TxLut8,
+		c.TxLut9,
+		c.TxLut10,
+		c.TxLut11,
+		c.TxLut12,
+		c.TxLut13,
+		c.TxLut14,
+		c.TxLut15,
+	}
+}
+
+// ClearTxLuts removes every TX gain table entry
+func (c *SX1301Conf) ClearTxLuts() {
+	c.clearFields("tx_lut_")
+}
+
+// ClearChannels removes every IF channel: the multi-SF, LoRa standard and FSK channels
+func (c *SX1301Conf) ClearChannels() {
+	c.clearFields("chan_")
+}
+
+// clearFields sets to nil the fields whose JSON key starts with the prefix
+func (c *SX1301Conf) clearFields(prefix string) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if strings.HasPrefix(key, prefix) {
+			v.Field(i).Set(reflect.Zero(v.Field(i).Type()))
+		}
+	}
+}
+
+// DefaultSX1301Conf returns the built-in configuration, on top of which the
+// configuration files are applied
+func DefaultSX1301Conf() SX1301Conf {
+	var conf = SX1301Conf{
+		LorawanPublic:  true,
+		Clksrc:         1,
+		LoraSTDChannel: GetLoraSTDChannel(),
+		FSKChannel:     GetFSKChannel(),
+	}
+
+	radios := GetRFConfs()
+	conf.Radio0, conf.Radio1 = &radios[0], &radios[1]
+
+	channels := GetMultiSFChannels()
+	conf.MultiSFChan0 = &channels[0]
+	conf.MultiSFChan1 = &channels[1]
+	conf.MultiSFChan2 = &channels[2]
+	conf.MultiSFChan3 = &channels[3]
+	conf.MultiSFChan4 = &channels[4]
+	conf.MultiSFChan5 = &channels[5]
+	conf.MultiSFChan6 = &channels[6]
+	conf.MultiSFChan7 = &channels[7]
+
+	luts := GetLuts()
+	conf.TxLut0 = &luts[0]
+	conf.TxLut1 = &luts[1]
+	conf.TxLut2 = &luts[2]
+	conf.TxLut3 = &luts[3]
+	conf.TxLut4 = &luts[4]
+	conf.TxLut5 = &luts[5]
+	conf.TxLut6 = &luts[6]
+	conf.TxLut7 = &luts[7]
+	conf.TxLut8 = &luts[8]
+	conf.TxLut9 = &luts[9]
+	conf.TxLut10 = &luts[10]
+	conf.TxLut11 = &luts[11]
+	conf.TxLut12 = &luts[12]
+	conf.TxLut13 = &luts[13]
+	conf.TxLut14 = &luts[14]
+	conf.TxLut15 = &luts[15]
+	return conf
+}
+
 func GetLuts() []GainTableConf {
 	return []GainTableConf{
-		{0, 15, 2, 0, nil, nil},
+		{0, 15, -2, 0, nil, nil},
 		{1, 8, 1, 0, nil, nil},
 		{1, 10, 4, 0, nil, nil},
 		{1, 12, 6, 0, nil, nil},
@@ -168,24 +347,24 @@ func GetRFConfs() []RadioConf {
 
 func GetMultiSFChannels() []ChannelConf {
 	return []ChannelConf{
-		{true, 0, 300000, nil, nil, nil, nil},
-		{true, 0, 100000, nil, nil, nil, nil},
-		{true, 0, 100000, nil, nil, nil, nil},
-		{true, 0, 300000, nil, nil, nil, nil},
-		{true, 1, 300000, nil, nil, nil, nil},
-		{true, 1, 100000, nil, nil, nil, nil},
-		{true, 1, 100000, nil, nil, nil, nil},
-		{true, 1, 300000, nil, nil, nil, nil},
+		{true, 0, 300000, nil, nil, nil, nil, nil},
+		{true, 0, 100000, nil, nil, nil, nil, nil},
+		{true, 0, 100000, nil, nil, nil, nil, nil},
+		{true, 0, 300000, nil, nil, nil, nil, nil},
+		{true, 1, 300000, nil, nil, nil, nil, nil},
+		{true, 1, 100000, nil, nil, nil, nil, nil},
+		{true, 1, 100000, nil, nil, nil, nil, nil},
+		{true, 1, 300000, nil, nil, nil, nil, nil},
 	}
 }
 
 func GetLoraSTDChannel() *ChannelConf {
 	var bandwidth uint32 = 0
 	var spread_factor uint8 = 7
-	return &ChannelConf{false, 0, 0, &bandwidth, nil, &spread_factor, nil}
+	return &ChannelConf{false, 0, 0, &bandwidth, nil, &spread_factor, nil, nil}
 }
 
 func GetFSKChannel() *ChannelConf {
 	var bandwidth uint32 = 0
-	return &ChannelConf{false, 0, 0, &bandwidth, nil, nil, nil}
+	return &ChannelConf{false, 0, 0, &bandwidth, nil, nil, nil, nil}
 }
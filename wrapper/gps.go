@@ -0,0 +1,208 @@
+package wrapper
+
+// #include <stdlib.h>
+// #include "loragw_hal.h"
+// #include "loragw_gps.h"
+import "C"
+import (
+	"errors"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// gpsRefMaxAge is how long the GPS time reference stays valid without being updated
+const gpsRefMaxAge = 30 * time.Second
+
+// GPSCoordinates is a location as reported by the GPS
+type GPSCoordinates struct {
+	Latitude  float64 // in degrees, North is positive
+	Longitude float64 // in degrees, East is positive
+	Altitude  int16   // in meters
+}
+
+// GPSMessage is the type of a message read from the GPS
+type GPSMessage int
+
+// Messages reported by ParseGPSMessage
+const (
+	GPSUnknown    GPSMessage = C.UNKNOWN
+	GPSIgnored    GPSMessage = C.IGNORED
+	GPSInvalid    GPSMessage = C.INVALID
+	GPSIncomplete GPSMessage = C.INCOMPLETE
+	GPSNMEARMC    GPSMessage = C.NMEA_RMC
+	GPSNMEAGGA    GPSMessage = C.NMEA_GGA
+	GPSUBXTimeGPS GPSMessage = C.UBX_NAV_TIMEGPS
+)
+
+// GPSMinMessageSize is the size of the smallest message the GPS can send
+const GPSMinMessageSize = C.LGW_GPS_MIN_MSG_SIZE
+
+// EnableGPS opens the serial port the GPS is connected to, and configures the GPS to
+// send the messages needed for synchronisation. family is the GPS family, e.g. ubx7.
+func EnableGPS(ttyPath string, family string) (*os.File, error) {
+	cPath := C.CString(ttyPath)
+	defer C.free(unsafe.Pointer(cPath))
+	cFamily := C.CString(family)
+	defer C.free(unsafe.Pointer(cFamily))
+
+	var fd C.int
+	if C.lgw_gps_enable(cPath, cFamily, 0, &fd) != C.LGW_GPS_SUCCESS {
+		return nil, errors.New("Failed to enable GPS on " + ttyPath)
+	}
+	return os.NewFile(uintptr(fd), ttyPath), nil
+}
+
+// ParseGPSMessage parses the message at the start of buf, which can be either an NMEA
+// sentence or a UBX frame. It returns the type of the message and its size, which is
+// 0 if buf doesn't start with a complete message.
+func ParseGPSMessage(buf []byte) (GPSMessage, int) {
+	if len(buf) == 0 {
+		return GPSIncomplete, 0
+	}
+	cBuf := (*C.char)(unsafe.Pointer(&buf[0]))
+
+	switch buf[0] {
+	case C.LGW_GPS_UBX_SYNC_CHAR:
+		var size C.size_t
+		msg := GPSMessage(C.lgw_parse_ubx(cBuf, C.size_t(len(buf)), &size))
+		if msg == GPSIncomplete {
+			return msg, 0
+		}
+		return msg, int(size)
+	case C.LGW_GPS_NMEA_SYNC_CHAR:
+		for i, c := range buf {
+			if c == '\n' {
+				return GPSMessage(C.lgw_parse_nmea(cBuf, C.int(i+1))), i + 1
+			}
+		}
+		return GPSIncomplete, 0
+	}
+	return GPSUnknown, 0
+}
+
+// SyncGPSTime updates the GPS time reference from the last time message parsed, and the
+// counter of the concentrator latched on the last PPS pulse. The messages are parsed by
+// this process, the PPS pulse has to reach the boards of the workers too.
+func (c *Concentrator) SyncGPSTime() error {
+	var utc, gpsTime C.struct_timespec
+	if C.lgw_gps_get(&utc, &gpsTime, nil, nil) != C.LGW_GPS_SUCCESS {
+		return errors.New("Failed to get GPS time")
+	}
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "SyncGPSTime", UTC: durationFromTimespec(utc), GPSTime: durationFromTimespec(gpsTime)})
+	}
+	return c.syncGPSTime(utc, gpsTime)
+}
+
+// syncGPSTime updates the GPS time reference from the UTC and GPS time of the last PPS pulse
+func (c *Concentrator) syncGPSTime(utc, gpsTime C.struct_timespec) error {
+	var trigCount C.uint32_t
+	c.mutex.Lock()
+	result := C.lgw_get_trigcnt(&trigCount)
+	c.mutex.Unlock()
+	if result != C.LGW_HAL_SUCCESS {
+		return &HALError{"Failed to read the concentrator counter latched on PPS"}
+	}
+
+	c.gpsMutex.Lock()
+	defer c.gpsMutex.Unlock()
+	if C.lgw_gps_sync(&c.gpsRef, trigCount, utc, gpsTime) != C.LGW_GPS_SUCCESS {
+		c.gpsValid = false
+		return errors.New("GPS time reference out of sync")
+	}
+	c.gpsValid = true
+	return nil
+}
+
+// syncGPSTimeFrom is syncGPSTime for the times sent to a worker, since their epoch
+func (c *Concentrator) syncGPSTimeFrom(utc, gpsTime time.Duration) error {
+	return c.syncGPSTime(timespecFromDuration(utc), timespecFromDuration(gpsTime))
+}
+
+// UpdateLocation updates the location of the board from the last position message parsed
+func (c *Concentrator) UpdateLocation() error {
+	var coord, coordErr C.struct_coord_s
+	if C.lgw_gps_get(nil, nil, &coord, &coordErr) != C.LGW_GPS_SUCCESS {
+		return errors.New("Failed to get GPS coordinates")
+	}
+	c.SetLocation(GPSCoordinates{
+		Latitude:  float64(coord.lat),
+		Longitude: float64(coord.lon),
+		Altitude:  int16(coord.alt),
+	})
+	return nil
+}
+
+// SetLocation sets the location reported with the packets the board receives, e.g. to
+// a fixed location when there is no GPS
+func (c *Concentrator) SetLocation(coordinates GPSCoordinates) {
+	c.gpsMutex.Lock()
+	c.location = &coordinates
+	c.gpsMutex.Unlock()
+}
+
+// Location returns the last known location of the board, if any
+func (c *Concentrator) Location() (GPSCoordinates, bool) {
+	c.gpsMutex.Lock()
+	defer c.gpsMutex.Unlock()
+	if c.location == nil {
+		return GPSCoordinates{}, false
+	}
+	return *c.location, true
+}
+
+// gpsTimeReferenceUsable tells whether the GPS time reference can be used to timestamp
+// packets. c.gpsMutex must be held.
+func (c *Concentrator) gpsTimeReferenceUsable() bool {
+	if !c.gpsValid {
+		return false
+	}
+	age := time.Since(time.Unix(int64(c.gpsRef.systime), 0))
+	return age <= gpsRefMaxAge
+}
+
+// timestampPacket sets the UTC and GPS time of reception of the packet, from its
+// concentrator counter. c.gpsMutex must be held.
+func (c *Concentrator) timestampPacket(p *Packet) {
+	if !c.gpsTimeReferenceUsable() {
+		return
+	}
+	var utc, gpsTime C.struct_timespec
+	if C.lgw_cnt2utc(c.gpsRef, C.uint32_t(p.CountUS), &utc) == C.LGW_GPS_SUCCESS {
+		t := time.Unix(int64(utc.tv_sec), int64(utc.tv_nsec)).UTC()
+		p.Time = &t
+	}
+	if C.lgw_cnt2gps(c.gpsRef, C.uint32_t(p.CountUS), &gpsTime) == C.LGW_GPS_SUCCESS {
+		d := durationFromTimespec(gpsTime)
+		p.GPSTime = &d
+	}
+}
+
+// GPSTimeToCount converts a GPS time (time since the GPS epoch) to the matching
+// concentrator counter value, through the GPS time reference
+func (c *Concentrator) GPSTimeToCount(gpsTime time.Duration) (uint32, error) {
+	c.gpsMutex.Lock()
+	defer c.gpsMutex.Unlock()
+	if !c.gpsTimeReferenceUsable() {
+		return 0, errors.New("No valid GPS time reference")
+	}
+
+	var countUS C.uint32_t
+	if C.lgw_gps2cnt(c.gpsRef, timespecFromDuration(gpsTime), &countUS) != C.LGW_GPS_SUCCESS {
+		return 0, errors.New("Failed to convert GPS time to concentrator counter")
+	}
+	return uint32(countUS), nil
+}
+
+// durationFromTimespec returns the time elapsed since the epoch of ts
+func durationFromTimespec(ts C.struct_timespec) time.Duration {
+	return time.Duration(ts.tv_sec)*time.Second + time.Duration(ts.tv_nsec)
+}
+
+func timespecFromDuration(d time.Duration) C.struct_timespec {
+	var ts C.struct_timespec
+	ts.tv_sec = C.time_t(d / time.Second)
+	ts.tv_nsec = C.long(d % time.Second)
+	return ts
+}
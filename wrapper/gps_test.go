@@ -0,0 +1,62 @@
+package wrapper
+
+import (
+	"fmt"
+	"testing"
+)
+
+// ubxFrame returns a UBX frame with its checksum
+func ubxFrame(class, id byte, payload []byte) []byte {
+	frame := append([]byte{0xB5, 0x62, class, id, byte(len(payload)), byte(len(payload) >> 8)}, payload...)
+	var a, b byte
+	for _, c := range frame[2:] {
+		a += c
+		b += a
+	}
+	return append(frame, a, b)
+}
+
+// nmeaSentence returns an NMEA sentence with its checksum
+func nmeaSentence(fields string) []byte {
+	var checksum byte
+	for i := 0; i < len(fields); i++ {
+		checksum ^= fields[i]
+	}
+	return []byte(fmt.Sprintf("$%s*%02X\r\n", fields, checksum))
+}
+
+func TestParseGPSMessage(t *testing.T) {
+	timeGPS := ubxFrame(0x01, 0x20, make([]byte, 16))
+	corrupt := append([]byte(nil), timeGPS...)
+	corrupt[10] ^= 0xff
+	rmc := nmeaSentence("GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W")
+	gga := nmeaSentence("GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,")
+	gsv := nmeaSentence("GPGSV,1,1,00")
+
+	tests := []struct {
+		name string
+		buf  []byte
+		msg  GPSMessage
+		size int
+	}{
+		{"UBX NAV-TIMEGPS", timeGPS, GPSUBXTimeGPS, len(timeGPS)},
+		{"UBX NAV-TIMEGPS followed by more", append(append([]byte(nil), timeGPS...), rmc...), GPSUBXTimeGPS, len(timeGPS)},
+		{"UBX other message", ubxFrame(0x01, 0x07, make([]byte, 92)), GPSIgnored, 100},
+		{"UBX header only", timeGPS[:6], GPSIncomplete, 0},
+		{"UBX truncated", timeGPS[:len(timeGPS)-1], GPSIncomplete, 0},
+		{"UBX bad checksum", corrupt, GPSInvalid, len(corrupt)},
+		{"NMEA RMC", rmc, GPSNMEARMC, len(rmc)},
+		{"NMEA GGA", gga, GPSNMEAGGA, len(gga)},
+		{"NMEA other sentence", gsv, GPSIgnored, len(gsv)},
+		{"NMEA without end of line", rmc[:len(rmc)-1], GPSIncomplete, 0},
+		{"NMEA bad checksum", []byte("$GPGSV,1,1,00*00\r\n"), GPSInvalid, 18},
+		{"garbage", []byte("xyz"), GPSUnknown, 0},
+		{"empty", nil, GPSIncomplete, 0},
+	}
+	for _, test := range tests {
+		msg, size := ParseGPSMessage(test.buf)
+		if msg != test.msg || size != test.size {
+			t.Errorf("%s: got message %d of %d bytes, expected %d of %d bytes", test.name, msg, size, test.msg, test.size)
+		}
+	}
+}
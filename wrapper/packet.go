@@ -1,5 +1,10 @@
 package wrapper
 
+import (
+	"math/bits"
+	"time"
+)
+
 type Packet struct {
 	Freq       uint32  // central frequency of the IF chain (in Hz)
 	IFChain    uint8   // by which IF chain was packet received
@@ -17,4 +22,43 @@ type Packet struct {
 	CRC        uint16  // CRC that was received in the payload
 	Size       uint32  // Payload size in bytes
 	Payload    []byte  // Buffer containing the payload, not yet base64-encoded
+	FDev       uint8   // frequency deviation in kHz (FSK only)
+	Preamble   uint16  // preamble length, in symbols for LoRa and bytes for FSK, the HAL default if 0
+	NoCRC      bool    // the packet carries no payload CRC
+	NoHeader   bool    // implicit header mode (LoRa only)
+	InvertPol  bool    // inverted IQ, i.e. downlink polarity (LoRa only)
+
+	ReceivedAt time.Time       `json:"-"` // local time at which the packet was fetched from the concentrator
+	Time       *time.Time      // UTC time of reception, if a GPS time reference is available
+	GPSTime    *time.Duration  // GPS time of reception (time since the GPS epoch), if a GPS time reference is available
+	Location   *GPSCoordinates // location of the gateway at reception, if known
+}
+
+// TxMode selects when a packet is emitted
+type TxMode uint8
+
+const (
+	TxImmediate   TxMode = iota // as soon as possible
+	TxTimestamped               // when the concentrator counter reaches TxParams.CountUS
+	TxOnGPS                     // at the GPS time TxParams.GPSTime, requires a GPS time reference
+)
+
+// TxParams holds the settings of a transmission which aren't taken from the received packet
+type TxParams struct {
+	RfPower int8          // TX power, in dBm
+	Mode    TxMode        // when to emit the packet
+	CountUS uint32        // concentrator counter value at which to emit, for TxTimestamped
+	GPSTime time.Duration // GPS time (time since the GPS epoch) at which to emit, for TxOnGPS
+
+	InvertPol bool   // emit with inverted IQ, usually the polarity of the packet
+	Preamble  uint16 // preamble length overriding the one of the packet, if not 0
+}
+
+// SpreadingFactor returns the spreading factor of a LoRa packet, 0 for other modulations
+func (p *Packet) SpreadingFactor() uint8 {
+	// LoRa datarates are DR_LORA_SF7 (0x02) to DR_LORA_SF12 (0x40)
+	if p.Modulation != ModulationLoRa || p.Datarate < 0x02 || p.Datarate > 0x40 {
+		return 0
+	}
+	return uint8(bits.TrailingZeros32(p.Datarate)) + 6
 }
@@ -0,0 +1,262 @@
+package wrapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits enforced by the HAL, mirrored here so that the configuration can be checked
+// without the concentrator
+const (
+	rfChainNb       = 2  // number of radios
+	multiSFChanNb   = 8  // number of multi-SF IF chains
+	txGainLutSize   = 16 // maximum number of entries in the TX gain table
+	lbtChannelNbMax = 8  // maximum number of LBT channels
+
+	refBandwidth      = 125000  // bandwidth of the multi-SF channels, in Hz
+	fskDatarateMin    = 500     // in bits per second
+	fskDatarateMax    = 250000  // in bits per second
+	minTxNotchFreq    = 126000  // in Hz
+	maxTxNotchFreq    = 250000  // in Hz
+	rxBandwidth125KHz = 925000  // usable radio bandwidth for 125kHz channels, in Hz
+	rxBandwidth250KHz = 1000000 // usable radio bandwidth for 250kHz channels, in Hz
+	rxBandwidth500KHz = 1100000 // usable radio bandwidth for 500kHz channels, in Hz
+)
+
+// radioBands lists the frequency range (in Hz) covered by each supported radio type
+var radioBands = map[string][2]int{
+	"SX1255": {400000000, 510000000},
+	"SX1257": {862000000, 1020000000},
+}
+
+// ConfigError is a single violation found in a configuration
+type ConfigError struct {
+	Path    string // JSON path of the offending value, e.g. SX1301_conf.chan_multiSF_2.if
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ConfigErrors lists every violation found in a configuration
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	var lines = make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type validator struct {
+	errs ConfigErrors
+}
+
+func (v *validator) fail(path string, format string, a ...interface{}) {
+	v.errs = append(v.errs, ConfigError{path, fmt.Sprintf(format, a...)})
+}
+
+// Validate checks the configuration against the constraints of the SX1301 and its
+// radios, and returns every violation found as ConfigErrors. prefix is the JSON path
+// of the configuration, prepended to the path of the violations.
+func (c *SX1301Conf) Validate(prefix string) error {
+	var v validator
+	path := func(key string) string {
+		return prefix + "." + key
+	}
+
+	radios := c.Radios()
+	radioEnabled := func(nb uint8) bool {
+		return int(nb) < len(radios) && radios[nb] != nil && radios[nb].Enabled
+	}
+
+	// Clock source
+	if c.Clksrc < 0 || c.Clksrc >= rfChainNb {
+		v.fail(path("clksrc"), "radio %d does not exist, should be 0 or 1", c.Clksrc)
+	} else if !radioEnabled(uint8(c.Clksrc)) {
+		v.fail(path("clksrc"), "radio_%d provides the clock but is not enabled", c.Clksrc)
+	}
+
+	// Radios
+	txRadio := -1
+	for i, radio := range radios {
+		if radio == nil || !radio.Enabled {
+			continue
+		}
+		key := fmt.Sprintf("radio_%d", i)
+		validateRadio(&v, path(key), radio)
+		if radio.TxEnabled {
+			if txRadio >= 0 {
+				v.fail(path(key)+".tx_enable", "radio_%d is already TX enabled, only one radio can transmit", txRadio)
+			} else {
+				txRadio = i
+			}
+		}
+	}
+
+	// Multi-SF channels
+	for i, channel := range c.MultiSFChannels() {
+		if channel == nil || !channel.Enabled {
+			continue
+		}
+		key := path(fmt.Sprintf("chan_multiSF_%d", i))
+		if i >= multiSFChanNb {
+			v.fail(key, "only %d multi-SF channels are available (chan_multiSF_0 to chan_multiSF_%d)", multiSFChanNb, multiSFChanNb-1)
+			continue
+		}
+		validateChannelRadio(&v, key, channel, radioEnabled)
+		validateIfOffset(&v, key, channel.IfValue, refBandwidth)
+	}
+
+	// LoRa standard channel
+	if channel := c.LoraSTDChannel; channel != nil && channel.Enabled {
+		key := path("chan_Lora_std")
+		validateChannelRadio(&v, key, channel, radioEnabled)
+		if channel.Bandwidth == nil {
+			v.fail(key+".bandwidth", "missing, should be 125000, 250000 or 500000")
+		} else {
+			switch *channel.Bandwidth {
+			case 125000, 250000, 500000:
+				validateIfOffset(&v, key, channel.IfValue, *channel.Bandwidth)
+			default:
+				v.fail(key+".bandwidth", "%d Hz is not supported, should be 125000, 250000 or 500000", *channel.Bandwidth)
+			}
+		}
+		if channel.SpreadFactor == nil {
+			v.fail(key+".spread_factor", "missing, should be between 7 and 12")
+		} else if *channel.SpreadFactor < 7 || *channel.SpreadFactor > 12 {
+			v.fail(key+".spread_factor", "%d is not supported, should be between 7 and 12", *channel.SpreadFactor)
+		}
+	}
+
+	// FSK channel
+	if channel := c.FSKChannel; channel != nil && channel.Enabled {
+		key := path("chan_FSK")
+		validateChannelRadio(&v, key, channel, radioEnabled)
+		if channel.Bandwidth == nil || *channel.Bandwidth == 0 || *channel.Bandwidth > 500000 {
+			v.fail(key+".bandwidth", "should be set, between 1 and 500000 Hz")
+		} else {
+			validateIfOffset(&v, key, channel.IfValue, *channel.Bandwidth)
+		}
+		if channel.Datarate == nil || *channel.Datarate < fskDatarateMin || *channel.Datarate > fskDatarateMax {
+			v.fail(key+".datarate", "should be set, between %d and %d bps", fskDatarateMin, fskDatarateMax)
+		} else if channel.FDev == nil && *channel.Datarate/2000 == 0 {
+			v.fail(key+".f_dev", "missing, and the %d bps datarate is too low to derive it", *channel.Datarate)
+		}
+		if channel.FDev != nil && *channel.FDev == 0 {
+			v.fail(key+".f_dev", "should be at least 1 kHz")
+		}
+	}
+
+	// TX gain table
+	validateTxLuts(&v, prefix, c.TxLuts())
+
+	// Listen-before-talk
+	if lbt := c.LbtConfig; lbt != nil && lbt.Enabled {
+		key := path("lbt_cfg")
+		if len(lbt.ChannelsConfig) == 0 || len(lbt.ChannelsConfig) > lbtChannelNbMax {
+			v.fail(key+".chan_cfg", "%d channels configured, should be between 1 and %d", len(lbt.ChannelsConfig), lbtChannelNbMax)
+		}
+		for i, channel := range lbt.ChannelsConfig {
+			if channel.ScanTime != 128 && channel.ScanTime != 5000 {
+				v.fail(fmt.Sprintf("%s.chan_cfg[%d].scan_time_us", key, i), "%d µs is not supported, should be 128 or 5000", channel.ScanTime)
+			}
+		}
+	}
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+func validateRadio(v *validator, key string, radio *RadioConf) {
+	band, ok := radioBands[radio.RadioType]
+	if !ok {
+		v.fail(key+".type", "invalid radio type %q, should be SX1255 or SX1257", radio.RadioType)
+		return
+	}
+	inBand := func(freq int) bool {
+		return freq >= band[0] && freq <= band[1]
+	}
+
+	if !inBand(radio.Freq) {
+		v.fail(key+".freq", "%d Hz is outside the %s band (%d-%d Hz)", radio.Freq, radio.RadioType, band[0], band[1])
+	}
+	if !radio.TxEnabled {
+		return
+	}
+	if radio.TxMinFreq != nil && !inBand(*radio.TxMinFreq) {
+		v.fail(key+".tx_freq_min", "%d Hz is outside the %s band (%d-%d Hz)", *radio.TxMinFreq, radio.RadioType, band[0], band[1])
+	}
+	if radio.TxMaxFreq != nil && !inBand(*radio.TxMaxFreq) {
+		v.fail(key+".tx_freq_max", "%d Hz is outside the %s band (%d-%d Hz)", *radio.TxMaxFreq, radio.RadioType, band[0], band[1])
+	}
+	if radio.TxMinFreq != nil && radio.TxMaxFreq != nil && *radio.TxMinFreq >= *radio.TxMaxFreq {
+		v.fail(key+".tx_freq_max", "%d Hz should be above tx_freq_min (%d Hz)", *radio.TxMaxFreq, *radio.TxMinFreq)
+	}
+	if radio.TxNotchFreq != nil && (*radio.TxNotchFreq < minTxNotchFreq || *radio.TxNotchFreq > maxTxNotchFreq) {
+		v.fail(key+".tx_notch_freq", "%d Hz is out of range, should be between %d and %d Hz", *radio.TxNotchFreq, minTxNotchFreq, maxTxNotchFreq)
+	}
+}
+
+func validateChannelRadio(v *validator, key string, channel *ChannelConf, radioEnabled func(uint8) bool) {
+	if channel.Radio >= rfChainNb {
+		v.fail(key+".radio", "radio %d does not exist, should be 0 or 1", channel.Radio)
+	} else if !radioEnabled(channel.Radio) {
+		v.fail(key+".radio", "radio_%d is not enabled", channel.Radio)
+	}
+}
+
+// validateIfOffset checks that a channel of the given bandwidth, centered on the IF
+// offset, fits in the bandwidth the radio can receive
+func validateIfOffset(v *validator, key string, ifValue int32, bandwidth uint32) {
+	var rxBandwidth int32
+	switch {
+	case bandwidth <= 125000:
+		rxBandwidth = rxBandwidth125KHz
+	case bandwidth <= 250000:
+		rxBandwidth = rxBandwidth250KHz
+	default:
+		rxBandwidth = rxBandwidth500KHz
+	}
+
+	limit := rxBandwidth/2 - int32(bandwidth)/2
+	if ifValue > limit || ifValue < -limit {
+		v.fail(key+".if", "%d Hz is out of the radio bandwidth, a %d Hz channel should be within ±%d Hz", ifValue, bandwidth, limit)
+	}
+}
+
+func validateTxLuts(v *validator, prefix string, luts []*GainTableConf) {
+	var previous *GainTableConf
+	var count int
+	for i, lut := range luts {
+		if lut == nil {
+			continue
+		}
+		key := fmt.Sprintf("%s.tx_lut_%d", prefix, i)
+		count++
+		if lut.PaGain > 3 {
+			v.fail(key+".pa_gain", "%d is out of range, should be between 0 and 3", lut.PaGain)
+		}
+		if lut.MixGain > 15 {
+			v.fail(key+".mix_gain", "%d is out of range, should be between 0 and 15", lut.MixGain)
+		}
+		if lut.DigGain > 3 {
+			v.fail(key+".dig_gain", "%d is out of range, should be between 0 and 3", lut.DigGain)
+		}
+		if lut.DacGain != nil && *lut.DacGain > 3 {
+			v.fail(key+".dac_gain", "%d is out of range, should be between 0 and 3", *lut.DacGain)
+		}
+		if previous != nil && lut.RfPower <= previous.RfPower {
+			v.fail(key+".rf_power", "%d dBm is not above the previous entry (%d dBm), entries should be sorted by increasing power", lut.RfPower, previous.RfPower)
+		}
+		previous = lut
+	}
+	// The HAL refuses an empty table, there is no room for more than the tx_lut_* keys
+	if count == 0 {
+		v.fail(prefix+".tx_lut_0", "the TX gain table is empty, it should have between 1 and %d entries", txGainLutSize)
+	}
+}
@@ -0,0 +1,146 @@
+package wrapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	u8 := func(v uint8) *uint8 { return &v }
+	u32 := func(v uint32) *uint32 { return &v }
+	integer := func(v int) *int { return &v }
+
+	tests := []struct {
+		name   string
+		change func(c *SX1301Conf)
+		paths  []string
+	}{
+		{"default", func(c *SX1301Conf) {}, nil},
+
+		// Clock source and radios
+		{"clock radio", func(c *SX1301Conf) { c.Clksrc = 2 }, []string{"clksrc"}},
+		{
+			"clock radio disabled",
+			func(c *SX1301Conf) {
+				c.Radio1.Enabled = false
+				c.ClearChannels()
+			},
+			[]string{"clksrc"},
+		},
+		{"radio type", func(c *SX1301Conf) { c.Radio0.RadioType = "SX1250" }, []string{"radio_0.type"}},
+		{"radio band", func(c *SX1301Conf) { c.Radio1.Freq = 433000000 }, []string{"radio_1.freq"}},
+		{"SX1255 band", func(c *SX1301Conf) { c.Radio1.RadioType = "SX1255" }, []string{"radio_1.freq"}},
+		{"two TX radios", func(c *SX1301Conf) { c.Radio1.TxEnabled = true }, []string{"radio_1.tx_enable"}},
+		{"TX band", func(c *SX1301Conf) { c.Radio0.TxMinFreq = integer(800000000) }, []string{"radio_0.tx_freq_min"}},
+		{"TX range", func(c *SX1301Conf) { c.Radio0.TxMaxFreq = integer(919000000) }, []string{"radio_0.tx_freq_max"}},
+		{"TX range of a receiver", func(c *SX1301Conf) { c.Radio1.TxMinFreq = integer(800000000) }, nil},
+		{"notch", func(c *SX1301Conf) { c.Radio0.TxNotchFreq = integer(100000) }, []string{"radio_0.tx_notch_freq"}},
+
+		// Channels
+		{"channel radio", func(c *SX1301Conf) { c.MultiSFChan0.Radio = 2 }, []string{"chan_multiSF_0.radio"}},
+		{
+			"channel radio disabled",
+			func(c *SX1301Conf) { c.Radio0.Enabled = false },
+			[]string{"chan_multiSF_0.radio", "chan_multiSF_1.radio", "chan_multiSF_2.radio", "chan_multiSF_3.radio"},
+		},
+		{"channel IF", func(c *SX1301Conf) { c.MultiSFChan3.IfValue = -400001 }, []string{"chan_multiSF_3.if"}},
+		{"channel IF limit", func(c *SX1301Conf) { c.MultiSFChan3.IfValue = -400000 }, nil},
+		{"disabled channel", func(c *SX1301Conf) { c.MultiSFChan3.Enabled = false; c.MultiSFChan3.Radio = 5 }, nil},
+		{"ninth multi-SF channel", func(c *SX1301Conf) { c.MultiSFChan8 = &ChannelConf{Enabled: true} }, []string{"chan_multiSF_8"}},
+		{
+			"LoRa standard channel",
+			func(c *SX1301Conf) {
+				c.LoraSTDChannel = &ChannelConf{Enabled: true, Bandwidth: u32(250000), SpreadFactor: u8(7), IfValue: 375000}
+			},
+			nil,
+		},
+		{
+			"LoRa standard channel IF",
+			func(c *SX1301Conf) {
+				c.LoraSTDChannel = &ChannelConf{Enabled: true, Bandwidth: u32(250000), SpreadFactor: u8(7), IfValue: 375001}
+			},
+			[]string{"chan_Lora_std.if"},
+		},
+		{
+			"LoRa standard channel settings",
+			func(c *SX1301Conf) {
+				c.LoraSTDChannel = &ChannelConf{Enabled: true, Bandwidth: u32(200000), SpreadFactor: u8(6)}
+			},
+			[]string{"chan_Lora_std.bandwidth", "chan_Lora_std.spread_factor"},
+		},
+		{
+			"LoRa standard channel without settings",
+			func(c *SX1301Conf) { c.LoraSTDChannel = &ChannelConf{Enabled: true} },
+			[]string{"chan_Lora_std.bandwidth", "chan_Lora_std.spread_factor"},
+		},
+		{
+			"FSK channel",
+			func(c *SX1301Conf) {
+				c.FSKChannel = &ChannelConf{Enabled: true, Bandwidth: u32(125000), Datarate: u32(50000)}
+			},
+			nil,
+		},
+		{
+			"FSK channel settings",
+			func(c *SX1301Conf) {
+				c.FSKChannel = &ChannelConf{Enabled: true, Bandwidth: u32(600000), Datarate: u32(300000), FDev: u8(0)}
+			},
+			[]string{"chan_FSK.bandwidth", "chan_FSK.datarate", "chan_FSK.f_dev"},
+		},
+		{
+			"FSK deviation",
+			func(c *SX1301Conf) {
+				c.FSKChannel = &ChannelConf{Enabled: true, Bandwidth: u32(125000), Datarate: u32(1000)}
+			},
+			[]string{"chan_FSK.f_dev"},
+		},
+
+		// TX gain table
+		{
+			"gains",
+			func(c *SX1301Conf) {
+				c.TxLut2 = &GainTableConf{PaGain: 4, MixGain: 16, RfPower: 4, DigGain: 4, DacGain: u8(4)}
+			},
+			[]string{"tx_lut_2.pa_gain", "tx_lut_2.mix_gain", "tx_lut_2.dig_gain", "tx_lut_2.dac_gain"},
+		},
+		{"unsorted", func(c *SX1301Conf) { c.TxLut5.RfPower = 7 }, []string{"tx_lut_5.rf_power"}},
+		{"gap", func(c *SX1301Conf) { c.TxLut5 = nil }, nil},
+		{"single entry", func(c *SX1301Conf) { c.ClearTxLuts(); c.TxLut15 = &GainTableConf{RfPower: 14} }, nil},
+		{"empty", func(c *SX1301Conf) { c.ClearTxLuts() }, []string{"tx_lut_0"}},
+
+		// Listen-before-talk
+		{
+			"LBT",
+			func(c *SX1301Conf) {
+				c.LbtConfig = &LbtConf{Enabled: true, ChannelsConfig: []ChannelFreqConf{{922200000, 128}, {922400000, 5000}}}
+			},
+			nil,
+		},
+		{"LBT without channels", func(c *SX1301Conf) { c.LbtConfig = &LbtConf{Enabled: true} }, []string{"lbt_cfg.chan_cfg"}},
+		{
+			"LBT scan time",
+			func(c *SX1301Conf) {
+				c.LbtConfig = &LbtConf{Enabled: true, ChannelsConfig: []ChannelFreqConf{{922200000, 128}, {922400000, 1000}}}
+			},
+			[]string{"lbt_cfg.chan_cfg[1].scan_time_us"},
+		},
+		{"LBT disabled", func(c *SX1301Conf) { c.LbtConfig = &LbtConf{} }, nil},
+	}
+	for _, test := range tests {
+		conf := DefaultSX1301Conf()
+		test.change(&conf)
+		var paths []string
+		if err := conf.Validate("SX1301_conf"); err != nil {
+			for _, err := range err.(ConfigErrors) {
+				paths = append(paths, err.Path)
+			}
+		}
+		var expected []string
+		for _, path := range test.paths {
+			expected = append(expected, "SX1301_conf."+path)
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%s: errors on %v, expected %v", test.name, paths, expected)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Kinds of the errors reported by a worker, which are rebuilt as such by its client
+const (
+	workerHALError = "hal"
+	workerLBTError = "lbt"
+)
+
+// workerRequest is a call on the concentrator of a worker. Only the arguments of the
+// method are set.
+type workerRequest struct {
+	ID     uint64
+	Method string
+
+	Clksrc        uint             `json:",omitempty"`
+	LorawanPublic bool             `json:",omitempty"`
+	TxLuts        []*GainTableConf `json:",omitempty"`
+	Radios        []*RadioConf     `json:",omitempty"`
+	Channels      []*ChannelConf   `json:",omitempty"`
+	Channel       *ChannelConf     `json:",omitempty"`
+	LBT           *LbtConf         `json:",omitempty"`
+	Packet        *Packet          `json:",omitempty"`
+	ReceivedAt    time.Time        `json:",omitzero"` // of Packet, which isn't encoded with it
+	Params        *TxParams        `json:",omitempty"`
+	Timeout       time.Duration    `json:",omitempty"`
+	UTC           time.Duration    `json:",omitempty"` // since the Unix epoch
+	GPSTime       time.Duration    `json:",omitempty"` // since the GPS epoch
+}
+
+// workerResponse is the result of a call, along with the ID of its request
+type workerResponse struct {
+	ID    uint64
+	Error string `json:",omitempty"`
+	Kind  string `json:",omitempty"` // of the error, see workerHALError
+
+	Packets    []Packet  `json:",omitempty"`
+	ReceivedAt time.Time `json:",omitzero"` // of Packets
+	Status     string    `json:",omitempty"`
+}
+
+func (r *workerResponse) setError(err error) {
+	if err == nil {
+		return
+	}
+	r.Error = err.Error()
+	var halErr *HALError
+	switch {
+	case errors.As(err, &halErr):
+		r.Kind = workerHALError
+	case errors.Is(err, ErrLBT):
+		r.Kind = workerLBTError
+	}
+}
+
+func (r *workerResponse) err() error {
+	switch {
+	case r.Error == "":
+		return nil
+	case r.Kind == workerHALError:
+		return &HALError{r.Error}
+	case r.Kind == workerLBTError:
+		return ErrLBT
+	}
+	return errors.New(r.Error)
+}
+
+// worker is the client of a process driving a board, see StartWorker. The calls are
+// sent as JSON requests, one per line, and can be pending at the same time, e.g.
+// Receive while waiting for an emission to end.
+type worker struct {
+	cmd   *exec.Cmd // nil if the worker isn't a process of its own
+	input io.WriteCloser
+
+	encMutex sync.Mutex
+	enc      *json.Encoder
+
+	mutex   sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan workerResponse
+	failure error // set once the worker can't be reached anymore
+}
+
+// StartWorker runs the worker at path with args, e.g. the repeater with its board
+// command, and returns a handle on the board it drives. The worker serves the calls on
+// its standard input and output with ServeWorker, its standard error is the one of
+// this process.
+func StartWorker(path string, args ...string) (*Concentrator, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = os.Stderr
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to start the board worker %s: %v", path, err)
+	}
+	w := newWorker(output, input)
+	w.cmd = cmd
+	return &Concentrator{worker: w}, nil
+}
+
+// newWorker reads the responses to the requests written to input from output
+func newWorker(output io.Reader, input io.WriteCloser) *worker {
+	w := &worker{
+		input:   input,
+		enc:     json.NewEncoder(input),
+		pending: make(map[uint64]chan workerResponse),
+	}
+	go w.readResponses(output)
+	return w
+}
+
+func (w *worker) readResponses(output io.Reader) {
+	dec := json.NewDecoder(output)
+	for {
+		var resp workerResponse
+		if err := dec.Decode(&resp); err != nil {
+			if err == io.EOF {
+				err = errors.New("exited")
+			}
+			w.fail(err)
+			return
+		}
+		w.mutex.Lock()
+		respc, ok := w.pending[resp.ID]
+		delete(w.pending, resp.ID)
+		w.mutex.Unlock()
+		if ok {
+			respc <- resp
+		}
+	}
+}
+
+// fail fails the pending calls and the next ones. The error isn't a HALError: the
+// board can't be restarted without its worker.
+func (w *worker) fail(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.failure != nil {
+		return
+	}
+	w.failure = fmt.Errorf("Board worker failed: %v", err)
+	for id, respc := range w.pending {
+		close(respc)
+		delete(w.pending, id)
+	}
+}
+
+// call sends the request and waits for its response
+func (w *worker) call(req workerRequest) (workerResponse, error) {
+	respc := make(chan workerResponse, 1)
+	w.mutex.Lock()
+	if w.failure != nil {
+		w.mutex.Unlock()
+		return workerResponse{}, w.failure
+	}
+	w.nextID++
+	req.ID = w.nextID
+	w.pending[req.ID] = respc
+	w.mutex.Unlock()
+
+	w.encMutex.Lock()
+	err := w.enc.Encode(req)
+	w.encMutex.Unlock()
+	if err != nil {
+		w.fail(err)
+	}
+
+	resp, ok := <-respc
+	if !ok {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		return resp, w.failure
+	}
+	return resp, resp.err()
+}
+
+// do is call for the methods which only return an error
+func (w *worker) do(req workerRequest) error {
+	_, err := w.call(req)
+	return err
+}
+
+// receive fetches the packets the board received, reported at location if known
+func (w *worker) receive(location GPSCoordinates, located bool) ([]Packet, error) {
+	resp, err := w.call(workerRequest{Method: "Receive"})
+	if err != nil {
+		return nil, err
+	}
+	for i := range resp.Packets {
+		resp.Packets[i].ReceivedAt = resp.ReceivedAt
+		if located {
+			coordinates := location
+			resp.Packets[i].Location = &coordinates
+		}
+	}
+	return resp.Packets, nil
+}
+
+// close ends the input of the worker, which then exits
+func (w *worker) close() error {
+	err := w.input.Close()
+	if w.cmd != nil {
+		if waitErr := w.cmd.Wait(); waitErr != nil && err == nil {
+			err = fmt.Errorf("Board worker failed: %v", waitErr)
+		}
+	}
+	return err
+}
+
+// ServeWorker drives the board of this process for the client writing the requests to
+// r, and writes the responses to w, until r is exhausted. Nothing else may be written
+// to w meanwhile.
+func ServeWorker(r io.Reader, w io.Writer) error {
+	c, err := Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var encMutex sync.Mutex
+	enc := json.NewEncoder(w)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	dec := json.NewDecoder(r)
+	for {
+		var req workerRequest
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// The client serializes the calls which depend on each other
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := c.serve(req)
+			resp.ID = req.ID
+			encMutex.Lock()
+			defer encMutex.Unlock()
+			if err := enc.Encode(resp); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to answer the repeater:", err)
+			}
+		}()
+	}
+}
+
+// serve calls the method of the request on the board
+func (c *Concentrator) serve(req workerRequest) workerResponse {
+	var resp workerResponse
+	var err error
+	switch req.Method {
+	case "SetBoardConf":
+		err = c.SetBoardConf(req.Clksrc, req.LorawanPublic)
+	case "SetTXGainConf":
+		err = c.SetTXGainConf(req.TxLuts)
+	case "SetRFChannels":
+		err = c.SetRFChannels(req.Radios)
+	case "SetSFChannels":
+		err = c.SetSFChannels(req.Channels)
+	case "SetStandardChannel", "SetFSKChannel", "SetLBTConf", "SendPacket":
+		err = c.serveWithArgument(req)
+	case "Start":
+		err = c.Start()
+	case "Stop":
+		err = c.Stop()
+	case "Receive":
+		resp.Packets, err = c.Receive()
+		if len(resp.Packets) > 0 {
+			resp.ReceivedAt = resp.Packets[0].ReceivedAt
+		}
+	case "WaitForConcentrator":
+		err = c.WaitForConcentrator(req.Timeout)
+	case "TxStatus":
+		resp.Status, err = c.TxStatus()
+	case "SyncGPSTime":
+		err = c.syncGPSTimeFrom(req.UTC, req.GPSTime)
+	default:
+		err = fmt.Errorf("Unknown board worker method %q", req.Method)
+	}
+	resp.setError(err)
+	return resp
+}
+
+// serveWithArgument calls the methods taking a structure, which the request must hold
+func (c *Concentrator) serveWithArgument(req workerRequest) error {
+	switch {
+	case req.Method == "SetStandardChannel" && req.Channel != nil:
+		return c.SetStandardChannel(*req.Channel)
+	case req.Method == "SetFSKChannel" && req.Channel != nil:
+		return c.SetFSKChannel(*req.Channel)
+	case req.Method == "SetLBTConf" && req.LBT != nil:
+		return c.SetLBTConf(*req.LBT)
+	case req.Method == "SendPacket" && req.Packet != nil && req.Params != nil:
+		pkt := *req.Packet
+		pkt.ReceivedAt = req.ReceivedAt
+		return c.SendPacket(pkt, *req.Params)
+	}
+	return fmt.Errorf("Missing argument of board worker method %q", req.Method)
+}
@@ -0,0 +1,123 @@
+package wrapper
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// serveWorker returns a handle on a worker served by this process through pipes, and
+// the result of ServeWorker once the handle is closed
+func serveWorker() (*Concentrator, chan error) {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeWorker(reqR, respW)
+		respW.Close()
+	}()
+	return &Concentrator{worker: newWorker(respR, reqW)}, served
+}
+
+func TestWorker(t *testing.T) {
+	c, served := serveWorker()
+	conf := DefaultSX1301Conf()
+	u32 := func(v uint32) *uint32 { return &v }
+
+	// Configuration and start
+	if err := c.SetBoardConf(uint(conf.Clksrc), conf.LorawanPublic); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetTXGainConf(conf.TxLuts()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetRFChannels(conf.Radios()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSFChannels(conf.MultiSFChannels()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetStandardChannel(ChannelConf{Enabled: true, Bandwidth: u32(250000), Datarate: u32(7)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetFSKChannel(ChannelConf{Enabled: true}); err == nil || isHALError(err) {
+		t.Errorf("FSK channel without bandwidth configured: %v", err)
+	}
+	if err := c.SetFSKChannel(ChannelConf{Enabled: true, Bandwidth: u32(125000), Datarate: u32(50000)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetLBTConf(LbtConf{Enabled: true, ChannelsConfig: []ChannelFreqConf{{922200000, 128}}}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.LBTEnabled() {
+		t.Error("LBT not enabled")
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The packets are reported at the location of the handle, with their reception time
+	location := GPSCoordinates{Latitude: 35.6, Longitude: 139.7, Altitude: 40}
+	c.SetLocation(location)
+	t.Setenv("STUB_RX_ONE", "1")
+	packets, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 {
+		t.Fatalf("Received %d packets, expected 1", len(packets))
+	}
+	pkt := packets[0]
+	if pkt.Freq != 922100000 || pkt.SpreadingFactor() != 7 || len(pkt.Payload) != 2 {
+		t.Errorf("Received %+v", pkt)
+	}
+	if pkt.Location == nil || *pkt.Location != location {
+		t.Errorf("Received at %v, expected %v", pkt.Location, location)
+	}
+	if time.Since(pkt.ReceivedAt) > time.Second {
+		t.Errorf("Received at %v", pkt.ReceivedAt)
+	}
+	t.Setenv("STUB_RX_FAIL", "1")
+	if _, err := c.Receive(); !isHALError(err) {
+		t.Errorf("Failed reception returned %v", err)
+	}
+
+	// Emission, the errors keeping their kind
+	params := TxParams{RfPower: 14, Mode: TxImmediate}
+	if err := c.SendPacket(pkt, params); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForConcentrator(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := c.TxStatus(); err != nil || status != "free" {
+		t.Errorf("TX status %q, %v", status, err)
+	}
+	t.Setenv("STUB_LBT_BUSY", "1")
+	if err := c.SendPacket(pkt, params); !errors.Is(err, ErrLBT) {
+		t.Errorf("Emission on a busy channel returned %v", err)
+	}
+	fsk := pkt
+	fsk.Modulation = ModulationFSK
+	if err := c.SendPacket(fsk, params); err == nil || isHALError(err) || errors.Is(err, ErrLBT) {
+		t.Errorf("FSK packet without deviation returned %v", err)
+	}
+
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+	// Once the worker exited, the calls fail for good, without asking for a restart
+	if err := c.Start(); err == nil || isHALError(err) {
+		t.Errorf("Call on a closed worker returned %v", err)
+	}
+}
+
+func isHALError(err error) bool {
+	var halErr *HALError
+	return errors.As(err, &halErr)
+}
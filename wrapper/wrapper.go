@@ -19,8 +19,98 @@ import (
 
 const NbMaxPackets = 8
 
-// Lock to prevent concentrator conflict
-var concentratorMutex = &sync.Mutex{}
+// maxStatusFailures is how many consecutive failures to read the TX status are
+// tolerated while waiting for the concentrator
+const maxStatusFailures = 100
+
+// HALError reports a failure of the HAL or of the concentrator itself, as opposed to
+// an invalid packet. The concentrator may need to be restarted to recover from it.
+type HALError struct {
+	msg string
+}
+
+func (e *HALError) Error() string {
+	return e.msg
+}
+
+// ErrLBT is returned when listen-before-talk found the channel busy, and the packet
+// wasn't emitted
+var ErrLBT = errors.New("Channel busy, emission cancelled by LBT")
+
+// LBTTxDelay is how far ahead immediate emissions are scheduled when LBT is enabled,
+// leaving the concentrator time to scan the channel
+const LBTTxDelay = 20 * time.Millisecond
+
+// Modulations of a Packet
+const (
+	ModulationLoRa = C.MOD_LORA
+	ModulationFSK  = C.MOD_FSK
+)
+
+// Status of a received Packet
+const (
+	StatusNoCRC  = C.STAT_NO_CRC
+	StatusCRCBad = C.STAT_CRC_BAD
+	StatusCRCOK  = C.STAT_CRC_OK
+)
+
+// Concentrator is a handle on an SX1301 board, through which it is configured, started
+// and used. It keeps the settings of the board the HAL doesn't report, and serializes
+// the HAL calls on the board.
+//
+// libloragw keeps the state of the board in global variables, and talks to the SPI
+// device chosen when it is built: a process can only drive one board, and Open fails
+// while another handle is open. Other boards are driven by worker processes, see
+// StartWorker, their handles passing the calls on to them.
+type Concentrator struct {
+	mutex  sync.Mutex // held during the HAL calls on the board
+	worker *worker    // process driving the board, nil for the board of this process
+
+	// fskFDev is the frequency deviation (in kHz) of the packets received on the FSK
+	// channel, which the concentrator doesn't report
+	fskFDev uint8
+	// lbtEnabled is set once LBT is configured, only changed while the concentrator is stopped
+	lbtEnabled bool
+
+	// GPS time reference of the counter of the board, which timestamps received packets
+	gpsMutex sync.Mutex
+	gpsRef   C.struct_tref
+	gpsValid bool
+	location *GPSCoordinates // of the board, reported with the packets it receives
+}
+
+// ErrConcentratorOpen is returned by Open while another concentrator is open
+var ErrConcentratorOpen = errors.New("A concentrator is already open, libloragw drives only one per process")
+
+var openMutex sync.Mutex
+var openConcentrator *Concentrator
+
+// Open returns a handle on the concentrator, to configure and start it
+func Open() (*Concentrator, error) {
+	openMutex.Lock()
+	defer openMutex.Unlock()
+	if openConcentrator != nil {
+		return nil, ErrConcentratorOpen
+	}
+	openConcentrator = &Concentrator{}
+	return openConcentrator, nil
+}
+
+// Close releases the handle, once the concentrator is stopped. The worker driving the
+// board, if any, exits.
+func (c *Concentrator) Close() {
+	if c.worker != nil {
+		if err := c.worker.close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+	openMutex.Lock()
+	defer openMutex.Unlock()
+	if openConcentrator == c {
+		openConcentrator = nil
+	}
+}
 
 var loraChannelBandwidths = map[uint32]C.uint8_t{
 	7800:   C.BW_7K8HZ,
@@ -49,7 +139,13 @@ var loraChannelSpreadingFactors = map[uint32]C.uint32_t{
 ============================
 */
 
-func SetBoardConf(clksrc uint, lorawan_public bool) error {
+// SetBoardConf sets the clock source and the LoRaWAN sync word of the board
+func (c *Concentrator) SetBoardConf(clksrc uint, lorawan_public bool) error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "SetBoardConf", Clksrc: clksrc, LorawanPublic: lorawan_public})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	var boardConf = C.struct_lgw_conf_board_s{
 		clksrc:         C.uint8_t(clksrc),
 		lorawan_public: C.bool(lorawan_public),
@@ -61,9 +157,14 @@ func SetBoardConf(clksrc uint, lorawan_public bool) error {
 	return nil
 }
 
-// StartLoRaGateway wraps the HAL function to start the concentrator once configured
-func StartLoRaGateway() error {
+// Start wraps the HAL function to start the concentrator once configured
+func (c *Concentrator) Start() error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "Start"})
+	}
+	c.mutex.Lock()
 	state := C.lgw_start()
+	c.mutex.Unlock()
 
 	if state != C.LGW_HAL_SUCCESS {
 		return errors.New("Failed to start concentrator")
@@ -71,9 +172,14 @@ func StartLoRaGateway() error {
 	return nil
 }
 
-// StopLoRaGateway wraps the HAL function to stop the concentrator once started
-func StopLoRaGateway() error {
+// Stop wraps the HAL function to stop the concentrator once started
+func (c *Concentrator) Stop() error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "Stop"})
+	}
+	c.mutex.Lock()
 	state := C.lgw_stop()
+	c.mutex.Unlock()
 
 	if state != C.LGW_HAL_SUCCESS {
 		return errors.New("Failed to stop concentrator gracefully")
@@ -101,17 +207,28 @@ func prepareTXLut(txLut *C.struct_lgw_tx_gain_s, txConf GainTableConf) {
 	txLut.dig_gain = C.uint8_t(txConf.DigGain)
 }
 
-// SetTXGainConf prepares, and then sends the configuration of the TX Gain LUT to the concentrator
-func SetTXGainConf() error {
-	txLuts := GetLuts()
+// SetTXGainConf prepares, and then sends the configuration of the TX Gain LUT to the concentrator.
+// Missing entries are skipped.
+func (c *Concentrator) SetTXGainConf(txLuts []*GainTableConf) error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "SetTXGainConf", TxLuts: txLuts})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	var gainLut = C.struct_lgw_tx_gain_lut_s{
 		size: 0,
 		lut:  [C.TX_GAIN_LUT_SIZE_MAX]C.struct_lgw_tx_gain_s{},
 	}
-	for i, txLut := range txLuts {
-		prepareTXLut(&gainLut.lut[i], txLut)
+	for _, txLut := range txLuts {
+		if txLut == nil {
+			continue
+		}
+		if gainLut.size >= C.TX_GAIN_LUT_SIZE_MAX {
+			return errors.New("Too many entries in the TX Gain LUT")
+		}
+		prepareTXLut(&gainLut.lut[gainLut.size], *txLut)
+		gainLut.size++
 	}
-	gainLut.size = C.uint8_t(len(txLuts))
 
 	if C.lgw_txgain_setconf(&gainLut) != C.LGW_HAL_SUCCESS {
 		return errors.New("Failed to configure concentrator TX Gain LUT")
@@ -169,9 +286,17 @@ func enableRadio(radio RadioConf, nb uint8) error {
 }
 
 // SetRFChannels send the configuration of the radios to the concentrator
-func SetRFChannels() error {
-	for i, radio := range GetRFConfs() {
-		err := enableRadio(radio, uint8(i))
+func (c *Concentrator) SetRFChannels(radios []*RadioConf) error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "SetRFChannels", Radios: radios})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, radio := range radios {
+		if radio == nil {
+			continue
+		}
+		err := enableRadio(*radio, uint8(i))
 		if err != nil {
 			return err
 		}
@@ -205,9 +330,17 @@ func enableSFChannel(channelConf ChannelConf, nb uint8) error {
 }
 
 // SetSFChannels enables the different SF channels
-func SetSFChannels() error {
-	for i, sfChannel := range GetMultiSFChannels() {
-		err := enableSFChannel(sfChannel, uint8(i))
+func (c *Concentrator) SetSFChannels(sfChannels []*ChannelConf) error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "SetSFChannels", Channels: sfChannels})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, sfChannel := range sfChannels {
+		if sfChannel == nil {
+			continue
+		}
+		err := enableSFChannel(*sfChannel, uint8(i))
 		if err != nil {
 			return err
 		}
@@ -249,7 +382,12 @@ func initLoRaStdChannel(stdChan ChannelConf) C.struct_lgw_conf_rxif_s {
 }
 
 // SetStandardChannel enables the LoRa standard channel from the configuration
-func SetStandardChannel(stdChan ChannelConf) error {
+func (c *Concentrator) SetStandardChannel(stdChan ChannelConf) error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "SetStandardChannel", Channel: &stdChan})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if !stdChan.Enabled {
 		return nil
 	}
@@ -263,7 +401,12 @@ func SetStandardChannel(stdChan ChannelConf) error {
 }
 
 // SetFSKChannel sets the FSK Channel configuration on the concentrator
-func SetFSKChannel(fskChan ChannelConf) error {
+func (c *Concentrator) SetFSKChannel(fskChan ChannelConf) error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "SetFSKChannel", Channel: &fskChan})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if !fskChan.Enabled {
 		return nil
 	}
@@ -302,9 +445,63 @@ func SetFSKChannel(fskChan ChannelConf) error {
 	if C.lgw_rxif_setconf(9, cFSKChan) != C.LGW_HAL_SUCCESS {
 		return errors.New("Configuration for FSK channel failed")
 	}
+
+	// The frequency deviation is only needed to repeat the packets
+	switch {
+	case fskChan.FDev != nil:
+		c.fskFDev = *fskChan.FDev
+	case fskChan.Datarate != nil:
+		c.fskFDev = uint8(*fskChan.Datarate / 2000)
+	}
 	return nil
 }
 
+/*
+============================
+|                          |
+|   LISTEN-BEFORE-TALK     |
+|                          |
+============================
+*/
+
+// SetLBTConf configures listen-before-talk: before each emission, the concentrator
+// checks that the RSSI on the channel stays below the target for the scan time
+func (c *Concentrator) SetLBTConf(lbt LbtConf) error {
+	if c.worker != nil {
+		if err := c.worker.do(workerRequest{Method: "SetLBTConf", LBT: &lbt}); err != nil {
+			return err
+		}
+		c.lbtEnabled = lbt.Enabled
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var cLbt = C.struct_lgw_conf_lbt_s{
+		enable:      C.bool(lbt.Enabled),
+		rssi_target: C.int8_t(lbt.RssiTarget),
+		rssi_offset: C.int8_t(lbt.RssiOffset),
+	}
+	if len(lbt.ChannelsConfig) > C.LGW_LBT_CHANNEL_NB_MAX {
+		return errors.New("Too many LBT channels")
+	}
+	for i, channel := range lbt.ChannelsConfig {
+		cLbt.channels[i].freq_hz = C.uint32_t(channel.Freq)
+		cLbt.channels[i].scan_time_us = C.uint16_t(channel.ScanTime)
+	}
+	cLbt.nb_channel = C.uint8_t(len(lbt.ChannelsConfig))
+
+	if C.lgw_lbt_setconf(cLbt) != C.LGW_HAL_SUCCESS {
+		return errors.New("LBT configuration failed")
+	}
+	c.lbtEnabled = lbt.Enabled
+	return nil
+}
+
+// LBTEnabled tells whether emissions are subject to listen-before-talk
+func (c *Concentrator) LBTEnabled() bool {
+	return c.lbtEnabled
+}
+
 /*
 ============================
 |                          |
@@ -313,18 +510,19 @@ func SetFSKChannel(fskChan ChannelConf) error {
 ============================
 */
 
-func packetsFromCPackets(cPackets [8]C.struct_lgw_pkt_rx_s, nbPackets int) []Packet {
+func (c *Concentrator) packetsFromCPackets(cPackets [8]C.struct_lgw_pkt_rx_s, nbPackets int) []Packet {
 	var packets = make([]Packet, nbPackets)
+	receivedAt := time.Now()
 	for i := 0; i < nbPackets && i < 8; i++ {
-		packets[i] = packetFromCPacket(cPackets[i])
+		packets[i] = c.packetFromCPacket(cPackets[i])
+		packets[i].ReceivedAt = receivedAt
 	}
 	return packets
 }
 
-func packetFromCPacket(cPacket C.struct_lgw_pkt_rx_s) Packet {
-	// When using packetFromCPacket, it is assumed that accessing gpsTimeReferenceMutex
-	// is safe => Use gpsTimeReferenceMutex before calling packetFromCPacket /before/
-	// using this function
+func (c *Concentrator) packetFromCPacket(cPacket C.struct_lgw_pkt_rx_s) Packet {
+	// When using packetFromCPacket, it is assumed that accessing the GPS time reference
+	// and the location is safe => Lock c.gpsMutex /before/ using this function
 	var p = Packet{
 		Freq:       uint32(cPacket.freq_hz),
 		IFChain:    uint8(cPacket.if_chain),
@@ -341,7 +539,10 @@ func packetFromCPacket(cPacket C.struct_lgw_pkt_rx_s) Packet {
 		MaxSNR:     float32(cPacket.snr_max),
 		CRC:        uint16(cPacket.crc),
 		Size:       uint32(cPacket.size),
+		NoCRC:      cPacket.status == C.STAT_NO_CRC,
 	}
+	// The concentrator only demodulates explicit header packets with uplink polarity,
+	// so NoHeader and InvertPol are always false
 
 	p.Payload = make([]byte, p.Size)
 	var i uint32
@@ -349,18 +550,68 @@ func packetFromCPacket(cPacket C.struct_lgw_pkt_rx_s) Packet {
 		p.Payload[i] = byte(cPacket.payload[i])
 	}
 
+	if p.Modulation == C.MOD_FSK {
+		p.FDev = c.fskFDev
+	}
+
+	c.timestampPacket(&p)
+	if c.location != nil {
+		location := *c.location
+		p.Location = &location
+	}
+
 	return p
 }
 
-func Receive() ([]Packet, error) {
+// SetLoRa changes the modulation of the packet to LoRa with the spreading factor and the
+// bandwidth, in Hz, e.g. to emit it on another channel
+func (p *Packet) SetLoRa(sf uint8, bandwidth uint32) error {
+	datarate, ok := loraChannelSpreadingFactors[uint32(sf)]
+	if !ok {
+		return fmt.Errorf("Invalid spreading factor %d", sf)
+	}
+	bw, ok := loraChannelBandwidths[bandwidth]
+	if !ok {
+		return fmt.Errorf("Invalid bandwidth %d Hz", bandwidth)
+	}
+	p.Modulation = ModulationLoRa
+	p.Datarate = uint32(datarate)
+	p.Bandwidth = uint8(bw)
+	if p.Coderate == C.CR_UNDEFINED {
+		p.Coderate = C.CR_LORA_4_5
+	}
+	p.FDev = 0
+	return nil
+}
+
+// BandwidthHz returns the bandwidth of a LoRa packet in Hz, 0 for other modulations
+func (p *Packet) BandwidthHz() uint32 {
+	if p.Modulation != ModulationLoRa {
+		return 0
+	}
+	for hz, bw := range loraChannelBandwidths {
+		if uint8(bw) == p.Bandwidth {
+			return hz
+		}
+	}
+	return 0
+}
+
+// Receive fetches the packets received since the last call
+func (c *Concentrator) Receive() ([]Packet, error) {
+	if c.worker != nil {
+		return c.worker.receive(c.Location())
+	}
 	var packets [NbMaxPackets]C.struct_lgw_pkt_rx_s
-	concentratorMutex.Lock()
+	c.mutex.Lock()
 	nbPackets := C.lgw_receive(NbMaxPackets, &packets[0])
-	concentratorMutex.Unlock()
+	c.mutex.Unlock()
 	if nbPackets == C.LGW_HAL_ERROR {
-		return nil, errors.New("Failed packet fetch from the concentrator")
+		return nil, &HALError{"Failed packet fetch from the concentrator"}
 	}
-	return packetsFromCPackets(packets, int(nbPackets)), nil
+	c.gpsMutex.Lock()
+	defer c.gpsMutex.Unlock()
+	return c.packetsFromCPackets(packets, int(nbPackets)), nil
 }
 
 /*
@@ -383,38 +634,94 @@ func insertPayload(pkt Packet, txPkt *C.struct_lgw_pkt_tx_s) error {
 	return nil
 }
 
-func SendPacket(pkt Packet) error {
+// txPacketFromPacket prepares the emission of the packet with the same modulation it was received with
+func txPacketFromPacket(pkt Packet, params TxParams) (C.struct_lgw_pkt_tx_s, error) {
 	var txPacket = C.struct_lgw_pkt_tx_s{
 		freq_hz: C.uint32_t(pkt.Freq),
 		// rf_chain:   C.uint8_t(pkt.RFChain),
-		no_crc:    C.bool(false),
-		no_header: C.bool(false),
-		payload:   [256]C.uint8_t{},
-		tx_mode:   C.IMMEDIATE,
-		count_us:  C.uint32_t(pkt.CountUS),
-		bandwidth: C.uint8_t(pkt.Bandwidth),
-		datarate:  C.uint32_t(pkt.Datarate),
+		no_crc:     C.bool(pkt.NoCRC),
+		no_header:  C.bool(pkt.NoHeader),
+		invert_pol: C.bool(params.InvertPol),
+		payload:    [256]C.uint8_t{},
+		tx_mode:    C.IMMEDIATE,
+		count_us:   C.uint32_t(params.CountUS),
+		bandwidth:  C.uint8_t(pkt.Bandwidth),
+		datarate:   C.uint32_t(pkt.Datarate),
 		// datarate:   C.DR_LORA_SF9,
 		coderate: C.uint8_t(pkt.Coderate),
 		// coderate:   C.CR_LORA_4_5,
-		rf_power:   14,
+		rf_power:   C.int8_t(params.RfPower),
 		modulation: C.uint8_t(pkt.Modulation),
+		preamble:   C.uint16_t(pkt.Preamble),
+	}
+
+	if params.Preamble != 0 {
+		txPacket.preamble = C.uint16_t(params.Preamble)
+	}
+
+	// FSK packets are emitted at the datarate (in bps) and deviation they were received with
+	if pkt.Modulation == C.MOD_FSK {
+		if pkt.FDev == 0 {
+			return txPacket, errors.New("No frequency deviation to repeat the FSK packet")
+		}
+		txPacket.f_dev = C.uint8_t(pkt.FDev)
+		txPacket.bandwidth = C.BW_UNDEFINED
+		txPacket.coderate = C.CR_UNDEFINED
+	}
+
+	// The HAL ON_GPS mode triggers the emission on the next PPS pulse: emitting at an
+	// arbitrary GPS time is done by converting it to a counter value
+	if params.Mode == TxTimestamped || params.Mode == TxOnGPS {
+		txPacket.tx_mode = C.TIMESTAMPED
 	}
 
 	// Inserting payload
-	if err := insertPayload(pkt, &txPacket); err != nil {
+	err := insertPayload(pkt, &txPacket)
+	return txPacket, err
+}
+
+// SendPacket emits the packet with the same modulation it was received with, at the
+// time selected by the TX mode
+func (c *Concentrator) SendPacket(pkt Packet, params TxParams) error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "SendPacket", Packet: &pkt, ReceivedAt: pkt.ReceivedAt, Params: &params})
+	}
+	if params.Mode == TxImmediate && c.lbtEnabled {
+		// The HAL can't check the channel for immediate emissions: schedule it shortly
+		// after now, counted from the reception of the packet
+		params.Mode = TxTimestamped
+		params.CountUS = pkt.CountUS + uint32((time.Since(pkt.ReceivedAt)+LBTTxDelay)/time.Microsecond)
+	}
+	if params.Mode == TxOnGPS {
+		countUS, err := c.GPSTimeToCount(params.GPSTime)
+		if err != nil {
+			return err
+		}
+		params.CountUS = countUS
+	}
+
+	txPacket, err := txPacketFromPacket(pkt, params)
+	if err != nil {
 		return err
 	}
+	return c.sendPacketConcentrator(txPacket)
+}
 
-	return sendPacketConcentrator(txPacket)
+// TimeOnAir returns how long the emission of the packet lasts
+func TimeOnAir(pkt Packet, params TxParams) (time.Duration, error) {
+	txPacket, err := txPacketFromPacket(pkt, params)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(C.lgw_time_on_air(&txPacket)) * time.Millisecond, nil
 }
 
-func sendPacketConcentrator(txPacket C.struct_lgw_pkt_tx_s) error {
+func (c *Concentrator) sendPacketConcentrator(txPacket C.struct_lgw_pkt_tx_s) error {
 	for {
 		var txStatus C.uint8_t
-		concentratorMutex.Lock()
+		c.mutex.Lock()
 		var result = C.lgw_status(C.TX_STATUS, &txStatus)
-		concentratorMutex.Unlock()
+		c.mutex.Unlock()
 		if result == C.LGW_HAL_ERROR {
 			fmt.Fprintln(os.Stderr, "Couldn't get concentrator status")
 		} else if txStatus == C.TX_EMITTING {
@@ -428,36 +735,78 @@ func sendPacketConcentrator(txPacket C.struct_lgw_pkt_tx_s) error {
 		break
 	}
 
-	concentratorMutex.Lock()
+	c.mutex.Lock()
 	result := C.lgw_send(txPacket)
-	concentratorMutex.Unlock()
+	c.mutex.Unlock()
 
+	if result == C.LGW_LBT_ISSUE {
+		return ErrLBT
+	}
 	if result == C.LGW_HAL_ERROR {
-		return errors.New("Downlink transmission to the concentrator failed")
+		return &HALError{"Downlink transmission to the concentrator failed"}
 	}
 
 	return nil
 }
 
-func WaitForConcentrator() error {
+// WaitForConcentrator waits for the concentrator to be done emitting, for at most timeout
+func (c *Concentrator) WaitForConcentrator(timeout time.Duration) error {
+	if c.worker != nil {
+		return c.worker.do(workerRequest{Method: "WaitForConcentrator", Timeout: timeout})
+	}
+	var failures int
+	deadline := time.Now().Add(timeout)
 	for {
 		var txStatus C.uint8_t
-		concentratorMutex.Lock()
+		c.mutex.Lock()
 		var result = C.lgw_status(C.TX_STATUS, &txStatus)
-		concentratorMutex.Unlock()
+		c.mutex.Unlock()
 		if result == C.LGW_HAL_ERROR {
 			fmt.Fprintln(os.Stderr, "Couldn't get concentrator status")
+			if failures++; failures >= maxStatusFailures {
+				return &HALError{"Concentrator status unavailable"}
+			}
 		} else if txStatus == C.TX_OFF {
 			// XX: Should we stop emission (like in the legacy packet forwarder) or retry?
 			// If we retry, we might overwrite a normally scheduled downlink, that might
 			// then not be relayed by the concentrator...
-			return errors.New("Concentrator is off")
+			return &HALError{"Concentrator is off"}
 		} else if txStatus == C.TX_STATUS_UNKNOWN {
-			return errors.New("Concentrator status unknown")
+			return &HALError{"Concentrator status unknown"}
 		} else if txStatus == C.TX_FREE {
 			break
 		}
+		if time.Now().After(deadline) {
+			return &HALError{"Concentrator still emitting past the packet time on air"}
+		}
 		time.Sleep(100 * time.Microsecond)
 	}
 	return nil
 }
+
+// TxStatus describes the state of the TX path of the concentrator: free, scheduled,
+// emitting or off
+func (c *Concentrator) TxStatus() (string, error) {
+	if c.worker != nil {
+		resp, err := c.worker.call(workerRequest{Method: "TxStatus"})
+		return resp.Status, err
+	}
+	var txStatus C.uint8_t
+	c.mutex.Lock()
+	var result = C.lgw_status(C.TX_STATUS, &txStatus)
+	c.mutex.Unlock()
+	if result == C.LGW_HAL_ERROR {
+		return "", &HALError{"Couldn't get concentrator status"}
+	}
+	switch txStatus {
+	case C.TX_FREE:
+		return "free", nil
+	case C.TX_SCHEDULED:
+		return "scheduled", nil
+	case C.TX_EMITTING:
+		return "emitting", nil
+	case C.TX_OFF:
+		return "off", nil
+	}
+	return "unknown", nil
+}